@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wamblee.org/kubedock/dns/internal/admissioncontroller"
+	"wamblee.org/kubedock/dns/internal/config"
+	kubedockdns "wamblee.org/kubedock/dns/internal/dns"
+	"wamblee.org/kubedock/dns/internal/model"
+	"wamblee.org/kubedock/dns/internal/networkdefinition"
+	"wamblee.org/kubedock/dns/internal/registration"
+	"wamblee.org/kubedock/dns/internal/support"
+	"wamblee.org/kubedock/dns/internal/watcher"
+)
+
+// Harness runs the DNS server, pod watcher and admission controller in-process
+// against a fake clientset. Pods get loopback IPs (127.x.y.z) so that DNS queries
+// can be sent from the pod IP by binding the client to it.
+type Harness struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	namespace string
+	config    config.Config
+	wg        sync.WaitGroup
+	clientset *fake.Clientset
+	dns       *kubedockdns.KubeDockDns
+	pods      *model.Pods
+	readiness *support.Readiness
+	admission *httptest.Server
+	changes   *registration.Changes
+
+	upstreamCalls atomic.Int32
+}
+
+// upstreamFunc is the upstream DNS server used by the harness. It resolves every
+// name to UPSTREAM_IP.
+type upstreamFunc func(r *dns.Msg) *dns.Msg
+
+func (f upstreamFunc) Resolve(r *dns.Msg) *dns.Msg {
+	return f(r)
+}
+
+const (
+	UPSTREAM_IP       = "1.2.3.4"
+	HARNESS_NAMESPACE = "kubedock"
+	DNS_SERVICE_NAME  = "kubedock-dns-server"
+	DNS_SERVICE_IP    = "10.96.0.53"
+	SEARCH_DOMAIN     = "kubedock.svc.cluster.local"
+	// Namespaces of teams that are watched in addition to the harness namespace.
+	TEAM_A_NAMESPACE = "team-a"
+	TEAM_B_NAMESPACE = "team-b"
+	// Global network that only TEAM_A_NAMESPACE may join.
+	RESTRICTED_NETWORK = "restricted"
+	// Bearer token of the registration API.
+	API_TOKEN = "kubedock-token"
+)
+
+func NewHarness() (*Harness, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	harness := &Harness{
+		ctx:       ctx,
+		cancel:    cancel,
+		namespace: HARNESS_NAMESPACE,
+		config: config.Config{
+			ServiceName: DNS_SERVICE_NAME,
+			PodConfig: config.PodConfig{
+				HostAliasPrefix:            "kubedock.hostalias/",
+				NetworkIdPrefix:            "kubedock.network/",
+				LabelName:                  "kubedock",
+				ExpiresAnnotation:          model.EXPIRES_ANNOTATION,
+				InternalNetworksAnnotation: model.INTERNAL_NETWORKS_ANNOTATION,
+				GlobalNetworks: map[string][]string{
+					RESTRICTED_NETWORK: {TEAM_A_NAMESPACE},
+					"fixtures":         nil,
+				},
+				NetworkDefinitions: networkdefinition.NewDefinitions(),
+				SetHostname:        true,
+				ShadowPolicy:       model.SHADOW_POLICY_SERVICE,
+			},
+			Namespaces:           []string{HARNESS_NAMESPACE, TEAM_A_NAMESPACE, TEAM_B_NAMESPACE},
+			WatchServices:        true,
+			ShutdownTimeout:      5 * time.Second,
+			DnsUpdateQuietPeriod: 10 * time.Millisecond,
+			DnsUpdateMaxDelay:    100 * time.Millisecond,
+			Events:               true,
+			AnnotateNetworkView:  true,
+			// only networks with an expiry annotation are cleaned up.
+			Janitor:         true,
+			JanitorInterval: 100 * time.Millisecond,
+		},
+	}
+
+	harness.clientset = fake.NewClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DNS_SERVICE_NAME,
+			Namespace: HARNESS_NAMESPACE,
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: DNS_SERVICE_IP,
+		},
+	})
+	// The fake clientset does not support resource versions, so objects created between
+	// the initial list and the start of the watch would be missed. Therefore, wait
+	// for the watches to be established before returning. Services are watched both for
+	// network members and for the shadow policy.
+	watchedResources := map[string]int32{"pods": 1, "services": 2, "endpointslices": 1, "configmaps": 1}
+	watches := make([]<-chan struct{}, 0)
+	for resource, count := range watchedResources {
+		watching := make(chan struct{})
+		var started atomic.Int32
+		harness.clientset.PrependWatchReactor(resource,
+			func(action k8stesting.Action) (bool, watch.Interface, error) {
+				watcher, err := harness.clientset.Tracker().Watch(
+					action.GetResource(), action.GetNamespace())
+				if started.Add(1) == count {
+					close(watching)
+				}
+				return true, watcher, err
+			})
+		watches = append(watches, watching)
+	}
+
+	upstream := upstreamFunc(func(r *dns.Msg) *dns.Msg {
+		harness.upstreamCalls.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, question := range r.Question {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: net.ParseIP(UPSTREAM_IP),
+			})
+		}
+		return m
+	})
+	harness.dns = kubedockdns.NewKubeDockDns(upstream, "127.0.0.1:0", SEARCH_DOMAIN, []string{})
+
+	namespaces, err := getNamespaces(harness.clientset, harness.namespace, harness.config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	harness.readiness = newReadiness(harness.config)
+	harness.changes = registration.NewChanges()
+	serviceExists := startServiceNames(ctx, &harness.wg, harness.readiness, harness.clientset, namespaces)
+	pods, err := startDnsAndWatcher(ctx, &harness.wg, harness.readiness, harness.clientset, namespaces,
+		harness.dns, serviceExists, harness.config, harness.changes.NetworksChanged)
+	if err != nil {
+		cancel()
+		harness.wg.Wait()
+		return nil, err
+	}
+	harness.pods = pods
+
+	clientConfig := &dns.ClientConfig{
+		Servers:  []string{DNS_SERVICE_IP},
+		Search:   []string{SEARCH_DOMAIN},
+		Ndots:    5,
+		Timeout:  10,
+		Attempts: 3,
+	}
+	registry := registration.NewRegistry(pods, harness.dns.Networks, harness.config.PodConfig, API_TOKEN,
+		namespaces.Watched, harness.changes)
+	mux, err := admissioncontroller.NewAdmissionHandler(ctx, pods, harness.readiness, harness.clientset,
+		harness.namespace, namespaces.Watched, serviceExists, harness.config.ServiceName, clientConfig,
+		harness.config.PodConfig,
+		registry.Handler())
+	if err != nil {
+		cancel()
+		harness.wg.Wait()
+		return nil, err
+	}
+	harness.admission = httptest.NewServer(mux)
+
+	for _, started := range append(watches, harness.readiness.Ready()) {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			harness.Stop()
+			return nil, fmt.Errorf("Not ready: %v", harness.readiness.Pending())
+		}
+	}
+	return harness, nil
+}
+
+// Stop stops all components in the same way as on receiving SIGTERM and waits for them
+// to complete.
+func (harness *Harness) Stop() {
+	// watches only end when the changes are closed.
+	harness.changes.Close()
+	harness.admission.Close()
+	harness.cancel()
+	harness.wg.Wait()
+}
+
+// NewPod creates the definition of a kubedock pod in the harness namespace.
+func (harness *Harness) NewPod(name string, hostAliases []string, networks []string) *corev1.Pod {
+	annotations := make(map[string]string)
+	for i, hostAlias := range hostAliases {
+		annotations[harness.config.PodConfig.HostAliasPrefix+strconv.Itoa(i)] = hostAlias
+	}
+	for i, network := range networks {
+		annotations[harness.config.PodConfig.NetworkIdPrefix+strconv.Itoa(i)] = network
+	}
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   harness.namespace,
+			Annotations: annotations,
+			Labels: map[string]string{
+				harness.config.PodConfig.LabelName: "true",
+			},
+		},
+	}
+}
+
+// Admit sends an admission review for the pod to the admission controller.
+func (harness *Harness) Admit(operation admissionv1.Operation,
+	pod *corev1.Pod) (*admissionv1.AdmissionResponse, error) {
+	podRaw, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AdmissionReview",
+			APIVersion: "admission.k8s.io/v1",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID(strconv.FormatInt(time.Now().UnixNano(), 10)),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: podRaw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(harness.admission.URL+"/mutate/pods", "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Admission request failed with status %d", resp.StatusCode)
+	}
+	var result admissionv1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Response, nil
+}
+
+// Deploy admits the pod and when allowed, creates it in the cluster with the given IP,
+// similar to what happens when a pod is scheduled.
+func (harness *Harness) Deploy(pod *corev1.Pod, ip string, ready bool) (*admissionv1.AdmissionResponse, error) {
+	response, err := harness.Admit(admissionv1.Create, pod)
+	if err != nil || !response.Allowed {
+		return response, err
+	}
+	pod = pod.DeepCopy()
+	pod.Status.PodIP = ip
+	pod.Status.Conditions = podConditions(ready)
+	_, err = harness.clientset.CoreV1().Pods(pod.Namespace).Create(harness.ctx, pod, metav1.CreateOptions{})
+	return response, err
+}
+
+func (harness *Harness) SetReady(name string, ready bool) error {
+	pod, err := harness.clientset.CoreV1().Pods(harness.namespace).Get(harness.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	pod.Status.Conditions = podConditions(ready)
+	_, err = harness.clientset.CoreV1().Pods(harness.namespace).UpdateStatus(harness.ctx, pod, metav1.UpdateOptions{})
+	return err
+}
+
+// EventReasons returns the reasons of the events on a pod in the harness namespace.
+func (harness *Harness) EventReasons(name string) ([]string, error) {
+	events, err := harness.clientset.CoreV1().Events(harness.namespace).List(harness.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	reasons := make([]string, 0)
+	for _, event := range events.Items {
+		if event.InvolvedObject.Kind == "Pod" && event.InvolvedObject.Name == name {
+			reasons = append(reasons, event.Reason)
+		}
+	}
+	return reasons, nil
+}
+
+// Api sends a request to the registration API with the path relative to the harness
+// namespace and decodes the JSON response into result, which may be nil.
+func (harness *Harness) Api(method string, path string, body any, result any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(harness.ctx, method,
+		harness.admission.URL+registration.PREFIX+"/namespaces/"+harness.namespace+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+API_TOKEN)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if result != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Watch watches the networks in the harness namespace through the registration API. The
+// query selects the networks to watch. The returned channel is closed when the watch ends.
+func (harness *Harness) Watch(query string) (<-chan registration.Change, error) {
+	request, err := http.NewRequestWithContext(harness.ctx, "GET",
+		harness.admission.URL+registration.PREFIX+"/namespaces/"+harness.namespace+"/watch"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+API_TOKEN)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Watch failed with status %d", resp.StatusCode)
+	}
+	changes := make(chan registration.Change, 100)
+	go func() {
+		defer close(changes)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, found := strings.CutPrefix(scanner.Text(), "data: ")
+			if !found {
+				continue
+			}
+			var change registration.Change
+			if err := json.Unmarshal([]byte(data), &change); err == nil {
+				changes <- change
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// Annotation returns an annotation of a pod in the harness namespace.
+func (harness *Harness) Annotation(name string, annotation string) (string, error) {
+	pod, err := harness.clientset.CoreV1().Pods(harness.namespace).Get(harness.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return pod.Annotations[annotation], nil
+}
+
+func (harness *Harness) Delete(name string) error {
+	return harness.clientset.CoreV1().Pods(harness.namespace).Delete(harness.ctx, name, metav1.DeleteOptions{})
+}
+
+// CreateService creates a service in the harness namespace annotated with the host aliases and
+// networks. An empty cluster IP creates a headless service.
+func (harness *Harness) CreateService(name string, clusterIP string, hostAliases []string,
+	networks []string) error {
+	annotations := harness.NewPod(name, hostAliases, networks).Annotations
+	if clusterIP == "" {
+		clusterIP = corev1.ClusterIPNone
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   harness.namespace,
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: clusterIP,
+		},
+	}
+	_, err := harness.clientset.CoreV1().Services(harness.namespace).Create(harness.ctx, service, metav1.CreateOptions{})
+	return err
+}
+
+func (harness *Harness) DeleteService(name string) error {
+	return harness.clientset.CoreV1().Services(harness.namespace).Delete(harness.ctx, name, metav1.DeleteOptions{})
+}
+
+// SetEndpoints creates or updates the endpoint slice of a service with the given ready and
+// not ready addresses.
+func (harness *Harness) SetEndpoints(service string, ready []string, notReady []string) error {
+	endpointSlice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service + "-1",
+			Namespace: harness.namespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for _, addresses := range []struct {
+		ips   []string
+		ready bool
+	}{{ready, true}, {notReady, false}} {
+		for _, ip := range addresses.ips {
+			endpointSlice.Endpoints = append(endpointSlice.Endpoints, discoveryv1.Endpoint{
+				Addresses:  []string{ip},
+				Conditions: discoveryv1.EndpointConditions{Ready: &addresses.ready},
+			})
+		}
+	}
+	endpointSlices := harness.clientset.DiscoveryV1().EndpointSlices(harness.namespace)
+	_, err := endpointSlices.Update(harness.ctx, endpointSlice, metav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		_, err = endpointSlices.Create(harness.ctx, endpointSlice, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// SetNetworkDefinitions creates or updates the ConfigMap with network definitions in the
+// harness namespace.
+func (harness *Harness) SetNetworkDefinitions(definitions map[string]string) error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "network-definitions",
+			Namespace: harness.namespace,
+			Labels: map[string]string{
+				watcher.NetworkDefinitionLabel(harness.config.PodConfig): "true",
+			},
+		},
+		Data: definitions,
+	}
+	configMaps := harness.clientset.CoreV1().ConfigMaps(harness.namespace)
+	_, err := configMaps.Update(harness.ctx, configMap, metav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(harness.ctx, configMap, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// NewUnmanagedPod returns a pod without the kubedock label and annotations, such as a pod
+// created by a Job or operator.
+func (harness *Harness) NewUnmanagedPod(name string, podLabels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: harness.namespace,
+			Labels:    podLabels,
+		},
+	}
+}
+
+// CreateUnmanagedPod creates a running unmanaged pod without admitting it.
+func (harness *Harness) CreateUnmanagedPod(name string, ip string, podLabels map[string]string) error {
+	pod := harness.NewUnmanagedPod(name, podLabels)
+	pod.Status = corev1.PodStatus{
+		PodIP:      ip,
+		Conditions: podConditions(true),
+	}
+	_, err := harness.clientset.CoreV1().Pods(harness.namespace).Create(harness.ctx, pod, metav1.CreateOptions{})
+	return err
+}
+
+func podConditions(ready bool) []corev1.PodCondition {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return []corev1.PodCondition{
+		{Type: corev1.PodReady, Status: status},
+	}
+}
+
+// Query sends a DNS query over UDP to the DNS server from the given source IP.
+func (harness *Harness) Query(sourceIp string, name string, qtype uint16) (*dns.Msg, error) {
+	return harness.QueryNet("udp", sourceIp, name, qtype)
+}
+
+// QueryNet sends a DNS query over udp or tcp to the DNS server from the given source IP.
+func (harness *Harness) QueryNet(network string, sourceIp string, name string, qtype uint16) (*dns.Msg, error) {
+	var localAddr net.Addr = &net.UDPAddr{IP: net.ParseIP(sourceIp)}
+	if network == "tcp" {
+		localAddr = &net.TCPAddr{IP: net.ParseIP(sourceIp)}
+	}
+	client := dns.Client{
+		Net:     network,
+		Timeout: 2 * time.Second,
+		Dialer: &net.Dialer{
+			LocalAddr: localAddr,
+		},
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	response, _, err := client.Exchange(m, harness.dns.Addr())
+	return response, err
+}
+
+// Lookup resolves A records for a hostname from the given source IP.
+func (harness *Harness) Lookup(sourceIp string, hostname string) ([]string, error) {
+	response, err := harness.Query(sourceIp, dns.Fqdn(hostname), dns.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0)
+	for _, rr := range response.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A.String())
+		}
+	}
+	slices.Sort(ips)
+	return ips, nil
+}
+
+// ReverseLookup resolves the PTR records for an IP from the given source IP.
+func (harness *Harness) ReverseLookup(sourceIp string, ip string) ([]string, error) {
+	reverse, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	response, err := harness.Query(sourceIp, reverse, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0)
+	for _, rr := range response.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			hosts = append(hosts, ptr.Ptr)
+		}
+	}
+	slices.Sort(hosts)
+	return hosts, nil
+}
+
+// Eventually polls the condition until it is true or the timeout expires. Changes to
+// pods reach the DNS server asynchronously through the watcher.
+func Eventually(timeout time.Duration, condition func() bool) bool {
+	tend := time.Now().Add(timeout)
+	for time.Now().Before(tend) {
+		if condition() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return condition()
+}
@@ -2,16 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	goflags "flag"
 	"fmt"
 	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"wamblee.org/kubedock/dns/internal/admissioncontroller"
+	"wamblee.org/kubedock/dns/internal/certificates"
 	"wamblee.org/kubedock/dns/internal/config"
 	"wamblee.org/kubedock/dns/internal/dns"
+	"wamblee.org/kubedock/dns/internal/events"
+	"wamblee.org/kubedock/dns/internal/janitor"
+	"wamblee.org/kubedock/dns/internal/metrics"
 	"wamblee.org/kubedock/dns/internal/model"
+	"wamblee.org/kubedock/dns/internal/networkdefinition"
+	"wamblee.org/kubedock/dns/internal/networkview"
+	"wamblee.org/kubedock/dns/internal/registration"
 	"wamblee.org/kubedock/dns/internal/support"
 	"wamblee.org/kubedock/dns/internal/watcher"
 )
@@ -28,30 +44,97 @@ func createDns(config config.Config) *dns.KubeDockDns {
 	return kubedocDns
 }
 
+// Conditions that must be met before the server is ready.
+const (
+	READY_DNS  = "dns"
+	READY_PODS = "pods"
+	// only when services are watched.
+	READY_SERVICES      = "services"
+	READY_SERVICE_NAMES = "service-names"
+	// only with managed certificates, when the webhooks trust the serving certificate.
+	READY_CERTIFICATES = "certificates"
+)
+
 type DnsWatcherIntegration struct {
-	pods *model.Pods
-	dns  *dns.KubeDockDns
+	// updates of the DNS are done both for the initial sync and by the coalescer
+	mutex     sync.Mutex
+	pods      *model.Pods
+	dns       *dns.KubeDockDns
+	readiness *support.Readiness
+	// called after each update of the DNS with the new networks.
+	networksChanged []func(*model.Networks)
+	// changes are batched so that many changes in a short time, such as deleting all
+	// pods of a test, lead to only a single update of the DNS.
+	coalescer *support.Coalescer
+}
+
+func NewDnsWatcherIntegration(pods *model.Pods, dns *dns.KubeDockDns, readiness *support.Readiness,
+	config config.Config, networksChanged ...func(*model.Networks)) *DnsWatcherIntegration {
+	integrator := DnsWatcherIntegration{
+		pods:            pods,
+		dns:             dns,
+		readiness:       readiness,
+		networksChanged: networksChanged,
+	}
+	integrator.coalescer = support.NewCoalescer(config.DnsUpdateQuietPeriod, config.DnsUpdateMaxDelay,
+		func(batchSize int) {
+			klog.V(2).Infof("Updating DNS for %d changes", batchSize)
+			metrics.DnsUpdateBatchSize.Observe(float64(batchSize))
+			integrator.updateDns()
+		})
+	return &integrator
 }
 
 func (integrator *DnsWatcherIntegration) AddOrUpdate(pod *model.Pod) {
 	klog.V(2).Infof("%v/%v: Pod added or updated", pod.Namespace, pod.Name)
 	if integrator.pods.AddOrUpdate(pod) {
-		integrator.updateDns()
+		integrator.coalescer.Trigger()
 	}
 }
 
 func (integrator *DnsWatcherIntegration) Delete(namespace, name string) {
 	klog.V(2).Infof("%v/%v: deleted", namespace, name)
-	integrator.pods.Delete(namespace, name)
+	if integrator.pods.Delete(namespace, name) {
+		integrator.coalescer.Trigger()
+	}
+}
+
+func (integrator *DnsWatcherIntegration) Synced() {
+	klog.Info("Initial pods synchronized")
 	integrator.updateDns()
+	integrator.readiness.Set(READY_PODS)
+}
+
+func (integrator *DnsWatcherIntegration) SetServiceMembers(namespace string, service string,
+	members []*model.Pod) {
+	if integrator.pods.SetServiceMembers(namespace, service, members) {
+		integrator.coalescer.Trigger()
+	}
+}
+
+func (integrator *DnsWatcherIntegration) ServicesSynced() {
+	klog.Info("Initial services synchronized")
+	integrator.coalescer.Trigger()
+	integrator.readiness.Set(READY_SERVICES)
 }
 
 func (integrator *DnsWatcherIntegration) updateDns() {
+	integrator.mutex.Lock()
+	defer integrator.mutex.Unlock()
+
+	t0 := time.Now()
 	networks, err := integrator.pods.Networks()
+	metrics.DnsUpdateDuration.Observe(time.Since(t0).Seconds())
 	if err != nil {
 		klog.Warningf("Errors occured creating network configuration, only conflicting pods are affected '%v'", err)
 	}
 	integrator.dns.SetNetworks(networks)
+	for quota, usage := range networks.QuotaUsage() {
+		metrics.QuotaUsage.WithLabelValues(quota).Set(float64(usage))
+	}
+	for _, networksChanged := range integrator.networksChanged {
+		networksChanged(networks)
+	}
 	if klog.V(3).Enabled() {
 		networks.Log()
 	}
@@ -69,16 +152,53 @@ func execute(cmd *cobra.Command, args []string, config config.Config) error {
 	fmt.Printf("Host alias prefix:  %s\n", config.PodConfig.HostAliasPrefix)
 	fmt.Printf("Network prefix:     %s\n", config.PodConfig.NetworkIdPrefix)
 	fmt.Printf("Pod label:          %s\n", config.PodConfig.LabelName)
-	fmt.Printf("CRT file:           %s\n", config.CrtFile)
-	fmt.Printf("KEY file:           %s\n", config.KeyFile)
+	fmt.Printf("Expires annotation: %s\n", config.PodConfig.ExpiresAnnotation)
+	fmt.Printf("Internal networks annotation: %s\n", config.PodConfig.InternalNetworksAnnotation)
+	fmt.Printf("Global networks:    %v\n", config.PodConfig.GlobalNetworks)
+	fmt.Printf("Undeclared global:  %v\n", config.PodConfig.UndeclaredGlobalNetworks)
+	fmt.Printf("Network defs:       %v\n", config.PodConfig.NetworkDefinitions != nil)
+	fmt.Printf("Set hostname:       %v\n", config.PodConfig.SetHostname)
+	fmt.Printf("Hostname as FQDN:   %v\n", config.PodConfig.HostnameAsFQDN)
+	fmt.Printf("Rejected warnings:  %v\n", config.PodConfig.RejectedWarnings)
+	fmt.Printf("Shadow policy:      %s\n", config.PodConfig.ShadowPolicy)
+	fmt.Printf("Quotas:             %+v\n", config.PodConfig.Quotas)
+	for quota, limit := range model.QuotaLimits(config.PodConfig.Quotas) {
+		metrics.QuotaLimit.WithLabelValues(quota).Set(float64(limit))
+	}
+	if config.ManageCertificates {
+		fmt.Printf("Cert secret:        %s\n", config.CertificateSecret)
+		fmt.Printf("Cert validity:      %v\n", config.CertificateValidity)
+		fmt.Printf("Mutating hooks:     %v\n", config.MutatingWebhookConfigs)
+		fmt.Printf("Validating hooks:   %v\n", config.ValidatingWebhookConfigs)
+	} else {
+		fmt.Printf("CRT file:           %s\n", config.CrtFile)
+		fmt.Printf("KEY file:           %s\n", config.KeyFile)
+	}
+	fmt.Printf("API token file:     %s\n", config.ApiTokenFile)
 	fmt.Printf("Client DNS timeout: %v\n", config.DnsTimeout)
 	fmt.Printf("Client DNS retries: %v\n", config.DnsRetries)
 
-	ctx := context.Background()
+	fmt.Printf("Watch services:     %v\n", config.WatchServices)
+	fmt.Printf("Shutdown timeout:   %v\n", config.ShutdownTimeout)
+	fmt.Printf("Reconcile interval: %v\n", config.ReconcileInterval)
+	fmt.Printf("DNS update quiet:   %v\n", config.DnsUpdateQuietPeriod)
+	fmt.Printf("DNS update delay:   %v\n", config.DnsUpdateMaxDelay)
+	fmt.Printf("Events:             %v\n", config.Events)
+	if config.Janitor {
+		fmt.Printf("Network TTL:        %v\n", config.NetworkTTL)
+		fmt.Printf("Janitor dry run:    %v\n", config.JanitorDryRun)
+		fmt.Printf("Janitor interval:   %v\n", config.JanitorInterval)
+	}
+	fmt.Printf("Network view:       %v\n", config.AnnotateNetworkView)
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	clientset, namespace := support.GetKubernetesConnection()
-
-	klog.Infof("Watching namespace %s", namespace)
+	namespaces, err := getNamespaces(clientset, namespace, config)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Watching namespaces %s", namespaces)
 
 	// DNS server
 	dns := createDns(config)
@@ -86,27 +206,279 @@ func execute(cmd *cobra.Command, args []string, config config.Config) error {
 	if sourceIp != "" {
 		dns.OverrideSourceIP(model.IPAddress(sourceIp))
 	}
+
+	// changes of the networks for the watch API of the registration API.
+	var changes *registration.Changes
+	networksChanged := make([]func(*model.Networks), 0)
+	if config.ApiTokenFile != "" {
+		changes = registration.NewChanges()
+		context.AfterFunc(ctx, changes.Close)
+		networksChanged = append(networksChanged, changes.NetworksChanged)
+	}
+
+	var wg sync.WaitGroup
+	readiness := newReadiness(config)
+	serviceExists := startServiceNames(ctx, &wg, readiness, clientset, namespaces)
+	pods, err := startDnsAndWatcher(ctx, &wg, readiness, clientset, namespaces, dns, serviceExists, config,
+		networksChanged...)
+	if err != nil {
+		return err
+	}
+
+	getCertificate, err := startCertificates(ctx, &wg, readiness, clientset, namespace, config)
+	if err != nil {
+		stop()
+		wg.Wait()
+		return err
+	}
+
+	registry, err := newRegistry(pods, dns, namespaces, config, changes)
+	if err != nil {
+		stop()
+		wg.Wait()
+		return err
+	}
+
+	// Admission controller, this only returns on shutdown or when it could not be started.
+	err = admissioncontroller.RunAdmisstionController(ctx, pods, readiness, clientset, namespace,
+		namespaces.Watched, serviceExists, config.ServiceName,
+		getCertificate, config.PodConfig, registry, config.ShutdownTimeout)
+
+	stop()
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("Could not start admission controller: %+v", err)
+	}
+	klog.Info("Stopped")
+	return nil
+}
+
+// startCertificates provides the serving certificate of the webhooks. Managed certificates
+// are renewed in the background until the context is canceled, and the readiness condition
+// READY_CERTIFICATES is set once the webhooks trust them. Otherwise, the certificate files
+// are reloaded when they change.
+func startCertificates(ctx context.Context, wg *sync.WaitGroup, readiness *support.Readiness,
+	clientset kubernetes.Interface, namespace string, config config.Config) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	if !config.ManageCertificates {
+		files, err := certificates.NewKeyPairFiles(config.CrtFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return files.GetCertificate, nil
+	}
+	manager := certificates.NewManager(clientset, namespace, config)
+	if err := manager.Start(ctx); err != nil {
+		return nil, err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		manager.Run(ctx, config.CertificateCheckInterval)
+	}()
 	go func() {
-		dns.Serve()
+		select {
+		case <-manager.Trusted():
+			readiness.Set(READY_CERTIFICATES)
+		case <-ctx.Done():
+		}
+	}()
+	return manager.GetCertificate, nil
+}
+
+// newRegistry creates the handler of the registration API, which is nil when the API is
+// disabled.
+func newRegistry(pods *model.Pods, dns *dns.KubeDockDns, namespaces *watcher.Namespaces,
+	config config.Config, changes *registration.Changes) (http.Handler, error) {
+	if config.ApiTokenFile == "" {
+		return nil, nil
+	}
+	token, err := os.ReadFile(config.ApiTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read API token: %v", err)
+	}
+	if strings.TrimSpace(string(token)) == "" {
+		return nil, fmt.Errorf("API token file %s is empty", config.ApiTokenFile)
+	}
+	registry := registration.NewRegistry(pods, dns.Networks, config.PodConfig,
+		strings.TrimSpace(string(token)), namespaces.Watched, changes)
+	return registry.Handler(), nil
+}
+
+func newReadiness(config config.Config) *support.Readiness {
+	conditions := []string{READY_DNS, READY_PODS}
+	if config.WatchServices {
+		conditions = append(conditions, READY_SERVICES)
+	}
+	conditions = append(conditions, READY_SERVICE_NAMES)
+	if config.ManageCertificates {
+		conditions = append(conditions, READY_CERTIFICATES)
+	}
+	return support.NewReadiness(conditions...)
+}
+
+// shadowPolicyInDns returns true when the DNS server must apply the shadow policy. With the
+// local policy, which is the default, lookups do not depend on services.
+func shadowPolicyInDns(config config.Config) bool {
+	policy := config.PodConfig.ShadowPolicy
+	return policy == model.SHADOW_POLICY_SERVICE || policy == model.SHADOW_POLICY_REJECT
+}
+
+// getNamespaces determines the namespaces to watch. By default, this is only the namespace
+// of the DNS server.
+func getNamespaces(clientset kubernetes.Interface, namespace string,
+	config config.Config) (*watcher.Namespaces, error) {
+	if config.NamespaceSelector != "" {
+		if len(config.Namespaces) > 0 {
+			return nil, fmt.Errorf("Namespaces and a namespace selector cannot both be specified")
+		}
+		return watcher.NewNamespaceSelector(clientset, config.NamespaceSelector)
+	}
+	if len(config.Namespaces) > 0 {
+		return watcher.NewNamespaceList(config.Namespaces...), nil
+	}
+	return watcher.NewNamespaceList(namespace), nil
+}
+
+// startServiceNames watches the names of services and sets the readiness condition
+// READY_SERVICE_NAMES when they are known. The returned function is shared by the DNS server
+// and the admission controller, which warns about host aliases that shadow services.
+func startServiceNames(ctx context.Context, wg *sync.WaitGroup, readiness *support.Readiness,
+	clientset kubernetes.Interface, namespaces *watcher.Namespaces) func(namespace string, name string) bool {
+	serviceNames := watcher.NewServiceNames(clientset, namespaces)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serviceNames.Run(ctx, func() {
+			readiness.Set(READY_SERVICE_NAMES)
+		})
+	}()
+	return serviceNames.Exists
+}
+
+// startDnsAndWatcher starts serving DNS and watching pods. The returned pod administration
+// is shared with the admission controller. The wait group is done when all started components
+// have stopped after the context is canceled. The readiness conditions READY_DNS, READY_PODS,
+// and READY_SERVICES are set when met. The shadow policy is applied using serviceExists unless
+// it is local. The given listeners are called in addition to the configured ones when the
+// networks change.
+func startDnsAndWatcher(ctx context.Context, wg *sync.WaitGroup, readiness *support.Readiness,
+	clientset kubernetes.Interface, namespaces *watcher.Namespaces, dns *dns.KubeDockDns,
+	serviceExists func(namespace string, name string) bool,
+	config config.Config, listeners ...func(*model.Networks)) (*model.Pods, error) {
+	var recorder record.EventRecorder
+	// the janitor always reports deletions as events.
+	if config.Events || config.Janitor {
+		recorder = events.NewEventRecorder(ctx, clientset)
+	}
+	var networkJanitor *janitor.Janitor
+	if config.Janitor {
+		networkJanitor = janitor.NewJanitor(clientset, recorder, config.NetworkTTL, config.JanitorDryRun)
+		// queries are activity in the networks of their source, this must be set before serving.
+		dns.OnQuery(networkJanitor.Queried)
+	}
+	if shadowPolicyInDns(config) {
+		// this must be set before serving.
+		dns.SetShadowPolicy(config.PodConfig.ShadowPolicy, serviceExists)
+	}
+
+	if err := dns.Listen(); err != nil {
+		return nil, err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := dns.Serve(ctx, config.ShutdownTimeout); err != nil {
+			klog.Errorf("DNS server stopped: %v", err)
+		}
+	}()
+	go func() {
+		select {
+		case <-dns.Started():
+			readiness.Set(READY_DNS)
+		case <-ctx.Done():
+		}
 	}()
 
 	// pod administration
 	pods := model.NewPods()
-	dnsWatcherIntegration := &DnsWatcherIntegration{
-		pods: pods,
-		dns:  dns,
+	networksChanged := slices.Clone(listeners)
+	if config.Events {
+		networkEvents := events.NewNetworkEvents(recorder)
+		networksChanged = append(networksChanged, networkEvents.NetworksChanged)
+	}
+	if networkJanitor != nil {
+		networksChanged = append(networksChanged, networkJanitor.NetworksChanged)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			networkJanitor.Run(ctx, config.JanitorInterval)
+		}()
+	}
+	if config.AnnotateNetworkView {
+		annotator := networkview.NewAnnotator(clientset)
+		networksChanged = append(networksChanged, annotator.NetworksChanged)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			annotator.Run(ctx)
+		}()
 	}
+	dnsWatcherIntegration := NewDnsWatcherIntegration(pods, dns, readiness, config, networksChanged...)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dnsWatcherIntegration.coalescer.Run(ctx)
+	}()
 
 	// Watching Pods
-	go watcher.WatchPods(clientset, namespace, dnsWatcherIntegration, config.PodConfig)
+	podWatcher := watcher.NewPodWatcher(clientset, namespaces, dnsWatcherIntegration, config.PodConfig)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := podWatcher.Run(ctx); err != nil {
+			klog.Errorf("Could not watch pods: %v", err)
+		}
+		klog.Info("Pod watcher stopped")
+	}()
 
-	// Admission controller
+	if config.WatchServices {
+		serviceWatcher := watcher.NewServiceWatcher(clientset, namespaces, dnsWatcherIntegration, config.PodConfig)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serviceWatcher.Run(ctx); err != nil {
+				klog.Errorf("Could not watch services: %v", err)
+			}
+			klog.Info("Service watcher stopped")
+		}()
+	}
 
-	if err := admissioncontroller.RunAdmisstionController(ctx, pods, clientset, namespace, config.ServiceName,
-		config.CrtFile, config.KeyFile, config.PodConfig); err != nil {
-		return fmt.Errorf("Could not start admission controller: %+v", err)
+	if config.ReconcileInterval > 0 {
+		reconciler := watcher.NewReconciler(pods, podWatcher, dnsWatcherIntegration.coalescer.Trigger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reconciler.Run(ctx, config.ReconcileInterval)
+		}()
 	}
-	return nil
+	return pods, nil
+}
+
+// parseGlobalNetworks parses global network definitions of the form '<network>' or
+// '<network>=<namespace>,...' where the namespaces are the namespaces that may join.
+func parseGlobalNetworks(definitions []string) (map[string][]string, error) {
+	globalNetworks := make(map[string][]string)
+	for _, definition := range definitions {
+		network, namespaces, found := strings.Cut(definition, "=")
+		if network == "" || (found && namespaces == "") {
+			return nil, fmt.Errorf("Invalid global network '%s', expected <network>[=<namespace>,...]", definition)
+		}
+		globalNetworks[network] = nil
+		if found {
+			globalNetworks[network] = strings.Split(namespaces, ",")
+		}
+	}
+	return globalNetworks, nil
 }
 
 func main() {
@@ -114,6 +486,8 @@ func main() {
 	klog.InitFlags(klogFlags)
 
 	config := config.Config{}
+	var globalNetworkDefinitions []string
+	var useNetworkDefinitions bool
 	cmd := &cobra.Command{
 		Use:   "kubedock-dns",
 		Short: "Run a DNS server and mutator for test containers",
@@ -121,10 +495,24 @@ func main() {
 Run a DNS server and mutator for test containers. 
 By labeling PODs with the host aliases and networks, 
 this provides separate networks of communicating pods
-in a single namespace. Thus emulating a typical docker
+in one or more namespaces. Thus emulating a typical docker
 setup with host aliases where some containers share a 
 network`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			globalNetworks, err := parseGlobalNetworks(globalNetworkDefinitions)
+			if err != nil {
+				return err
+			}
+			config.PodConfig.GlobalNetworks = globalNetworks
+			if err := admissioncontroller.ValidateWarningKinds(config.PodConfig.RejectedWarnings); err != nil {
+				return err
+			}
+			if err := model.ValidateShadowPolicy(config.PodConfig.ShadowPolicy); err != nil {
+				return err
+			}
+			if useNetworkDefinitions {
+				config.PodConfig.NetworkDefinitions = networkdefinition.NewDefinitions()
+			}
 			return execute(cmd, args, config)
 		},
 	}
@@ -133,22 +521,97 @@ network`,
 		"kubedock-dns-server", "Service name of the k8s DNS service that is configured for kubedock-dns")
 	cmd.PersistentFlags().StringVar(&config.PodConfig.HostAliasPrefix, "host-alias-prefix",
 		"kubedock.hostalias/", "annotation prefix for hosttnames. ")
+	cmd.PersistentFlags().StringVar(&config.PodConfig.ExpiresAnnotation, "expires-annotation",
+		model.EXPIRES_ANNOTATION, "annotation with the time in RFC 3339 format after which the networks of a pod may be cleaned up")
+	cmd.PersistentFlags().StringVar(&config.PodConfig.InternalNetworksAnnotation, "internal-networks-annotation",
+		model.INTERNAL_NETWORKS_ANNOTATION, "annotation with a comma separated list of networks of a pod that are internal")
 	cmd.PersistentFlags().StringVar(&config.PodConfig.NetworkIdPrefix, "network-prefix",
 		"kubedock.network/", "annotation prefix for network names. ")
 	cmd.PersistentFlags().StringVar(&config.PodConfig.LabelName, "label-name",
 		"kubedock", "name of the label (with value 'true') to be applied to pods")
+	cmd.PersistentFlags().StringArrayVar(&globalNetworkDefinitions, "global-network", []string{},
+		"network shared between namespaces as <network>[=<namespace>,...], optionally restricted to the given namespaces.\n"+
+			"Pods join global networks with an annotation value 'global:<network>'")
+	cmd.PersistentFlags().BoolVar(&config.PodConfig.UndeclaredGlobalNetworks, "allow-undeclared-global-networks", false,
+		"allow pods to use global networks that are not configured with --global-network, these may be joined by all namespaces")
+	cmd.PersistentFlags().BoolVar(&useNetworkDefinitions, "network-definitions", false,
+		"define networks by label selectors in ConfigMaps with label '<label-name>-network-definition' set to 'true'.\n"+
+			"Pods matching these do not need to be labeled and annotated. This watches all pods in the watched namespaces")
+	cmd.PersistentFlags().BoolVar(&config.PodConfig.SetHostname, "set-hostname", false,
+		"set the hostname of pods to their primary host alias, which is the host alias with annotation '<host-alias-prefix>primary'\n"+
+			"or otherwise the first host alias. A host alias with a dot sets both the hostname and subdomain")
+	cmd.PersistentFlags().BoolVar(&config.PodConfig.HostnameAsFQDN, "set-hostname-as-fqdn", false,
+		"also set setHostnameAsFQDN for pods whose hostname is set, requires --set-hostname")
+	cmd.PersistentFlags().StringSliceVar(&config.PodConfig.RejectedWarnings, "reject-on-warning", []string{},
+		"kinds of admission warnings that reject a pod instead: "+
+			strings.Join(admissioncontroller.REJECTABLE_WARNING_KINDS, ", "))
+	cmd.PersistentFlags().StringVar(&config.PodConfig.ShadowPolicy, "shadow-policy", model.SHADOW_POLICY_LOCAL,
+		"policy for host aliases that have the same name as a service in a watched namespace: "+
+			strings.Join(model.SHADOW_POLICIES, ", ")+".\n"+
+			"With 'local' the host alias is resolved, with 'service' the service, and with 'reject' such pods are rejected")
+	cmd.PersistentFlags().IntVar(&config.PodConfig.Quotas.PodsPerNetwork, "max-pods-per-network", 0,
+		"maximum number of pods in a network, 0 for unlimited")
+	cmd.PersistentFlags().IntVar(&config.PodConfig.Quotas.NetworksPerNamespace, "max-networks-per-namespace", 0,
+		"maximum number of networks in a namespace, not counting global networks, 0 for unlimited")
+	cmd.PersistentFlags().IntVar(&config.PodConfig.Quotas.HostAliasesPerPod, "max-host-aliases-per-pod", 0,
+		"maximum number of host aliases of a pod, 0 for unlimited")
+	cmd.PersistentFlags().IntVar(&config.PodConfig.Quotas.NetworksPerPod, "max-networks-per-pod", 0,
+		"maximum number of networks of a pod, 0 for unlimited")
 	cmd.PersistentFlags().StringVar(&config.CrtFile, "cert",
 		"/etc/kubedock/pki/tls.crt", "Certificate file")
 	cmd.PersistentFlags().StringVar(&config.KeyFile, "key",
 		"/etc/kubedock/pki/tls.key", "Key file")
+	cmd.PersistentFlags().StringVar(&config.ApiTokenFile, "api-token-file", "",
+		"File with the bearer token of the registration API, empty to disable the API")
+	cmd.PersistentFlags().BoolVar(&config.ManageCertificates, "manage-certificates", false,
+		"generate and renew the CA and serving certificate of the webhooks instead of using --cert and --key")
+	cmd.PersistentFlags().StringVar(&config.CertificateSecret, "certificate-secret",
+		"kubedock-dns-webhook-cert", "secret in which managed certificates are stored")
+	cmd.PersistentFlags().DurationVar(&config.CertificateValidity, "certificate-validity",
+		90*24*time.Hour, "validity of managed serving certificates, these are renewed when a third of the validity remains")
+	cmd.PersistentFlags().DurationVar(&config.CertificateCheckInterval, "certificate-check-interval",
+		1*time.Hour, "interval for checking whether managed certificates must be renewed")
+	cmd.PersistentFlags().StringSliceVar(&config.MutatingWebhookConfigs, "mutating-webhook-config",
+		[]string{}, "mutating webhook configurations of which the CA bundle is set for managed certificates")
+	cmd.PersistentFlags().StringSliceVar(&config.ValidatingWebhookConfigs, "validating-webhook-config",
+		[]string{}, "validating webhook configurations of which the CA bundle is set for managed certificates")
 	cmd.PersistentFlags().StringSliceVar(&config.InternalDomains,
 		"internal-domain", []string{}, "internal domains that will not be resolved using the upstream DNS server.\n"+
 			"By default empty so that only domain names without dots in them are considered to be internal")
+	cmd.PersistentFlags().StringSliceVar(&config.Namespaces,
+		"namespaces", []string{}, "namespaces to watch, by default only the namespace of the DNS server")
+	cmd.PersistentFlags().StringVar(&config.NamespaceSelector,
+		"namespace-selector", "", "label selector for the namespaces to watch, cannot be combined with --namespaces")
+	cmd.PersistentFlags().BoolVar(&config.WatchServices, "watch-services", false,
+		"services annotated with host aliases and networks become network members using their cluster IP,\n"+
+			"or for headless services, their ready endpoints")
 	cmd.PersistentFlags().DurationVar(&config.DnsTimeout, "client-dns-timeout",
 		30*time.Second, "DNS timeout to use by instrumented pods")
 	cmd.PersistentFlags().IntVar(&config.DnsRetries, "client-dns-retries",
 		5, "Max DNS retries to do by clients")
+	cmd.PersistentFlags().DurationVar(&config.DnsUpdateQuietPeriod, "dns-update-quiet-period",
+		100*time.Millisecond, "DNS is updated when there were no pod changes for this period")
+	cmd.PersistentFlags().DurationVar(&config.DnsUpdateMaxDelay, "dns-update-max-delay",
+		1*time.Second, "Maximum delay for pod changes to be reflected in DNS")
+	cmd.PersistentFlags().DurationVar(&config.ReconcileInterval, "reconcile-interval",
+		1*time.Minute, "Interval for comparing the pod administration with the cluster, 0 to disable")
+	cmd.PersistentFlags().BoolVar(&config.Events, "events", false,
+		"Report network membership and host alias conflicts as events on pods, requires permission to create events")
+	cmd.PersistentFlags().BoolVar(&config.AnnotateNetworkView, "annotate-network-view", false,
+		"Annotate pods with the host aliases they can resolve in their networks")
+	cmd.PersistentFlags().BoolVar(&config.Janitor, "janitor", false,
+		"Delete the pods of networks that were idle for the network TTL or of which the expiry annotation passed")
+	cmd.PersistentFlags().DurationVar(&config.NetworkTTL, "network-ttl",
+		1*time.Hour, "Time after which idle networks are cleaned up by the janitor, 0 to only use expiry annotations")
+	cmd.PersistentFlags().BoolVar(&config.JanitorDryRun, "janitor-dry-run", false,
+		"Only report the pods that the janitor would delete")
+	cmd.PersistentFlags().DurationVar(&config.JanitorInterval, "janitor-interval",
+		1*time.Minute, "Interval at which the janitor checks networks")
+	cmd.PersistentFlags().DurationVar(&config.ShutdownTimeout, "shutdown-timeout",
+		20*time.Second, "Maximum time to wait for in-flight DNS queries and admission requests on shutdown")
 	cmd.Flags().AddGoFlagSet(klogFlags)
 
-	cmd.Execute()
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"wamblee.org/kubedock/dns/internal/model"
+	"wamblee.org/kubedock/dns/internal/networkview"
+	"wamblee.org/kubedock/dns/internal/registration"
+)
+
+type ScenarioTestSuite struct {
+	suite.Suite
+
+	harness *Harness
+}
+
+func (s *ScenarioTestSuite) SetupTest() {
+	harness, err := NewHarness()
+	s.Require().Nil(err)
+	s.harness = harness
+}
+
+func (s *ScenarioTestSuite) TearDownTest() {
+	s.harness.Stop()
+}
+
+func TestScenarioTestSuite(t *testing.T) {
+	suite.Run(t, &ScenarioTestSuite{})
+}
+
+func (s *ScenarioTestSuite) deploy(name string, ip string, hostAliases []string, networks []string) {
+	s.deployInNamespace(HARNESS_NAMESPACE, name, ip, hostAliases, networks)
+}
+
+func (s *ScenarioTestSuite) deployInNamespace(namespace string, name string, ip string,
+	hostAliases []string, networks []string) {
+	pod := s.harness.NewPod(name, hostAliases, networks)
+	pod.Namespace = namespace
+	response, err := s.harness.Deploy(pod, ip, true)
+	s.Require().Nil(err)
+	s.Require().True(response.Allowed)
+}
+
+func (s *ScenarioTestSuite) assertLookup(sourceIp string, hostname string, expectedIps ...string) {
+	var ips []string
+	var err error
+	ok := Eventually(5*time.Second, func() bool {
+		ips, err = s.harness.Lookup(sourceIp, hostname)
+		return err == nil && slices.Equal(ips, expectedIps)
+	})
+	s.True(ok, "lookup of %s from %s: %v %v", hostname, sourceIp, ips, err)
+	s.Equal(expectedIps, ips)
+}
+
+func (s *ScenarioTestSuite) assertNotResolvable(sourceIp string, hostname string) {
+	ok := Eventually(10*time.Second, func() bool {
+		ips, err := s.harness.Lookup(sourceIp, hostname)
+		return err != nil || len(ips) == 0
+	})
+	s.True(ok, "%s should not be resolvable from %s", hostname, sourceIp)
+}
+
+func (s *ScenarioTestSuite) Test_SameHostnamesInDifferentNetworks() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+	s.deploy("db2", "127.0.2.1", []string{"db"}, []string{"test2"})
+	s.deploy("service2", "127.0.2.2", []string{"service"}, []string{"test2"})
+
+	s.assertLookup("127.0.1.2", "db", "127.0.1.1")
+	s.assertLookup("127.0.1.2", "db."+SEARCH_DOMAIN, "127.0.1.1")
+	s.assertLookup("127.0.2.2", "db", "127.0.2.1")
+	s.assertLookup("127.0.1.1", "service", "127.0.1.2")
+	s.assertLookup("127.0.2.1", "service", "127.0.2.2")
+
+	hosts, err := s.harness.ReverseLookup("127.0.1.2", "127.0.1.1")
+	s.Nil(err)
+	s.Equal([]string{"db."}, hosts)
+	hosts, err = s.harness.ReverseLookup("127.0.2.2", "127.0.2.1")
+	s.Nil(err)
+	s.Equal([]string{"db."}, hosts)
+}
+
+func (s *ScenarioTestSuite) Test_SameNetworkInDifferentNamespaces() {
+	s.deployInNamespace(TEAM_A_NAMESPACE, "db", "127.0.3.1", []string{"db"}, []string{"test1"})
+	s.deployInNamespace(TEAM_A_NAMESPACE, "service", "127.0.3.2", []string{"service"}, []string{"test1"})
+	s.deployInNamespace(TEAM_B_NAMESPACE, "db", "127.0.4.1", []string{"db"}, []string{"test1"})
+	s.deployInNamespace(TEAM_B_NAMESPACE, "service", "127.0.4.2", []string{"service"}, []string{"test1"})
+
+	s.assertLookup("127.0.3.2", "db", "127.0.3.1")
+	s.assertLookup("127.0.3.2", "db.team-a.svc.cluster.local", "127.0.3.1")
+	s.assertLookup("127.0.4.2", "db", "127.0.4.1")
+	s.assertLookup("127.0.4.2", "db.team-b.svc.cluster.local", "127.0.4.1")
+
+	hosts, err := s.harness.ReverseLookup("127.0.3.2", "127.0.4.1")
+	s.Nil(err)
+	s.NotContains(hosts, "db.")
+}
+
+func (s *ScenarioTestSuite) Test_GlobalNetworkAcrossNamespaces() {
+	s.deployInNamespace(TEAM_B_NAMESPACE, "ldap", "127.0.5.1", []string{"ldap"}, []string{"global:fixtures"})
+	s.deployInNamespace(TEAM_A_NAMESPACE, "service", "127.0.5.2", []string{"service"},
+		[]string{"test1", "global:fixtures"})
+	s.deployInNamespace(TEAM_A_NAMESPACE, "db", "127.0.5.3", []string{"db"}, []string{"test1"})
+
+	s.assertLookup("127.0.5.2", "ldap", "127.0.5.1")
+	s.assertLookup("127.0.5.2", "db", "127.0.5.3")
+	s.assertLookup("127.0.5.1", "service", "127.0.5.2")
+	// only pods that joined the global network see it.
+	s.assertNotResolvable("127.0.5.3", "ldap")
+}
+
+func (s *ScenarioTestSuite) Test_GlobalNetworkPolicy() {
+	s.deployInNamespace(TEAM_A_NAMESPACE, "db", "127.0.6.1", []string{"db"}, []string{RESTRICTED_NETWORK})
+
+	pod := s.harness.NewPod("db", []string{"db"}, []string{RESTRICTED_NETWORK})
+	pod.Namespace = TEAM_B_NAMESPACE
+	response, err := s.harness.Admit(admissionv1.Create, pod)
+	s.Require().Nil(err)
+	s.False(response.Allowed)
+	s.Contains(response.Result.Message, "may not join global network")
+
+	pod = s.harness.NewPod("db", []string{"db"}, []string{"global:undeclared"})
+	response, err = s.harness.Admit(admissionv1.Create, pod)
+	s.Require().Nil(err)
+	s.False(response.Allowed)
+	s.Contains(response.Result.Message, "is not declared")
+}
+
+func (s *ScenarioTestSuite) Test_ServiceAsNetworkMember() {
+	s.deploy("service", "127.0.7.1", []string{"service"}, []string{"test1"})
+	s.Require().Nil(s.harness.CreateService("ldap", "10.96.0.10", []string{"ldap"}, []string{"test1"}))
+	// not annotated
+	s.Require().Nil(s.harness.CreateService("other", "10.96.0.11", nil, nil))
+
+	s.assertLookup("127.0.7.1", "ldap", "10.96.0.10")
+	s.assertNotResolvable("127.0.7.1", "other")
+
+	s.Require().Nil(s.harness.DeleteService("ldap"))
+	s.assertNotResolvable("127.0.7.1", "ldap")
+}
+
+func (s *ScenarioTestSuite) Test_HeadlessServiceAsNetworkMember() {
+	s.deploy("service", "127.0.8.1", []string{"service"}, []string{"test1"})
+	s.Require().Nil(s.harness.CreateService("db", "", []string{"db"}, []string{"test1"}))
+	s.Require().Nil(s.harness.SetEndpoints("db", []string{"127.0.8.2", "127.0.8.3"}, []string{"127.0.8.4"}))
+
+	s.assertLookup("127.0.8.1", "db", "127.0.8.2", "127.0.8.3")
+	// endpoints are members as well
+	s.assertLookup("127.0.8.2", "service", "127.0.8.1")
+
+	s.Require().Nil(s.harness.SetEndpoints("db", []string{"127.0.8.4"}, []string{"127.0.8.2"}))
+	s.assertLookup("127.0.8.1", "db", "127.0.8.4")
+}
+
+func (s *ScenarioTestSuite) Test_ServiceWinsOverShadowingHostAlias() {
+	s.deploy("db", "127.0.10.1", []string{"db"}, []string{"test1"})
+	s.deploy("service", "127.0.10.2", []string{"service"}, []string{"test1"})
+	s.assertLookup("127.0.10.2", "db", "127.0.10.1")
+
+	// not annotated, so it is resolved by the upstream DNS server.
+	s.Require().Nil(s.harness.CreateService("db", "10.96.0.12", nil, nil))
+	s.assertLookup("127.0.10.2", "db", UPSTREAM_IP)
+	s.assertLookup("127.0.10.2", "db."+SEARCH_DOMAIN, UPSTREAM_IP)
+	s.assertLookup("127.0.10.1", "service", "127.0.10.2")
+
+	s.Require().Nil(s.harness.DeleteService("db"))
+	s.assertLookup("127.0.10.2", "db", "127.0.10.1")
+}
+
+func (s *ScenarioTestSuite) Test_NetworkDefinitions() {
+	s.deploy("service", "127.0.9.1", []string{"service"}, []string{"test1"})
+	s.Require().Nil(s.harness.CreateUnmanagedPod("ldap-0", "127.0.9.2", map[string]string{"app": "ldap"}))
+	s.Require().Nil(s.harness.CreateUnmanagedPod("web-0", "127.0.9.3", map[string]string{"app": "web"}))
+	s.assertNotResolvable("127.0.9.1", "ldap")
+
+	s.Require().Nil(s.harness.SetNetworkDefinitions(map[string]string{
+		"fixtures": "{network: test1, selector: 'app in (ldap)', hostAliases: ['{{ .Labels.app }}']}",
+	}))
+	s.assertLookup("127.0.9.1", "ldap", "127.0.9.2")
+	s.assertLookup("127.0.9.2", "service", "127.0.9.1")
+	s.assertNotResolvable("127.0.9.1", "web")
+
+	// pods that no longer match are removed.
+	s.Require().Nil(s.harness.SetNetworkDefinitions(map[string]string{
+		"fixtures": "{network: test1, selector: 'app in (web)', hostAliases: ['{{ .Labels.app }}']}",
+	}))
+	s.assertLookup("127.0.9.1", "web", "127.0.9.3")
+	s.assertNotResolvable("127.0.9.1", "ldap")
+}
+
+func (s *ScenarioTestSuite) Test_NetworkDefinitionMemberResolvesPeers() {
+	s.deploy("service", "127.0.12.1", []string{"service"}, []string{"test1"})
+	s.Require().Nil(s.harness.SetNetworkDefinitions(map[string]string{
+		"fixtures": "{network: test1, selector: 'app in (ldap)', hostAliases: ['{{ .Labels.app }}']}",
+	}))
+
+	// the pod gets the DNS configuration once the definition is known.
+	ldap := s.harness.NewUnmanagedPod("ldap-0", map[string]string{"app": "ldap"})
+	var response *admissionv1.AdmissionResponse
+	s.True(Eventually(5*time.Second, func() bool {
+		var err error
+		response, err = s.harness.Admit(admissionv1.Create, ldap)
+		return err == nil && response.Allowed && response.Patch != nil
+	}))
+	s.Contains(string(response.Patch), DNS_SERVICE_IP)
+	_, err := s.harness.Deploy(ldap, "127.0.12.2", true)
+	s.Require().Nil(err)
+	s.assertLookup("127.0.12.2", "service", "127.0.12.1")
+	s.assertLookup("127.0.12.1", "ldap", "127.0.12.2")
+
+	// other pods are not modified.
+	response, err = s.harness.Admit(admissionv1.Create,
+		s.harness.NewUnmanagedPod("web-0", map[string]string{"app": "web"}))
+	s.Require().Nil(err)
+	s.True(response.Allowed)
+	s.Nil(response.Patch)
+}
+
+func (s *ScenarioTestSuite) Test_UnwatchedNamespaceIsNotModified() {
+	pod := s.harness.NewPod("db", []string{"db"}, []string{"test1"})
+	pod.Namespace = "other"
+	response, err := s.harness.Admit(admissionv1.Create, pod)
+	s.Require().Nil(err)
+	s.True(response.Allowed)
+	s.Nil(response.Patch)
+}
+
+func (s *ScenarioTestSuite) Test_PodInMultipleNetworks() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("db2", "127.0.2.1", []string{"db"}, []string{"test2"})
+	s.deploy("proxy", "127.0.3.1", []string{"proxy"}, []string{"test1", "test2"})
+
+	s.assertLookup("127.0.3.1", "db", "127.0.1.1", "127.0.2.1")
+	s.assertLookup("127.0.1.1", "proxy", "127.0.3.1")
+	s.assertLookup("127.0.2.1", "proxy", "127.0.3.1")
+}
+
+func (s *ScenarioTestSuite) Test_ExternalNamesUseUpstream() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+
+	s.assertLookup("127.0.1.1", "www.example.com", UPSTREAM_IP)
+	s.Greater(s.harness.upstreamCalls.Load(), int32(0))
+}
+
+func (s *ScenarioTestSuite) Test_InternalNetworksBlockUpstream() {
+	pod := s.harness.NewPod("db", []string{"db"}, []string{"offline"})
+	pod.Annotations[model.INTERNAL_NETWORKS_ANNOTATION] = "offline"
+	response, err := s.harness.Deploy(pod, "127.0.11.1", true)
+	s.Require().Nil(err)
+	s.Require().True(response.Allowed)
+	// the network is only internal when all its pods agree.
+	proxy := s.harness.NewPod("proxy", []string{"proxy"}, []string{"offline", "online"})
+	proxy.Annotations[model.INTERNAL_NETWORKS_ANNOTATION] = "offline"
+	response, err = s.harness.Deploy(proxy, "127.0.11.2", true)
+	s.Require().Nil(err)
+	s.Require().True(response.Allowed)
+	s.assertLookup("127.0.11.1", "proxy", "127.0.11.2")
+
+	calls := s.harness.upstreamCalls.Load()
+	answer, err := s.harness.Query("127.0.11.1", "www.example.com.", dns.TypeA)
+	s.Require().Nil(err)
+	s.Equal(dns.RcodeNameError, answer.Rcode)
+	s.Equal(calls, s.harness.upstreamCalls.Load())
+	// pods that are also in other networks are not restricted.
+	s.assertLookup("127.0.11.2", "www.example.com", UPSTREAM_IP)
+}
+
+func (s *ScenarioTestSuite) Test_ReadinessAndDeletion() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+	s.assertLookup("127.0.1.2", "db", "127.0.1.1")
+
+	s.Require().Nil(s.harness.SetReady("db1", false))
+	s.assertNotResolvable("127.0.1.2", "db")
+
+	s.Require().Nil(s.harness.SetReady("db1", true))
+	s.assertLookup("127.0.1.2", "db", "127.0.1.1")
+
+	s.Require().Nil(s.harness.Delete("db1"))
+	s.assertNotResolvable("127.0.1.2", "db")
+}
+
+func (s *ScenarioTestSuite) Test_OwnHostnameResolvesBeforeReady() {
+	pod := s.harness.NewPod("kafka1", []string{"broker"}, []string{"test1"})
+	pod.Annotations[s.harness.config.PodConfig.HostAliasPrefix+"primary"] = "kafka.test"
+	response, err := s.harness.Deploy(pod, "127.0.1.1", false)
+	s.Require().Nil(err)
+	s.Require().True(response.Allowed)
+	s.deploy("client1", "127.0.1.2", []string{"client"}, []string{"test1"})
+
+	// names with a dot are not internal, so first wait for the pod to be known.
+	s.assertLookup("127.0.1.1", "kafka", "127.0.1.1")
+	s.assertLookup("127.0.1.1", "kafka.test", "127.0.1.1")
+	s.assertNotResolvable("127.0.1.1", "broker")
+	s.assertNotResolvable("127.0.1.2", "kafka")
+	s.assertLookup("127.0.1.2", "kafka.test", UPSTREAM_IP)
+
+	s.Require().Nil(s.harness.SetReady("kafka1", true))
+	s.assertLookup("127.0.1.2", "broker", "127.0.1.1")
+	s.assertLookup("127.0.1.2", "kafka.test", "127.0.1.1")
+}
+
+func (s *ScenarioTestSuite) assertEvents(name string, reasons ...string) {
+	var actual []string
+	var err error
+	ok := Eventually(5*time.Second, func() bool {
+		actual, err = s.harness.EventReasons(name)
+		return err == nil && len(actual) == len(reasons)
+	})
+	s.True(ok, "events of %s: %v %v", name, actual, err)
+	s.ElementsMatch(reasons, actual)
+}
+
+func (s *ScenarioTestSuite) Test_EventsForNetworkMembership() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.assertEvents("db1", "NetworkJoined", "DnsRegistered")
+
+	s.deploy("db2", "127.0.1.2", []string{"db"}, []string{"test1"})
+	s.assertEvents("db2", "NetworkJoined", "DnsRegistered", "HostAliasConflict")
+	s.assertEvents("db1", "NetworkJoined", "DnsRegistered", "HostAliasConflict")
+
+	s.Require().Nil(s.harness.Delete("db2"))
+	s.assertEvents("db2", "NetworkJoined", "DnsRegistered", "HostAliasConflict", "NetworkLeft")
+}
+
+func (s *ScenarioTestSuite) Test_NetworkViewAnnotation() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1", "test2"})
+	s.deploy("other1", "127.0.1.3", []string{"other"}, []string{"test2"})
+
+	expected := map[string]networkview.Network{
+		"test1": {
+			IPAddress: "127.0.1.2",
+			Aliases:   []string{"service"},
+			Hosts: map[string][]string{
+				"db":      {"127.0.1.1"},
+				"service": {"127.0.1.2"},
+			},
+		},
+		"test2": {
+			IPAddress: "127.0.1.2",
+			Aliases:   []string{"service"},
+			Hosts: map[string][]string{
+				"other":   {"127.0.1.3"},
+				"service": {"127.0.1.2"},
+			},
+		},
+	}
+	var view map[string]networkview.Network
+	ok := Eventually(5*time.Second, func() bool {
+		value, err := s.harness.Annotation("service1", networkview.ANNOTATION)
+		view = nil
+		return err == nil && json.Unmarshal([]byte(value), &view) == nil && reflect.DeepEqual(expected, view)
+	})
+	s.True(ok, "network view: %v", view)
+
+	// the view is refreshed
+	s.Require().Nil(s.harness.Delete("other1"))
+	ok = Eventually(5*time.Second, func() bool {
+		value, err := s.harness.Annotation("service1", networkview.ANNOTATION)
+		view = nil
+		return err == nil && json.Unmarshal([]byte(value), &view) == nil && len(view["test2"].Hosts) == 1
+	})
+	s.True(ok, "network view: %v", view)
+}
+
+func (s *ScenarioTestSuite) Test_RegistrationApi() {
+	api := func(method string, path string, body any, expectedStatus int) {
+		status, err := s.harness.Api(method, path, body, nil)
+		s.Require().Nil(err)
+		s.Equal(expectedStatus, status, "%s %s", method, path)
+	}
+	reservation := registration.Reservation{Networks: []string{"test1"}, HostAliases: []string{"db"}}
+
+	api("PUT", "/reservations/db1", reservation, http.StatusNotFound)
+	api("POST", "/networks/test1", nil, http.StatusCreated)
+	api("POST", "/networks/test1", nil, http.StatusConflict)
+	api("PUT", "/reservations/db1", reservation, http.StatusOK)
+	api("PUT", "/reservations/db2", registration.Reservation{
+		Networks:    []string{"test1"},
+		HostAliases: []string{"db_1"},
+	}, http.StatusBadRequest)
+	api("DELETE", "/networks/test1", nil, http.StatusConflict)
+
+	var network registration.Network
+	_, err := s.harness.Api("GET", "/networks/test1", nil, &network)
+	s.Require().Nil(err)
+	s.Equal([]registration.Member{{Name: "db1", HostAliases: []string{"db"}, Reserved: true}}, network.Members)
+
+	// the pod replaces the reservation
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+	s.assertLookup("127.0.1.2", "db", "127.0.1.1")
+	api("PUT", "/reservations/db1", reservation, http.StatusConflict)
+	api("DELETE", "/reservations/db1", nil, http.StatusConflict)
+
+	var networks []registration.Network
+	_, err = s.harness.Api("GET", "/networks", nil, &networks)
+	s.Require().Nil(err)
+	s.Equal(1, len(networks))
+	s.Equal([]registration.Member{
+		{Name: "db1", IP: "127.0.1.1", HostAliases: []string{"db"}, Ready: true},
+		{Name: "service1", IP: "127.0.1.2", HostAliases: []string{"service"}, Ready: true},
+	}, networks[0].Members)
+
+	request, err := http.NewRequest("GET", s.harness.admission.URL+registration.PREFIX+
+		"/namespaces/"+HARNESS_NAMESPACE+"/networks", nil)
+	s.Require().Nil(err)
+	request.Header.Set("Authorization", "Bearer invalid")
+	resp, err := http.DefaultClient.Do(request)
+	s.Require().Nil(err)
+	resp.Body.Close()
+	s.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *ScenarioTestSuite) Test_DockerNetworkInspect() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+	// the network is rendered from the networks used by the DNS server
+	s.assertLookup("127.0.1.2", "db", "127.0.1.1")
+
+	var network registration.NetworkResource
+	status, err := s.harness.Api("GET", "/docker/networks/test1", nil, &network)
+	s.Require().Nil(err)
+	s.Equal(http.StatusOK, status)
+	s.Equal("test1", network.Name)
+	addresses := make(map[string]string)
+	for _, container := range network.Containers {
+		addresses[container.Name] = container.IPv4Address
+	}
+	s.Equal(map[string]string{"db1": "127.0.1.1/32", "service1": "127.0.1.2/32"}, addresses)
+}
+
+// assertChanges asserts the next changes of a watch as '<network> <member> <type>'.
+func (s *ScenarioTestSuite) assertChanges(changes <-chan registration.Change, expected ...string) {
+	for _, description := range expected {
+		select {
+		case change, ok := <-changes:
+			s.Require().True(ok, "watch ended, expected %s", description)
+			member := "-"
+			if change.Member != nil {
+				member = change.Member.Name
+			}
+			s.Equal(description, fmt.Sprintf("%s %s %s", change.Network, member, change.Type))
+		case <-time.After(5 * time.Second):
+			s.Fail("no change received", "expected %s", description)
+			return
+		}
+	}
+}
+
+func (s *ScenarioTestSuite) Test_WatchNetworkChanges() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.assertLookup("127.0.1.1", "db", "127.0.1.1")
+	changes, err := s.harness.Watch("?network=test1")
+	s.Require().Nil(err)
+	s.assertChanges(changes,
+		"test1 db1 joined",
+		"test1 db1 ipassigned",
+		"test1 db1 ready")
+
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test2"})
+	s.deploy("service2", "127.0.1.3", []string{"service"}, []string{"test1"})
+	s.assertChanges(changes,
+		"test1 service2 joined",
+		"test1 service2 ipassigned",
+		"test1 service2 ready")
+
+	s.Require().Nil(s.harness.Delete("db1"))
+	s.Require().Nil(s.harness.Delete("service2"))
+	s.assertChanges(changes, "test1 db1 left")
+	s.assertChanges(changes, "test1 service2 left", "test1 - emptied")
+}
+
+func (s *ScenarioTestSuite) Test_JanitorDeletesExpiredNetworks() {
+	pod := s.harness.NewPod("db1", []string{"db"}, []string{"test1"})
+	pod.Annotations[model.EXPIRES_ANNOTATION] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	response, err := s.harness.Deploy(pod, "127.0.1.1", true)
+	s.Require().Nil(err)
+	s.Require().True(response.Allowed)
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+	s.deploy("web1", "127.0.1.3", []string{"web"}, []string{"test2"})
+
+	exists := func(name string) bool {
+		_, err := s.harness.clientset.CoreV1().Pods(HARNESS_NAMESPACE).Get(s.harness.ctx, name, metav1.GetOptions{})
+		return err == nil
+	}
+	s.True(Eventually(5*time.Second, func() bool {
+		return !exists("db1") && !exists("service1")
+	}))
+	s.True(exists("web1"))
+	s.True(Eventually(5*time.Second, func() bool {
+		reasons, err := s.harness.EventReasons("service1")
+		return err == nil && slices.Contains(reasons, "NetworkExpired")
+	}))
+	// deleted pods leave the network
+	s.True(Eventually(5*time.Second, func() bool {
+		return s.harness.pods.Get(HARNESS_NAMESPACE, "db1") == nil
+	}))
+}
+
+func (s *ScenarioTestSuite) Test_AdmissionRejectsMissingNetwork() {
+	response, err := s.harness.Deploy(s.harness.NewPod("db1", []string{"db"}, nil), "127.0.1.1", true)
+	s.Require().Nil(err)
+	s.False(response.Allowed)
+	s.True(strings.Contains(response.Result.Message, "no host or no network"))
+}
+
+func (s *ScenarioTestSuite) Test_AdmissionRejectsNetworkChange() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+
+	response, err := s.harness.Admit(admissionv1.Update,
+		s.harness.NewPod("db1", []string{"db"}, []string{"test2"}))
+	s.Require().Nil(err)
+	s.False(response.Allowed)
+	s.True(strings.Contains(response.Result.Message, "cannot change network"))
+}
+
+func (s *ScenarioTestSuite) Test_ShutdownAnswersPendingLookups() {
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+
+	// lookups of internal hosts that are not yet known wait for the host to appear
+	type result struct {
+		rcode int
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		response, err := s.harness.Query("127.0.1.2", "db.", dns.TypeA)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		results <- result{rcode: response.Rcode}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	t0 := time.Now()
+	s.harness.Stop()
+	s.Less(time.Since(t0), s.harness.config.ShutdownTimeout)
+
+	res := <-results
+	s.Require().Nil(res.err)
+	s.Equal(dns.RcodeServerFailure, res.rcode)
+}
+
+func (s *ScenarioTestSuite) Test_LookupOverTCP() {
+	s.deploy("db1", "127.0.1.1", []string{"db"}, []string{"test1"})
+	s.deploy("service1", "127.0.1.2", []string{"service"}, []string{"test1"})
+	s.assertLookup("127.0.1.2", "db", "127.0.1.1")
+
+	response, err := s.harness.QueryNet("tcp", "127.0.1.2", "db.", dns.TypeA)
+	s.Require().Nil(err)
+	s.Require().Equal(1, len(response.Answer))
+	s.Equal("127.0.1.1", response.Answer[0].(*dns.A).A.String())
+}
+
+func (s *ScenarioTestSuite) Test_HealthEndpoints() {
+	for _, path := range []string{"/livez", "/readyz"} {
+		resp, err := http.Get(s.harness.admission.URL + path)
+		s.Require().Nil(err)
+		resp.Body.Close()
+		s.Equal(http.StatusOK, resp.StatusCode, path)
+	}
+}
@@ -1,4 +1,21 @@
 
 {{- define  "labels" }}
 app.kubernetes.io/name: kubedock-dns
-{{- end }}
\ No newline at end of file
+{{- end }}
+{{/*
+Label selector string for the namespaceSelector value.
+*/}}
+{{- define "namespace-selector" }}
+{{- $selector := list }}
+{{- range $key, $value := .Values.namespaceSelector }}
+{{- $selector = append $selector (printf "%s=%s" $key $value) }}
+{{- end }}
+{{- join "," $selector }}
+{{- end }}
+
+{{/*
+True when pods are watched in other namespaces than the release namespace.
+*/}}
+{{- define "cluster-scoped" }}
+{{- if or (not (empty .Values.namespaces)) (not (empty .Values.namespaceSelector)) }}true{{ end }}
+{{- end }}
@@ -2,6 +2,8 @@ package admissioncontroller
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"gomodules.xyz/jsonpatch/v2"
@@ -9,15 +11,18 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"net/http"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
 	"wamblee.org/kubedock/dns/internal/model"
+	"wamblee.org/kubedock/dns/internal/registration"
 	"wamblee.org/kubedock/dns/internal/support"
 
 	"encoding/json"
@@ -27,6 +32,10 @@ import (
 
 const (
 	CONTROLLER_NAME = "kubedock-admission"
+	// Maximum time an admission request waits for the server to become ready.
+	READY_TIMEOUT = 5 * time.Second
+	// Maximum length of the hostname of a pod when it is set as FQDN.
+	MAX_FQDN_LENGTH = 64
 )
 
 type DnsMutator struct {
@@ -34,6 +43,21 @@ type DnsMutator struct {
 	pods         *model.Pods
 	dnsServiceIP string
 	clientConfig *dns.ClientConfig
+
+	// Admission is deferred until ready since before that, the pods are not yet
+	// known and conflicts cannot be detected. Nil means always ready.
+	readiness    *support.Readiness
+	readyTimeout time.Duration
+
+	// Namespace of the DNS server. Its search domain is replaced by that of the pod
+	// namespace. Empty means no replacement.
+	namespace string
+	// Pods in namespaces that are not watched are allowed without modification.
+	// Nil means all namespaces are watched.
+	watched func(namespace string) bool
+	// Returns whether a service exists using the watched service names, to warn about host
+	// aliases that shadow services. Nil disables the check.
+	serviceExists func(namespace string, name string) bool
 }
 
 type PatchOperation struct {
@@ -49,6 +73,7 @@ func NewDnsMutator(pods *model.Pods, dnsServiceIP string, clientConfig *dns.Clie
 		pods:         pods,
 		dnsServiceIP: dnsServiceIP,
 		clientConfig: clientConfig,
+		readyTimeout: READY_TIMEOUT,
 	}
 	return &mutator
 }
@@ -58,43 +83,128 @@ func (mutator *DnsMutator) errored(code int32, err error) admission.Response {
 	return admission.Errored(code, err)
 }
 
+func (mutator *DnsMutator) waitUntilReady(ctx context.Context) error {
+	if mutator.readiness == nil {
+		return nil
+	}
+	timer := time.NewTimer(mutator.readyTimeout)
+	defer timer.Stop()
+	select {
+	case <-mutator.readiness.Ready():
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return fmt.Errorf("Not ready yet, waiting for %v", mutator.readiness.Pending())
+}
+
 func (mutator *DnsMutator) Handle(ctx context.Context, request admission.Request) admission.Response {
+	if mutator.watched != nil && !mutator.watched(request.Namespace) {
+		klog.V(2).Infof("%s/%s: namespace not watched", request.Namespace, request.Name)
+		return admission.Allowed("namespace not watched")
+	}
 	var k8spod corev1.Pod
 	err := json.Unmarshal(request.Object.Raw, &k8spod)
 	if err != nil {
 		return mutator.errored(http.StatusBadRequest, fmt.Errorf("Could not unmarshal pod: %v", err))
 	}
-	err = mutator.validateK8sPod(k8spod, request.Operation)
+	if mutator.networkConfigUnchanged(request, &k8spod) {
+		klog.V(2).Infof("%s/%s: network configuration unchanged", request.Namespace, request.Name)
+		return admission.Allowed("network configuration unchanged")
+	}
+	if k8spod.Labels[mutator.podConfig.LabelName] != "true" && mutator.podConfig.NetworkDefinitions != nil {
+		if reason := mutator.skipUnlabeled(&k8spod, request.Operation); reason != "" {
+			klog.V(2).Infof("%s/%s: %s", request.Namespace, request.Name, reason)
+			return admission.Allowed(reason)
+		}
+	}
+	if err := mutator.waitUntilReady(ctx); err != nil {
+		return mutator.errored(http.StatusServiceUnavailable, err)
+	}
+	pod, networks, err := mutator.validateK8sPod(k8spod, request.Operation)
 	if err != nil {
 
 		return mutator.rejectPod(request, err)
 	}
-	return mutator.addDnsConfiguration(request)
+	dnsConfig := mutator.podDnsConfig(request.Namespace, &k8spod)
+	warnings := mutator.warnings(&k8spod, pod, networks, dnsConfig)
+	// pods that were already admitted are not rejected.
+	if request.Operation == admissionv1.Create {
+		if err := mutator.escalate(pod, warnings); err != nil {
+			klog.Warningf("%v", err)
+			mutator.pods.Delete(pod.Namespace, pod.Name)
+			return mutator.rejectPod(request, err)
+		}
+	}
+	return mutator.addDnsConfiguration(request, k8spod, pod, dnsConfig.merged, warnings)
+}
+
+// networkConfigUnchanged returns true for updates that do not change the network configuration
+// of the pod, such as the annotations of the network view. These are allowed without
+// validation, and without waiting until ready.
+func (mutator *DnsMutator) networkConfigUnchanged(request admission.Request, k8spod *corev1.Pod) bool {
+	if request.Operation != admissionv1.Update || len(request.OldObject.Raw) == 0 {
+		return false
+	}
+	var oldK8sPod corev1.Pod
+	if err := json.Unmarshal(request.OldObject.Raw, &oldK8sPod); err != nil {
+		return false
+	}
+	// the IP is not part of the network configuration.
+	ip := string(model.NewUnknownIP())
+	pod, err := model.GetPodEssentials(k8spod, ip, mutator.podConfig)
+	if err != nil {
+		return false
+	}
+	oldPod, err := model.GetPodEssentials(&oldK8sPod, ip, mutator.podConfig)
+	return err == nil && oldPod.Equal(pod)
+}
+
+// skipUnlabeled returns the reason for admitting a pod without the kubedock label unmodified
+// when network definitions are used, or the empty string when it is a member of a network
+// definition. Such pods are never delayed or rejected because kubedock-dns is not ready, since
+// that would affect all pods. Updates are allowed since the network configuration of such pods
+// follows the definitions.
+func (mutator *DnsMutator) skipUnlabeled(k8spod *corev1.Pod, operation admissionv1.Operation) string {
+	switch {
+	case operation != admissionv1.Create:
+		return "not a kubedock pod, network definitions only apply at creation"
+	case mutator.readiness != nil && !mutator.readiness.IsReady():
+		return "not a kubedock pod, network definitions are not known yet"
+	}
+	if _, networks := mutator.podConfig.NetworkDefinitions.Lookup(k8spod); len(networks) == 0 {
+		return "not a kubedock pod and no network definition matches"
+	}
+	return ""
 }
 
-func (mutator *DnsMutator) validateK8sPod(k8spod corev1.Pod, operation admissionv1.Operation) error {
+func (mutator *DnsMutator) validateK8sPod(k8spod corev1.Pod,
+	operation admissionv1.Operation) (*model.Pod, *model.Networks, error) {
 	// add pod with an unknown IP indicator but with a unique IP. The IP will be updated
 	// later when the IP becomes known during deployment.
 	podIpOverride := k8spod.Status.PodIP
 	if podIpOverride == "" {
-		podIpOverride = model.UNKNOWN_IP_PREFIX + strconv.Itoa(time.Now().Nanosecond()) +
-			strconv.Itoa(rand.Int())
+		podIpOverride = string(model.NewUnknownIP())
 	}
 	pod, err := model.GetPodEssentials(&k8spod, podIpOverride, mutator.podConfig)
 	if err != nil {
 		klog.Infof("%v", err)
-		return err
+		return nil, nil, err
+	}
+	if err := model.CheckGlobalNetworks(pod, mutator.podConfig); err != nil {
+		klog.Warningf("%v", err)
+		return nil, nil, err
 	}
 	var networks *model.Networks
 	networks, err = mutator.validatePod(operation, pod)
 	if err != nil {
 		klog.Warningf("%s/%s invalid", pod.Namespace, pod.Name)
-		return err
+		return nil, nil, err
 	}
 	if klog.V(3).Enabled() {
 		networks.Log()
 	}
-	return nil
+	return pod, networks, nil
 }
 
 func (mutator *DnsMutator) validatePod(operation admissionv1.Operation, pod *model.Pod) (*model.Networks, error) {
@@ -105,38 +215,12 @@ func (mutator *DnsMutator) validatePod(operation admissionv1.Operation, pod *mod
 				pod.Namespace, pod.Name)
 		}
 	}
-	mutator.pods.AddOrUpdate(pod)
-
-	// Because of concurrency, other pods can have been added concurrently
-	// But the order of adding pods to the network is deterministic because
-	// of how LinkedMap works by adding all pods to the nwtwork in the same
-	// order one by one.
-	//
-	// reject deployment because the specific pod is giving an error,
-	// here we ignore errors from other pods.
-	// In this design, only pods with valid network config can be deployed,
-	// so errors in other pods should never occur.
-	//
-	// With more than one replica we cannot 100% guarantee that invalid pods will
-	// be rejected, but in practice it should be close to 100%
-	networks, podErrors := mutator.pods.Networks()
-	if podErrors == nil {
-		return networks, nil
-	}
-	podError := podErrors.FirstError(pod)
-	if podError == nil {
-		return networks, nil
-	}
-
-	mutator.pods.Delete(pod.Namespace, pod.Name)
-	return nil, podError
+	return mutator.pods.AddAndValidate(pod, mutator.podConfig.Quotas)
 }
 
-func (mutator *DnsMutator) addDnsConfiguration(request admission.Request) admission.Response {
+func (mutator *DnsMutator) addDnsConfiguration(request admission.Request, k8spod corev1.Pod,
+	pod *model.Pod, dnsConfig corev1.PodDNSConfig, warnings []Warning) admission.Response {
 	klog.Infof("%s/%s Adding dnsconfig", request.Namespace, request.Name)
-	ndots := strconv.Itoa(mutator.clientConfig.Ndots)
-	timeout := strconv.Itoa(mutator.clientConfig.Timeout)
-	attempts := strconv.Itoa(mutator.clientConfig.Attempts)
 	patches := []jsonpatch.JsonPatchOperation{
 		{
 			Operation: "add",
@@ -146,23 +230,21 @@ func (mutator *DnsMutator) addDnsConfiguration(request admission.Request) admiss
 		{
 			Operation: "add",
 			Path:      "/spec/dnsConfig",
-			Value: corev1.PodDNSConfig{
-				Nameservers: []string{mutator.dnsServiceIP},
-				Searches:    mutator.clientConfig.Search,
-				Options: []corev1.PodDNSConfigOption{
-					{Name: "ndots", Value: &ndots},
-					{Name: "timeout", Value: &timeout},
-					{Name: "attempts", Value: &attempts},
-				},
-			},
+			Value:     dnsConfig,
 		},
 	}
+	patches = append(patches, mutator.hostnamePatches(k8spod, pod)...)
+
+	if len(warnings) > 0 {
+		klog.Infof("%s/%s: warnings %v", request.Namespace, request.Name, warnings)
+	}
 
 	// Create the admission response
 	response := admission.Response{
 		Patches: patches,
 		AdmissionResponse: admissionv1.AdmissionResponse{
-			Allowed: true,
+			Allowed:  true,
+			Warnings: warningStrings(warnings),
 			PatchType: func() *admissionv1.PatchType {
 				pt := admissionv1.PatchTypeJSONPatch
 				return &pt
@@ -172,6 +254,99 @@ func (mutator *DnsMutator) addDnsConfiguration(request admission.Request) admiss
 	return response
 }
 
+// dnsConfig returns the DNS configuration of kubedock-dns for pods in the namespace.
+func (mutator *DnsMutator) dnsConfig(namespace string) corev1.PodDNSConfig {
+	ndots := strconv.Itoa(mutator.clientConfig.Ndots)
+	timeout := strconv.Itoa(mutator.clientConfig.Timeout)
+	attempts := strconv.Itoa(mutator.clientConfig.Attempts)
+	return corev1.PodDNSConfig{
+		Nameservers: []string{mutator.dnsServiceIP},
+		Searches:    mutator.searches(namespace),
+		Options: []corev1.PodDNSConfigOption{
+			{Name: "ndots", Value: &ndots},
+			{Name: "timeout", Value: &timeout},
+			{Name: "attempts", Value: &attempts},
+		},
+	}
+}
+
+// podDnsConfig merges the DNS configuration of the pod into that of kubedock-dns for pods in
+// the namespace.
+func (mutator *DnsMutator) podDnsConfig(namespace string, k8spod *corev1.Pod) mergedDnsConfig {
+	ours := mutator.dnsConfig(namespace)
+	merged, messages := mergeDnsConfig(ours, k8spod.Spec.DNSConfig)
+	return mergedDnsConfig{
+		ours:     ours,
+		merged:   merged,
+		messages: messages,
+	}
+}
+
+// hostnamePatches sets the hostname of the pod to its primary host alias, similar to the
+// hostname of a docker container in a network. A hostname defined by the pod is kept.
+func (mutator *DnsMutator) hostnamePatches(k8spod corev1.Pod, pod *model.Pod) []jsonpatch.JsonPatchOperation {
+	if pod.Hostname == "" || k8spod.Spec.Hostname != "" {
+		return nil
+	}
+	hostname, subdomain, err := model.SplitHostname(pod.Hostname)
+	if err != nil {
+		// cannot occur since the hostname was validated when it was determined.
+		klog.Warningf("%s/%s: %v", pod.Namespace, pod.Name, err)
+		return nil
+	}
+	klog.Infof("%s/%s: setting hostname %s", pod.Namespace, pod.Name, pod.Hostname)
+	patches := []jsonpatch.JsonPatchOperation{
+		{
+			Operation: "add",
+			Path:      "/spec/hostname",
+			Value:     hostname,
+		},
+	}
+	if subdomain != "" {
+		patches = append(patches, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      "/spec/subdomain",
+			Value:     subdomain,
+		})
+	}
+	if mutator.podConfig.HostnameAsFQDN && k8spod.Spec.SetHostnameAsFQDN == nil {
+		// the pod would fail to start with a longer fully qualified domain name.
+		if fqdn := mutator.fqdn(pod); len(fqdn) > MAX_FQDN_LENGTH {
+			klog.Warningf("%s/%s: not setting hostname as FQDN since '%s' is longer than %d characters",
+				pod.Namespace, pod.Name, fqdn, MAX_FQDN_LENGTH)
+			return patches
+		}
+		patches = append(patches, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      "/spec/setHostnameAsFQDN",
+			Value:     true,
+		})
+	}
+	return patches
+}
+
+// fqdn returns the fully qualified domain name of the pod's hostname.
+func (mutator *DnsMutator) fqdn(pod *model.Pod) string {
+	searches := mutator.searches(pod.Namespace)
+	if len(searches) == 0 {
+		return string(pod.Hostname)
+	}
+	return string(pod.Hostname) + "." + searches[0]
+}
+
+// searches returns the search domains for a pod, using the search domain of the pod's
+// own namespace instead of that of the DNS server.
+func (mutator *DnsMutator) searches(namespace string) []string {
+	searches := slices.Clone(mutator.clientConfig.Search)
+	if mutator.namespace == "" || len(searches) == 0 {
+		return searches
+	}
+	if rest, found := strings.CutPrefix(searches[0], mutator.namespace+"."); found {
+		searches[0] = namespace + "." + rest
+	}
+	return searches
+}
+
 func (mutator *DnsMutator) rejectPod(request admission.Request,
 	err error) admission.Response {
 	response := admission.Response{
@@ -192,23 +367,34 @@ func (mutator *DnsMutator) rejectPod(request admission.Request,
 	return response
 }
 
-func RunAdmisstionController(ctx context.Context,
+// NewAdmissionHandler creates the HTTP handler serving the mutating webhook for pods, the
+// validating webhook for workloads, metrics, and the liveness and readiness endpoints.
+// The registration API is served when the registry is not nil. Host aliases that shadow
+// services are detected using serviceExists when it is not nil.
+func NewAdmissionHandler(ctx context.Context,
 	pods *model.Pods,
-	clientset *kubernetes.Clientset,
+	readiness *support.Readiness,
+	clientset kubernetes.Interface,
 	namespace string,
+	watched func(namespace string) bool,
+	serviceExists func(namespace string, name string) bool,
 	dnsServiceName string,
-	crtFile string,
-	keyFile string,
-	podConfig config.PodConfig) error {
+	clientConfig *dns.ClientConfig,
+	podConfig config.PodConfig,
+	registry http.Handler) (*http.ServeMux, error) {
 
 	svc, err := clientset.CoreV1().Services(namespace).Get(ctx, dnsServiceName, v1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("Could not get dns service IP for service '%s': %v", dnsServiceName, err)
+		return nil, fmt.Errorf("Could not get dns service IP for service '%s': %v", dnsServiceName, err)
 	}
 	dnsServiceIP := svc.Spec.ClusterIP
 	klog.Infof("DNS service IP is %s", dnsServiceIP)
 
-	dnsMutator := NewDnsMutator(pods, dnsServiceIP, support.GetClientConfig(), podConfig)
+	dnsMutator := NewDnsMutator(pods, dnsServiceIP, clientConfig, podConfig)
+	dnsMutator.readiness = readiness
+	dnsMutator.namespace = namespace
+	dnsMutator.watched = watched
+	dnsMutator.serviceExists = serviceExists
 	controllerlog.SetLogger(zap.New())
 
 	webhook := admission.Webhook{
@@ -217,13 +403,83 @@ func RunAdmisstionController(ctx context.Context,
 
 	dnsMutatorHandler, err := admission.StandaloneWebhook(&webhook, admission.StandaloneOptions{})
 	if err != nil {
-		return fmt.Errorf("Could not create mutator: %v", err)
+		return nil, fmt.Errorf("Could not create mutator: %v", err)
+	}
+	workloadValidatorHandler, err := admission.StandaloneWebhook(&admission.Webhook{
+		Handler: NewWorkloadValidator(dnsMutator),
+	}, admission.StandaloneOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create workload validator: %v", err)
 	}
 
-	http.HandleFunc("/mutate/pods", dnsMutatorHandler.ServeHTTP)
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate/pods", dnsMutatorHandler.ServeHTTP)
+	mux.HandleFunc("/validate/workloads", workloadValidatorHandler.ServeHTTP)
+	mux.Handle("/metrics", metrics.Handler())
+	if registry != nil {
+		mux.Handle(registration.PREFIX+"/", registry)
+	}
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !readiness.IsReady() {
+			http.Error(w, fmt.Sprintf("waiting for %v", readiness.Pending()),
+				http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	})
+	return mux, nil
+}
+
+// RunAdmisstionController runs the webhook server until the context is canceled. On
+// cancellation, no new requests are accepted and in-flight requests are given at most
+// shutdownTimeout to complete.
+func RunAdmisstionController(ctx context.Context,
+	pods *model.Pods,
+	readiness *support.Readiness,
+	clientset kubernetes.Interface,
+	namespace string,
+	watched func(namespace string) bool,
+	serviceExists func(namespace string, name string) bool,
+	dnsServiceName string,
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+	podConfig config.PodConfig,
+	registry http.Handler,
+	shutdownTimeout time.Duration) error {
+
+	mux, err := NewAdmissionHandler(ctx, pods, readiness, clientset, namespace, watched, serviceExists,
+		dnsServiceName, support.GetClientConfig(), podConfig, registry)
+	if err != nil {
+		return err
+	}
+	// the certificate is obtained for every connection so that it can be renewed.
+	server := &http.Server{
+		Addr:    ":8443",
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: getCertificate,
+		},
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		klog.Info("Stopping webhook server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			klog.Warningf("Webhook server did not stop cleanly: %v", err)
+		}
+	}()
 	klog.Info("Starting webhook server on port 8443")
-	return http.ListenAndServeTLS(":8443", crtFile, keyFile, nil)
+	err = server.ListenAndServeTLS("", "")
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// wait for in-flight requests to complete
+	<-stopped
+	klog.Info("Webhook server stopped")
+	return nil
 }
@@ -13,12 +13,16 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 	"math/rand"
+	"net/http"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	config2 "wamblee.org/kubedock/dns/internal/config"
 	"wamblee.org/kubedock/dns/internal/model"
+	"wamblee.org/kubedock/dns/internal/networkdefinition"
+	"wamblee.org/kubedock/dns/internal/support"
 )
 
 type MutatorTestSuite struct {
@@ -99,8 +103,16 @@ func (s *MutatorTestSuite) createRequest(
 	annotations map[string]string,
 	labels map[string]string,
 	ip string) admission.Request {
+	return s.createRequestInNamespace("kubedock", operation, name, annotations, labels, ip)
+}
 
-	namespace := "kubedock"
+func (s *MutatorTestSuite) createRequestInNamespace(
+	namespace string,
+	operation admissionv1.Operation,
+	name string,
+	annotations map[string]string,
+	labels map[string]string,
+	ip string) admission.Request {
 
 	pod := s.createPod(namespace, name, annotations, labels, ip)
 	podRaw, err := json.Marshal(pod)
@@ -286,6 +298,43 @@ func (s *MutatorTestSuite) Test_MissingNetwork() {
 	s.Nil(s.pods.Get("kubedock", "db"))
 }
 
+func (s *MutatorTestSuite) Test_Quotas() {
+	s.mutator.podConfig.Quotas = config2.Quotas{PodsPerNetwork: 1, HostAliasesPerPod: 1}
+	admitWithIP := func(operation admissionv1.Operation, name string, ip string,
+		hostAliases ...string) admission.Response {
+		annotations := map[string]string{"kubedock.network/0": "test"}
+		for i, hostAlias := range hostAliases {
+			annotations["kubedock.host/"+strconv.Itoa(i)] = hostAlias
+		}
+		return s.mutator.Handle(s.ctx, s.createRequest(operation, name, annotations, s.stdlabels, ip))
+	}
+	admit := func(name string, hostAliases ...string) admission.Response {
+		return admitWithIP("CREATE", name, "", hostAliases...)
+	}
+
+	response := admit("db", "db", "database")
+	s.False(response.Allowed)
+	s.Contains(response.Result.Message, "kubedock/db: pod has 2 host aliases, the maximum is 1")
+	s.Nil(s.pods.Get("kubedock", "db"))
+
+	s.True(admit("db", "db").Allowed)
+	response = admit("service", "service")
+	s.False(response.Allowed)
+	s.Contains(response.Result.Message, "kubedock/service: network 'test' would have 2 pods, the maximum is 1")
+	s.Nil(s.pods.Get("kubedock", "service"))
+
+	// running pods are not rejected when a quota is lowered
+	s.mutator.podConfig.Quotas.PodsPerNetwork = 0
+	s.True(admit("service", "service").Allowed)
+	pod, err := model.NewPod("10.0.0.2", "kubedock", "service", []model.Hostname{"service"},
+		[]model.NetworkId{"test"}, false)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+	s.mutator.podConfig.Quotas.PodsPerNetwork = 1
+	s.True(admitWithIP("UPDATE", "service", "10.0.0.2", "service").Allowed)
+	s.NotNil(s.pods.Get("kubedock", "service"))
+}
+
 func (s *MutatorTestSuite) Test_MissingLabel() {
 	// add another pod in the same network with same hostname
 	request := s.createRequest("CREATE", "db2",
@@ -304,6 +353,67 @@ func (s *MutatorTestSuite) Test_MissingLabel() {
 	s.Nil(s.pods.Get("kubedock", "db"))
 }
 
+func (s *MutatorTestSuite) Test_NetworkDefinitionMembers() {
+	definitions := networkdefinition.NewDefinitions()
+	s.Require().Nil(definitions.Set(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kubedock", Name: "definitions"},
+		Data: map[string]string{
+			"fixtures": "{network: test, selector: 'app in (ldap)', hostAliases: ['{{ .Labels.app }}']}",
+		},
+	}))
+	s.mutator.podConfig.NetworkDefinitions = definitions
+	readiness := support.NewReadiness("pods")
+	s.mutator.readiness = readiness
+	s.mutator.readyTimeout = time.Hour
+
+	// pods without the label are not delayed while not ready.
+	ldap := map[string]string{"app": "ldap"}
+	response := s.mutator.Handle(s.ctx, s.createRequest("CREATE", "ldap-0", nil, ldap, ""))
+	s.True(response.Allowed)
+	s.Empty(response.Patches)
+
+	readiness.Set("pods")
+	response = s.mutator.Handle(s.ctx, s.createRequest("CREATE", "ldap-0", nil, ldap, ""))
+	s.True(response.Allowed)
+	s.NotEmpty(response.Patches)
+	s.NotNil(s.pods.Get("kubedock", "ldap-0"))
+
+	response = s.mutator.Handle(s.ctx, s.createRequest("UPDATE", "ldap-0", nil, ldap, ""))
+	s.True(response.Allowed)
+	s.Empty(response.Patches)
+
+	response = s.mutator.Handle(s.ctx, s.createRequest("CREATE", "web-0", nil,
+		map[string]string{"app": "web"}, ""))
+	s.True(response.Allowed)
+	s.Empty(response.Patches)
+	s.Nil(s.pods.Get("kubedock", "web-0"))
+}
+
+func (s *MutatorTestSuite) Test_UpdateOfAnnotationsAllowedWithoutValidation() {
+	annotations := map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	}
+	oldPod := s.createPod("kubedock", "db", annotations, s.stdlabels, "10.0.0.1")
+	oldRaw, err := json.Marshal(oldPod)
+	s.Require().Nil(err)
+	// never ready, so that requests that are validated fail.
+	s.mutator.readiness = support.NewReadiness("pods")
+	s.mutator.readyTimeout = time.Millisecond
+
+	annotations["kubedock-dns/networks"] = `{"test":["db"]}`
+	request := s.createRequest("UPDATE", "db", annotations, s.stdlabels, "10.0.0.1")
+	request.OldObject.Raw = oldRaw
+	response := s.mutator.Handle(s.ctx, request)
+	s.True(response.Allowed)
+	s.Empty(response.Patches)
+
+	annotations["kubedock.network/0"] = "other"
+	request = s.createRequest("UPDATE", "db", annotations, s.stdlabels, "10.0.0.1")
+	request.OldObject.Raw = oldRaw
+	s.False(s.mutator.Handle(s.ctx, request).Allowed)
+}
+
 func (s *MutatorTestSuite) Test_UpdateAllowedWhenNetworkNotModified() {
 	s.Test_SingleHostAndNetwork()
 	request := s.createRequest("UPDATE", "db",
@@ -367,3 +477,188 @@ func (s *MutatorTestSuite) Test_UpdateDeniedWhenNetworkModified() {
 	klog.V(3).Infof("Message: %s", response.Result.Message)
 	s.True(strings.Contains(response.Result.Message, "cannot change network"))
 }
+
+func (s *MutatorTestSuite) Test_AdmissionDeferredUntilReady() {
+	s.mutator.readiness = support.NewReadiness("pods")
+	s.mutator.readyTimeout = 10 * time.Millisecond
+
+	request := s.createRequest("CREATE", "db",
+		map[string]string{
+			"kubedock.host/0":    "db",
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels,
+		"20.21.22.23")
+	response := s.mutator.Handle(s.ctx, request)
+	s.False(response.Allowed)
+	s.Equal(int32(http.StatusServiceUnavailable), response.Result.Code)
+	s.Nil(s.pods.Get("kubedock", "db"))
+
+	s.mutator.readiness.Set("pods")
+	response = s.mutator.Handle(s.ctx, request)
+	s.Nil(response.Complete(request))
+	s.assertMutated(request, response)
+}
+
+func (s *MutatorTestSuite) Test_PodsInUnwatchedNamespacesAreNotModified() {
+	s.mutator.watched = func(namespace string) bool {
+		return namespace == "kubedock"
+	}
+	request := s.createRequestInNamespace("other", "CREATE", "db",
+		map[string]string{
+			"kubedock.host/0":    "db",
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels,
+		"20.21.22.23")
+	response := s.mutator.Handle(s.ctx, request)
+	s.True(response.Allowed)
+	s.Empty(response.Patches)
+	s.Nil(s.pods.Get("other", "db"))
+}
+
+func (s *MutatorTestSuite) Test_SearchDomainOfPodNamespace() {
+	s.mutator.namespace = "a"
+	request := s.createRequestInNamespace("team-a", "CREATE", "db",
+		map[string]string{
+			"kubedock.host/0":    "db",
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels,
+		"20.21.22.23")
+	response := s.mutator.Handle(s.ctx, request)
+	s.True(response.Allowed)
+	s.Equal(2, len(response.Patches))
+	dnsConfig := response.Patches[1].Value.(corev1.PodDNSConfig)
+	s.Equal([]string{"team-a.b.c", "b.c", "c"}, dnsConfig.Searches)
+	// the client config is not modified.
+	s.Equal([]string{"a.b.c", "b.c", "c"}, s.clientConfig.Search)
+	s.NotNil(s.pods.Get("team-a", "db"))
+}
+
+func (s *MutatorTestSuite) Test_GlobalNetworkPolicy() {
+	s.config.GlobalNetworks = map[string][]string{"fixtures": {"team-a"}}
+	defer func() { s.config.GlobalNetworks = nil }()
+	s.mutator = NewDnsMutator(s.pods, s.dnsip, &s.clientConfig, s.config)
+
+	annotations := map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+		"kubedock.network/1": "fixtures",
+	}
+	response := s.mutator.Handle(s.ctx,
+		s.createRequestInNamespace("team-b", "CREATE", "db", annotations, s.stdlabels, "20.21.22.23"))
+	s.False(response.Allowed)
+	s.Contains(response.Result.Message, "may not join global network 'fixtures'")
+	s.Nil(s.pods.Get("team-b", "db"))
+
+	response = s.mutator.Handle(s.ctx,
+		s.createRequestInNamespace("team-a", "CREATE", "db", annotations, s.stdlabels, "20.21.22.24"))
+	s.True(response.Allowed)
+	s.Equal([]model.NetworkId{"global:fixtures", "test"}, s.pods.Get("team-a", "db").Networks)
+}
+
+func (s *MutatorTestSuite) Test_ExistingDnsConfigIsMerged() {
+	request := s.createRequest("CREATE", "db",
+		map[string]string{
+			"kubedock.host/0":    "db",
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels,
+		"20.21.22.23")
+	var pod v1.Pod
+	s.Require().Nil(json.Unmarshal(request.Object.Raw, &pod))
+	ndots := "2"
+	pod.Spec.DNSConfig = &v1.PodDNSConfig{
+		Nameservers: []string{"1.1.1.1"},
+		Searches:    []string{"example.com", "b.c"},
+		Options: []v1.PodDNSConfigOption{
+			{Name: "edns0"},
+			{Name: "ndots", Value: &ndots},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	s.Require().Nil(err)
+	request.Object.Raw = raw
+
+	response := s.mutator.Handle(s.ctx, request)
+	s.True(response.Allowed)
+	dnsConfig := response.Patches[1].Value.(corev1.PodDNSConfig)
+	s.Equal([]string{s.dnsip, "1.1.1.1"}, dnsConfig.Nameservers)
+	s.Equal([]string{"a.b.c", "b.c", "c", "example.com"}, dnsConfig.Searches)
+	s.Equal("ndots", dnsConfig.Options[0].Name)
+	s.Equal("5", *dnsConfig.Options[0].Value)
+	s.Equal("edns0", dnsConfig.Options[3].Name)
+	s.Equal([]string{
+		"kubedock-dns: merged dnsConfig: nameservers [10.11.12.13 1.1.1.1], searches [a.b.c b.c c example.com], " +
+			"options [ndots:5 timeout:10 attempts:3 edns0]",
+		"kubedock-dns: option ndots:2 overridden by ndots:5",
+		"kubedock-dns: network 'test' has no other members yet",
+	}, response.Warnings)
+}
+
+func (s *MutatorTestSuite) hostnamePatches(response admission.Response) map[string]any {
+	patches := make(map[string]any)
+	for _, patch := range response.Patches[2:] {
+		patches[patch.Path] = patch.Value
+	}
+	return patches
+}
+
+func (s *MutatorTestSuite) Test_HostnameFromPrimaryHostAlias() {
+	s.config.SetHostname = true
+	s.config.HostnameAsFQDN = true
+	defer func() {
+		s.config.SetHostname = false
+		s.config.HostnameAsFQDN = false
+	}()
+	s.mutator = NewDnsMutator(s.pods, s.dnsip, &s.clientConfig, s.config)
+
+	response := s.mutator.Handle(s.ctx, s.createRequest("CREATE", "kafka",
+		map[string]string{
+			"kubedock.host/0":       "broker",
+			"kubedock.host/primary": "kafka.test",
+			"kubedock.network/0":    "test",
+		},
+		s.stdlabels, ""))
+	s.True(response.Allowed)
+	s.Equal(map[string]any{
+		"/spec/hostname":          "kafka",
+		"/spec/subdomain":         "test",
+		"/spec/setHostnameAsFQDN": true,
+	}, s.hostnamePatches(response))
+
+	// FQDN would be too long
+	longname := strings.Repeat("x", 60)
+	response = s.mutator.Handle(s.ctx, s.createRequest("CREATE", "zookeeper",
+		map[string]string{
+			"kubedock.host/0":    longname,
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels, ""))
+	s.True(response.Allowed)
+	s.Equal(map[string]any{
+		"/spec/hostname": longname,
+	}, s.hostnamePatches(response))
+
+	// not usable as hostname
+	response = s.mutator.Handle(s.ctx, s.createRequest("CREATE", "db",
+		map[string]string{
+			"kubedock.host/0":    "db.test.local",
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels, ""))
+	s.True(response.Allowed)
+	s.Empty(s.hostnamePatches(response))
+}
+
+func (s *MutatorTestSuite) Test_NoHostnameByDefault() {
+	response := s.mutator.Handle(s.ctx, s.createRequest("CREATE", "kafka",
+		map[string]string{
+			"kubedock.host/0":    "kafka",
+			"kubedock.network/0": "test",
+		},
+		s.stdlabels, ""))
+	s.True(response.Allowed)
+	s.Empty(s.hostnamePatches(response))
+}
@@ -0,0 +1,99 @@
+package admissioncontroller
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"slices"
+	"strings"
+)
+
+// Maximum number of nameservers supported by Kubernetes.
+const MAX_NAMESERVERS = 3
+
+// mergedDnsConfig is the DNS configuration of a pod merged into that of kubedock-dns.
+type mergedDnsConfig struct {
+	ours   corev1.PodDNSConfig
+	merged corev1.PodDNSConfig
+	// settings of the pod that were dropped or overridden.
+	messages []string
+}
+
+// mergeDnsConfig merges the DNS configuration of a pod into the configuration of kubedock-dns.
+// The precedence is as follows:
+//   - nameservers: the kubedock-dns nameserver comes first, followed by the nameservers of
+//     the pod. Nameservers beyond the Kubernetes limit of 3 are dropped.
+//   - searches: the kubedock-dns search domains come first, followed by those of the pod.
+//   - options: the kubedock-dns options (ndots, timeout, attempts) take precedence over
+//     options of the pod with the same name, all other options of the pod are kept.
+//
+// Duplicates are removed. Messages are returned for every setting of the pod that was
+// dropped or overridden.
+func mergeDnsConfig(ours corev1.PodDNSConfig, pod *corev1.PodDNSConfig) (corev1.PodDNSConfig, []string) {
+	merged := corev1.PodDNSConfig{
+		Nameservers: slices.Clone(ours.Nameservers),
+		Searches:    slices.Clone(ours.Searches),
+		Options:     slices.Clone(ours.Options),
+	}
+	if pod == nil {
+		return merged, nil
+	}
+	messages := make([]string, 0)
+
+	for _, nameserver := range pod.Nameservers {
+		if slices.Contains(merged.Nameservers, nameserver) {
+			continue
+		}
+		if len(merged.Nameservers) == MAX_NAMESERVERS {
+			messages = append(messages, fmt.Sprintf("nameserver %s dropped, at most %d nameservers are allowed",
+				nameserver, MAX_NAMESERVERS))
+			continue
+		}
+		merged.Nameservers = append(merged.Nameservers, nameserver)
+	}
+
+	for _, search := range pod.Searches {
+		if !slices.Contains(merged.Searches, search) {
+			merged.Searches = append(merged.Searches, search)
+		}
+	}
+
+	for _, option := range pod.Options {
+		i := slices.IndexFunc(merged.Options, func(o corev1.PodDNSConfigOption) bool {
+			return o.Name == option.Name
+		})
+		if i < 0 {
+			merged.Options = append(merged.Options, option)
+			continue
+		}
+		if optionValue(merged.Options[i]) != optionValue(option) {
+			messages = append(messages, fmt.Sprintf("option %s overridden by %s",
+				optionString(option), optionString(merged.Options[i])))
+		}
+	}
+	return merged, messages
+}
+
+func optionValue(option corev1.PodDNSConfigOption) string {
+	if option.Value == nil {
+		return ""
+	}
+	return *option.Value
+}
+
+func optionString(option corev1.PodDNSConfigOption) string {
+	if option.Value == nil {
+		return option.Name
+	}
+	return option.Name + ":" + *option.Value
+}
+
+// dnsConfigString describes a DNS configuration for warnings.
+func dnsConfigString(config corev1.PodDNSConfig) string {
+	options := make([]string, 0, len(config.Options))
+	for _, option := range config.Options {
+		options = append(options, optionString(option))
+	}
+	return fmt.Sprintf("nameservers [%s], searches [%s], options [%s]",
+		strings.Join(config.Nameservers, " "), strings.Join(config.Searches, " "),
+		strings.Join(options, " "))
+}
@@ -0,0 +1,60 @@
+package admissioncontroller
+
+import (
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+type DnsConfigTestSuite struct {
+	suite.Suite
+}
+
+func TestDnsConfigSuite(t *testing.T) {
+	suite.Run(t, &DnsConfigTestSuite{})
+}
+
+func (s *DnsConfigTestSuite) option(name string, value string) corev1.PodDNSConfigOption {
+	return corev1.PodDNSConfigOption{Name: name, Value: &value}
+}
+
+func (s *DnsConfigTestSuite) ours() corev1.PodDNSConfig {
+	return corev1.PodDNSConfig{
+		Nameservers: []string{"10.0.0.10"},
+		Searches:    []string{"ns.svc.cluster.local", "svc.cluster.local"},
+		Options:     []corev1.PodDNSConfigOption{s.option("ndots", "5")},
+	}
+}
+
+func (s *DnsConfigTestSuite) Test_NoPodDnsConfig() {
+	merged, messages := mergeDnsConfig(s.ours(), nil)
+	s.Equal(s.ours(), merged)
+	s.Empty(messages)
+}
+
+func (s *DnsConfigTestSuite) Test_MergeIsIdempotent() {
+	ours := s.ours()
+	merged, messages := mergeDnsConfig(ours, &ours)
+	s.Equal(ours, merged)
+	s.Empty(messages)
+}
+
+func (s *DnsConfigTestSuite) Test_NameserverLimit() {
+	merged, messages := mergeDnsConfig(s.ours(), &corev1.PodDNSConfig{
+		Nameservers: []string{"1.1.1.1", "10.0.0.10", "8.8.8.8", "9.9.9.9"},
+	})
+	s.Equal([]string{"10.0.0.10", "1.1.1.1", "8.8.8.8"}, merged.Nameservers)
+	s.Equal([]string{"nameserver 9.9.9.9 dropped, at most 3 nameservers are allowed"}, messages)
+}
+
+func (s *DnsConfigTestSuite) Test_Options() {
+	merged, messages := mergeDnsConfig(s.ours(), &corev1.PodDNSConfig{
+		Options: []corev1.PodDNSConfigOption{
+			{Name: "single-request-reopen"},
+			s.option("ndots", "5"),
+		},
+	})
+	s.Equal([]corev1.PodDNSConfigOption{s.option("ndots", "5"), {Name: "single-request-reopen"}},
+		merged.Options)
+	s.Empty(messages)
+}
@@ -0,0 +1,189 @@
+package admissioncontroller
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+	"reflect"
+	"slices"
+	"strings"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// Kinds of warnings for issues that do not prevent a pod from being admitted. All except
+// WARNING_SINGLE_MEMBER can be escalated to rejections.
+const (
+	// A host alias has the same name as a service, which can then no longer be reached
+	// by name from the network.
+	WARNING_SERVICE_SHADOWED = "service-shadowed"
+	// A network of the pod has no other members.
+	WARNING_SINGLE_MEMBER = "single-member"
+	// A host alias is not a valid DNS name.
+	WARNING_INVALID_DNS_LABEL = "invalid-dns-label"
+	// The DNS configuration of the pod is modified.
+	WARNING_DNS_CONFIG_OVERWRITTEN = "dnsconfig-overwritten"
+)
+
+var WARNING_KINDS = []string{
+	WARNING_SERVICE_SHADOWED,
+	WARNING_SINGLE_MEMBER,
+	WARNING_INVALID_DNS_LABEL,
+	WARNING_DNS_CONFIG_OVERWRITTEN,
+}
+
+// REJECTABLE_WARNING_KINDS are the warnings that can be escalated. The first member of
+// every network is a single member, so rejecting these would prevent networks from being
+// created.
+var REJECTABLE_WARNING_KINDS = []string{
+	WARNING_SERVICE_SHADOWED,
+	WARNING_INVALID_DNS_LABEL,
+	WARNING_DNS_CONFIG_OVERWRITTEN,
+}
+
+type Warning struct {
+	Kind    string
+	Message string
+}
+
+func (warning Warning) String() string {
+	return "kubedock-dns: " + warning.Message
+}
+
+// ValidateWarningKinds verifies that the warning kinds can be escalated to rejections.
+func ValidateWarningKinds(kinds []string) error {
+	for _, kind := range kinds {
+		if kind == WARNING_SINGLE_MEMBER {
+			return fmt.Errorf("Warning '%s' cannot reject pods since it is reported for the first member of every network",
+				kind)
+		}
+		if !slices.Contains(REJECTABLE_WARNING_KINDS, kind) {
+			return fmt.Errorf("Unknown warning '%s', expected one of %v", kind, REJECTABLE_WARNING_KINDS)
+		}
+	}
+	return nil
+}
+
+func warningStrings(warnings []Warning) []string {
+	res := make([]string, 0, len(warnings))
+	for _, warning := range warnings {
+		res = append(res, warning.String())
+	}
+	return res
+}
+
+// warnings returns the warnings for a valid pod. The networks include the pod.
+func (mutator *DnsMutator) warnings(k8spod *corev1.Pod, pod *model.Pod, networks *model.Networks,
+	dnsConfig mergedDnsConfig) []Warning {
+	warnings := dnsConfigWarnings(k8spod, dnsConfig)
+	warnings = append(warnings, invalidDnsLabelWarnings(pod)...)
+	warnings = append(warnings, mutator.shadowedServiceWarnings(pod)...)
+	warnings = append(warnings, singleMemberWarnings(pod, networks)...)
+	return warnings
+}
+
+// escalate returns an error for the first warning that must be a rejection. Shadowed
+// services are also rejected by the reject shadow policy.
+func (mutator *DnsMutator) escalate(pod *model.Pod, warnings []Warning) error {
+	for _, warning := range warnings {
+		if slices.Contains(mutator.podConfig.RejectedWarnings, warning.Kind) ||
+			(warning.Kind == WARNING_SERVICE_SHADOWED &&
+				mutator.podConfig.ShadowPolicy == model.SHADOW_POLICY_REJECT) {
+			return fmt.Errorf("%s/%s: %s (%s)", pod.Namespace, pod.Name, warning.Message, warning.Kind)
+		}
+	}
+	return nil
+}
+
+// dnsConfigWarnings reports how the DNS configuration of the pod itself is modified.
+func dnsConfigWarnings(k8spod *corev1.Pod, dnsConfig mergedDnsConfig) []Warning {
+	warnings := make([]Warning, 0)
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, Warning{
+			Kind:    WARNING_DNS_CONFIG_OVERWRITTEN,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	if !reflect.DeepEqual(dnsConfig.merged, dnsConfig.ours) || len(dnsConfig.messages) > 0 {
+		warn("merged dnsConfig: %s", dnsConfigString(dnsConfig.merged))
+	}
+	for _, message := range dnsConfig.messages {
+		warn("%s", message)
+	}
+	// ClusterFirst is the default that is set by the API server.
+	policy := k8spod.Spec.DNSPolicy
+	if policy != "" && policy != corev1.DNSClusterFirst && policy != corev1.DNSNone {
+		warn("dnsPolicy %s replaced by %s", policy, corev1.DNSNone)
+	}
+	return warnings
+}
+
+// invalidDnsLabelWarnings reports host aliases that are accepted as hostname but which
+// are not valid DNS names, such as names with uppercase characters or long labels.
+func invalidDnsLabelWarnings(pod *model.Pod) []Warning {
+	warnings := make([]Warning, 0)
+	for _, hostalias := range pod.HostAliases {
+		for _, label := range strings.Split(string(hostalias), ".") {
+			if errs := validation.IsDNS1123Label(label); len(errs) > 0 {
+				warnings = append(warnings, Warning{
+					Kind: WARNING_INVALID_DNS_LABEL,
+					Message: fmt.Sprintf("host alias '%s' is not a valid DNS name: %s",
+						hostalias, strings.Join(errs, ", ")),
+				})
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// shadowedServiceWarnings reports host aliases that are also the name of a service,
+// either '<service>' in the namespace of the pod or '<service>.<namespace>'.
+func (mutator *DnsMutator) shadowedServiceWarnings(pod *model.Pod) []Warning {
+	warnings := make([]Warning, 0)
+	if mutator.serviceExists == nil {
+		return warnings
+	}
+	for _, hostalias := range pod.HostAliases {
+		namespace, service, ok := model.ServiceName(pod.Namespace, hostalias)
+		if !ok {
+			continue
+		}
+		if !mutator.serviceExists(namespace, service) {
+			continue
+		}
+		message := fmt.Sprintf("host alias '%s' shadows service %s/%s in the network",
+			hostalias, namespace, service)
+		winner := "local"
+		if mutator.podConfig.ShadowPolicy == model.SHADOW_POLICY_SERVICE {
+			message = fmt.Sprintf("host alias '%s' is shadowed by service %s/%s in the network",
+				hostalias, namespace, service)
+			winner = "service"
+		}
+		// with the local policy, lookups do not depend on services and are not logged.
+		if mutator.podConfig.ShadowPolicy != model.SHADOW_POLICY_REJECT {
+			klog.V(2).Infof("%s/%s: %s, %s wins", pod.Namespace, pod.Name, message, winner)
+		}
+		warnings = append(warnings, Warning{
+			Kind:    WARNING_SERVICE_SHADOWED,
+			Message: message,
+		})
+	}
+	return warnings
+}
+
+// singleMemberWarnings reports networks of the pod without other members. These are
+// likely to be misspelled.
+func singleMemberWarnings(pod *model.Pod, networks *model.Networks) []Warning {
+	warnings := make([]Warning, 0)
+	for _, networkId := range pod.Networks {
+		network := networks.NameToNetwork[model.NewNetworkKey(pod.Namespace, networkId)]
+		if network != nil && len(network.IPToPod) == 1 {
+			warnings = append(warnings, Warning{
+				Kind:    WARNING_SINGLE_MEMBER,
+				Message: fmt.Sprintf("network '%s' has no other members yet", networkId),
+			})
+		}
+	}
+	return warnings
+}
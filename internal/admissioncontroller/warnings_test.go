@@ -0,0 +1,158 @@
+package admissioncontroller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"slices"
+	"strings"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+func (s *MutatorTestSuite) admit(name string, annotations map[string]string) ([]string, bool) {
+	response := s.mutator.Handle(s.ctx, s.createRequest("CREATE", name, annotations, s.stdlabels, ""))
+	return response.Warnings, response.Allowed
+}
+
+func (s *MutatorTestSuite) Test_SingleMemberWarning() {
+	warnings, allowed := s.admit("db", map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	})
+	s.True(allowed)
+	s.Equal([]string{"kubedock-dns: network 'test' has no other members yet"}, warnings)
+
+	warnings, allowed = s.admit("service", map[string]string{
+		"kubedock.host/0":    "service",
+		"kubedock.network/0": "test",
+	})
+	s.True(allowed)
+	s.Empty(warnings)
+}
+
+func (s *MutatorTestSuite) Test_InvalidDnsLabelWarning() {
+	s.admit("db", map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	})
+	warnings, allowed := s.admit("service", map[string]string{
+		"kubedock.host/0":    "Service",
+		"kubedock.host/1":    "service." + strings.Repeat("x", 64),
+		"kubedock.network/0": "test",
+	})
+	s.True(allowed)
+	s.Equal(2, len(warnings))
+	s.Contains(warnings[0], "host alias 'Service' is not a valid DNS name")
+	s.Contains(warnings[1], "host alias 'service.xxx")
+}
+
+// services returns a function that returns whether a service exists, as obtained from the
+// watched service names.
+func services(names ...string) func(namespace string, name string) bool {
+	return func(namespace string, name string) bool {
+		return slices.Contains(names, namespace+"/"+name)
+	}
+}
+
+func (s *MutatorTestSuite) Test_ServiceShadowedWarning() {
+	s.mutator.serviceExists = services("kubedock/db", "fixtures/ldap")
+	s.admit("service", map[string]string{
+		"kubedock.host/0":    "service",
+		"kubedock.network/0": "test",
+	})
+	warnings, allowed := s.admit("db", map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.host/1":    "ldap.fixtures.svc",
+		"kubedock.host/2":    "other",
+		"kubedock.network/0": "test",
+	})
+	s.True(allowed)
+	s.Equal([]string{
+		"kubedock-dns: host alias 'db' shadows service kubedock/db in the network",
+		"kubedock-dns: host alias 'ldap.fixtures.svc' shadows service fixtures/ldap in the network",
+	}, warnings)
+}
+
+func (s *MutatorTestSuite) Test_ShadowPolicies() {
+	defer func() { s.config.ShadowPolicy = "" }()
+	serviceExists := services("kubedock/db")
+	annotations := map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	}
+
+	s.config.ShadowPolicy = model.SHADOW_POLICY_SERVICE
+	s.mutator = NewDnsMutator(s.pods, s.dnsip, &s.clientConfig, s.config)
+	s.mutator.serviceExists = serviceExists
+	warnings, allowed := s.admit("db", annotations)
+	s.True(allowed)
+	s.Contains(warnings, "kubedock-dns: host alias 'db' is shadowed by service kubedock/db in the network")
+	s.pods.Delete("kubedock", "db")
+
+	s.config.ShadowPolicy = model.SHADOW_POLICY_REJECT
+	s.mutator = NewDnsMutator(s.pods, s.dnsip, &s.clientConfig, s.config)
+	s.mutator.serviceExists = serviceExists
+	_, allowed = s.admit("db", annotations)
+	s.False(allowed)
+	s.Nil(s.pods.Get("kubedock", "db"))
+}
+
+func (s *MutatorTestSuite) Test_DnsPolicyWarning() {
+	s.admit("db", map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	})
+	k8spod := s.createPod("kubedock", "service", map[string]string{
+		"kubedock.host/0":    "service",
+		"kubedock.network/0": "test",
+	}, s.stdlabels, "")
+	for _, policy := range []v1.DNSPolicy{v1.DNSClusterFirst, v1.DNSDefault} {
+		k8spod.Spec.DNSPolicy = policy
+		warnings := dnsConfigWarnings(&k8spod, s.mutator.podDnsConfig("kubedock", &k8spod))
+		if policy == v1.DNSClusterFirst {
+			s.Empty(warnings)
+		} else {
+			s.Equal([]Warning{{
+				Kind:    WARNING_DNS_CONFIG_OVERWRITTEN,
+				Message: "dnsPolicy Default replaced by None",
+			}}, warnings)
+		}
+	}
+}
+
+func (s *MutatorTestSuite) Test_WarningsEscalatedToRejections() {
+	s.config.RejectedWarnings = []string{WARNING_INVALID_DNS_LABEL}
+	defer func() { s.config.RejectedWarnings = nil }()
+	s.mutator = NewDnsMutator(s.pods, s.dnsip, &s.clientConfig, s.config)
+
+	// not escalated
+	_, allowed := s.admit("db", map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	})
+	s.True(allowed)
+
+	_, allowed = s.admit("service", map[string]string{
+		"kubedock.host/0":    "Service",
+		"kubedock.network/0": "test",
+	})
+	s.False(allowed)
+	s.Nil(s.pods.Get("kubedock", "service"))
+
+	// also for workloads
+	validator := NewWorkloadValidator(s.mutator)
+	response := validator.Handle(s.ctx, s.workloadRequest("Deployment", appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: s.podTemplate(map[string]string{
+				"kubedock.host/0":    "Service",
+				"kubedock.network/0": "test",
+			}),
+		},
+	}))
+	s.False(response.Allowed)
+}
+
+func (s *MutatorTestSuite) Test_ValidateWarningKinds() {
+	s.Nil(ValidateWarningKinds([]string{WARNING_INVALID_DNS_LABEL, WARNING_SERVICE_SHADOWED}))
+	s.NotNil(ValidateWarningKinds([]string{"unknown"}))
+	s.NotNil(ValidateWarningKinds([]string{WARNING_SINGLE_MEMBER}))
+}
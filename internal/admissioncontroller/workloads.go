@@ -0,0 +1,188 @@
+package admissioncontroller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// WorkloadValidator validates the network configuration in the pod templates of workloads
+// so that errors are reported when the workload is created instead of as events when its
+// pods are created. The pods themselves are still validated and mutated by the DnsMutator.
+type WorkloadValidator struct {
+	mutator *DnsMutator
+}
+
+func NewWorkloadValidator(mutator *DnsMutator) *WorkloadValidator {
+	return &WorkloadValidator{
+		mutator: mutator,
+	}
+}
+
+// Handle validates a workload. Workloads that are not kubedock workloads are allowed
+// immediately, so that these are not affected when the server is not ready yet.
+func (validator *WorkloadValidator) Handle(ctx context.Context, request admission.Request) admission.Response {
+	mutator := validator.mutator
+	if mutator.watched != nil && !mutator.watched(request.Namespace) {
+		return admission.Allowed("namespace not watched")
+	}
+	template, added, err := getPodTemplate(request)
+	if err != nil {
+		return mutator.errored(http.StatusBadRequest, err)
+	}
+	if template == nil {
+		return admission.Allowed("not a workload")
+	}
+	if template.Labels[mutator.podConfig.LabelName] != "true" {
+		return admission.Allowed("not a kubedock workload")
+	}
+	if err := mutator.waitUntilReady(ctx); err != nil {
+		return mutator.errored(http.StatusServiceUnavailable, err)
+	}
+
+	// The name identifies the workload in error messages and cannot clash with pod names.
+	k8spod := &corev1.Pod{
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	k8spod.Namespace = request.Namespace
+	k8spod.Name = strings.ToLower(request.Kind.Kind) + "/" + request.Name
+	warnings, err := validator.validate(k8spod, request.Operation, added)
+	if err != nil {
+		klog.Warningf("%s/%s: invalid pod template: %v", request.Namespace, k8spod.Name, err)
+		return mutator.rejectPod(request, err)
+	}
+	return admission.Allowed("").WithWarnings(warningStrings(warnings)...)
+}
+
+// validate validates the pod template in the same way as a pod, but without adding it
+// to the pod administration, and returns the warnings for the pod template. The quotas are
+// checked for the number of pods that the workload adds, which can be zero for updates.
+func (validator *WorkloadValidator) validate(k8spod *corev1.Pod, operation admissionv1.Operation,
+	added int) ([]Warning, error) {
+	mutator := validator.mutator
+	podConfig := mutator.podConfig
+	pod, err := model.GetPodEssentials(k8spod, model.UNKNOWN_IP_PREFIX+k8spod.Name, podConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := model.CheckGlobalNetworks(pod, podConfig); err != nil {
+		return nil, err
+	}
+	pods := mutator.pods.Copy()
+	pods.AddOrUpdate(pod)
+	networks, podErrors := pods.Networks()
+	if podErrors != nil {
+		if err := podErrors.FirstError(pod); err != nil {
+			return nil, err
+		}
+	}
+	if added > 0 {
+		// the first pod is the one that can create networks.
+		if err := checkQuotas(networks, pod, podConfig.Quotas); err != nil {
+			return nil, err
+		}
+	}
+	if added > 1 {
+		for i := 1; i < added; i++ {
+			replica := k8spod.DeepCopy()
+			replica.Name = fmt.Sprintf("%s-%d", k8spod.Name, i)
+			replicaPod, err := model.GetPodEssentials(replica, model.UNKNOWN_IP_PREFIX+replica.Name, podConfig)
+			if err != nil {
+				return nil, err
+			}
+			pods.AddOrUpdate(replicaPod)
+		}
+		networks, _ = pods.Networks()
+		if err := checkQuotas(networks, pod, podConfig.Quotas); err != nil {
+			return nil, err
+		}
+	}
+	warnings := mutator.warnings(k8spod, pod, networks, mutator.podDnsConfig(k8spod.Namespace, k8spod))
+	if operation == admissionv1.Create {
+		if err := mutator.escalate(pod, warnings); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+func checkQuotas(networks *model.Networks, pod *model.Pod, quotas config.Quotas) error {
+	err := networks.CheckQuotas(pod, quotas)
+	var quotaError *model.QuotaError
+	if errors.As(err, &quotaError) {
+		metrics.QuotaRejections.WithLabelValues(quotaError.Quota).Inc()
+	}
+	return err
+}
+
+// getPodTemplate returns the pod template of a workload, or nil for other objects, and the
+// number of pods that the request adds. For updates, this is the increase of the replicas.
+// Scaling through the scale subresource is not validated.
+func getPodTemplate(request admission.Request) (*corev1.PodTemplateSpec, int, error) {
+	if request.Operation == admissionv1.Delete {
+		return nil, 0, nil
+	}
+	template, replicas, err := getWorkload(request.Kind.Kind, request.Object.Raw)
+	if err != nil || template == nil || request.Operation != admissionv1.Update {
+		return template, replicas, err
+	}
+	_, oldReplicas, err := getWorkload(request.Kind.Kind, request.OldObject.Raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	return template, max(replicas-oldReplicas, 0), nil
+}
+
+// getWorkload returns the pod template of a workload, or nil for other objects, and the
+// number of pods that run concurrently. For jobs, this is the parallelism.
+func getWorkload(kind string, raw []byte) (*corev1.PodTemplateSpec, int, error) {
+	var template *corev1.PodTemplateSpec
+	var count *int32
+	var err error
+	switch kind {
+	case "Deployment":
+		var deployment appsv1.Deployment
+		err = json.Unmarshal(raw, &deployment)
+		template = &deployment.Spec.Template
+		count = deployment.Spec.Replicas
+	case "StatefulSet":
+		var statefulSet appsv1.StatefulSet
+		err = json.Unmarshal(raw, &statefulSet)
+		template = &statefulSet.Spec.Template
+		count = statefulSet.Spec.Replicas
+	case "Job":
+		var job batchv1.Job
+		err = json.Unmarshal(raw, &job)
+		template = &job.Spec.Template
+		count = job.Spec.Parallelism
+	case "CronJob":
+		var cronJob batchv1.CronJob
+		err = json.Unmarshal(raw, &cronJob)
+		template = &cronJob.Spec.JobTemplate.Spec.Template
+		count = cronJob.Spec.JobTemplate.Spec.Parallelism
+	default:
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not unmarshal %s: %v", kind, err)
+	}
+	// the default is a single replica.
+	replicas := 1
+	if count != nil {
+		replicas = int(*count)
+	}
+	return template, replicas, nil
+}
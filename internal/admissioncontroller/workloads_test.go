@@ -0,0 +1,138 @@
+package admissioncontroller
+
+import (
+	"encoding/json"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"time"
+	"wamblee.org/kubedock/dns/internal/support"
+)
+
+func (s *MutatorTestSuite) podTemplate(annotations map[string]string) v1.PodTemplateSpec {
+	return v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      s.stdlabels,
+			Annotations: annotations,
+		},
+	}
+}
+
+func (s *MutatorTestSuite) workloadRequest(kind string, workload any) admission.Request {
+	raw, err := json.Marshal(workload)
+	s.Require().Nil(err)
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			UID:       "1",
+			Kind:      metav1.GroupVersionKind{Kind: kind},
+			Name:      "workload",
+			Namespace: "kubedock",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func (s *MutatorTestSuite) Test_WorkloadPodTemplatesAreValidated() {
+	validator := NewWorkloadValidator(s.mutator)
+	valid := s.podTemplate(map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	})
+	invalid := s.podTemplate(map[string]string{
+		"kubedock.host/0": "db",
+	})
+	workloads := func(template v1.PodTemplateSpec) map[string]any {
+		return map[string]any{
+			"Deployment":  appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}},
+			"StatefulSet": appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: template}},
+			"Job":         batchv1.Job{Spec: batchv1.JobSpec{Template: template}},
+			"CronJob": batchv1.CronJob{Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+			}},
+		}
+	}
+	for kind, workload := range workloads(valid) {
+		response := validator.Handle(s.ctx, s.workloadRequest(kind, workload))
+		s.True(response.Allowed, kind)
+	}
+	for kind, workload := range workloads(invalid) {
+		response := validator.Handle(s.ctx, s.workloadRequest(kind, workload))
+		s.False(response.Allowed, kind)
+		s.Contains(response.Result.Message, "no host or no network", kind)
+	}
+	// templates are not added to the pod administration.
+	s.Equal(0, s.pods.Pods.Len())
+}
+
+func (s *MutatorTestSuite) Test_WorkloadsWithoutKubedockLabelAreAllowed() {
+	validator := NewWorkloadValidator(s.mutator)
+	template := s.podTemplate(map[string]string{"kubedock.host/0": "db"})
+	template.Labels = nil
+	response := validator.Handle(s.ctx, s.workloadRequest("Deployment",
+		appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}))
+	s.True(response.Allowed)
+
+	response = validator.Handle(s.ctx, s.workloadRequest("ConfigMap", v1.ConfigMap{}))
+	s.True(response.Allowed)
+}
+
+func (s *MutatorTestSuite) Test_WorkloadsWithoutKubedockLabelDoNotWaitUntilReady() {
+	s.mutator.readiness = support.NewReadiness("pods")
+	s.mutator.readyTimeout = 10 * time.Millisecond
+	validator := NewWorkloadValidator(s.mutator)
+	template := s.podTemplate(map[string]string{"kubedock.host/0": "db"})
+	template.Labels = nil
+	response := validator.Handle(s.ctx, s.workloadRequest("Deployment",
+		appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}))
+	s.True(response.Allowed)
+
+	template.Labels = s.stdlabels
+	response = validator.Handle(s.ctx, s.workloadRequest("Deployment",
+		appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}))
+	s.False(response.Allowed)
+	s.Equal(int32(http.StatusServiceUnavailable), response.Result.Code)
+}
+
+func (s *MutatorTestSuite) Test_WorkloadReplicasCountForQuotas() {
+	s.mutator.podConfig.Quotas.PodsPerNetwork = 3
+	validator := NewWorkloadValidator(s.mutator)
+	template := s.podTemplate(map[string]string{
+		"kubedock.host/0":    "db",
+		"kubedock.network/0": "test",
+	})
+	deployment := func(replicas int32) appsv1.Deployment {
+		return appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &replicas, Template: template}}
+	}
+	update := func(oldReplicas int32, replicas int32) admission.Request {
+		request := s.workloadRequest("Deployment", deployment(replicas))
+		raw, err := json.Marshal(deployment(oldReplicas))
+		s.Require().Nil(err)
+		request.Operation = admissionv1.Update
+		request.OldObject = runtime.RawExtension{Raw: raw}
+		return request
+	}
+
+	s.True(validator.Handle(s.ctx, s.workloadRequest("Deployment", deployment(3))).Allowed)
+	response := validator.Handle(s.ctx, s.workloadRequest("Deployment", deployment(4)))
+	s.False(response.Allowed)
+	s.Contains(response.Result.Message, "network 'test' would have 4 pods, the maximum is 3")
+
+	// the pods of the workload already exist when it is updated.
+	for _, name := range []string{"db-1", "db-2", "db-3"} {
+		s.admit(name, map[string]string{
+			"kubedock.host/0":    "db",
+			"kubedock.network/0": "test",
+		})
+	}
+	s.True(validator.Handle(s.ctx, update(3, 3)).Allowed)
+	s.True(validator.Handle(s.ctx, update(3, 2)).Allowed)
+	s.False(validator.Handle(s.ctx, update(3, 4)).Allowed)
+	// templates are not added to the pod administration.
+	s.Equal(3, s.pods.Pods.Len())
+}
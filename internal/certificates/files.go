@@ -0,0 +1,84 @@
+package certificates
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"k8s.io/klog/v2"
+	"os"
+	"sync"
+	"time"
+	"wamblee.org/kubedock/dns/internal/metrics"
+)
+
+// KeyPairFiles serves a certificate from files and reloads it when the files change,
+// for instance when the secret that is mounted is updated.
+type KeyPairFiles struct {
+	crtFile string
+	keyFile string
+
+	mutex       sync.Mutex
+	modTime     time.Time
+	certificate *tls.Certificate
+}
+
+func NewKeyPairFiles(crtFile string, keyFile string) (*KeyPairFiles, error) {
+	files := &KeyPairFiles{
+		crtFile: crtFile,
+		keyFile: keyFile,
+	}
+	if err := files.reload(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetCertificate returns the certificate, for use in tls.Config. When the files were
+// changed but cannot be loaded, the previous certificate is used.
+func (files *KeyPairFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if err := files.reload(); err != nil {
+		klog.Warningf("Using previous certificate: %v", err)
+	}
+	return files.certificate, nil
+}
+
+// reload loads the certificate when the files were modified since they were last loaded.
+func (files *KeyPairFiles) reload() error {
+	modTime, err := files.latestModTime()
+	if err != nil {
+		return err
+	}
+	if modTime.Equal(files.modTime) {
+		return nil
+	}
+	certificate, err := tls.LoadX509KeyPair(files.crtFile, files.keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load certificate from %s and %s: %v", files.crtFile, files.keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	certificate.Leaf = leaf
+	klog.Infof("Loaded certificate from %s valid until %v", files.crtFile, leaf.NotAfter)
+	metrics.CertificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	files.modTime = modTime
+	files.certificate = &certificate
+	return nil
+}
+
+func (files *KeyPairFiles) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{files.crtFile, files.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Could not read certificate file: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
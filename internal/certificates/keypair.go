@@ -0,0 +1,147 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// keyPair is a certificate together with its private key in PEM format.
+type keyPair struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newKeyPair(template *x509.Certificate, issuer *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate key: %v", err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate serial number: %v", err)
+	}
+	template.SerialNumber = serialNumber
+
+	parent := template
+	var signer any = key
+	if issuer != nil {
+		parent = issuer.cert
+		issuerKey, err := tls.X509KeyPair(issuer.certPEM, issuer.keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid issuer key pair: %v", err)
+		}
+		signer = issuerKey.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal key: %v", err)
+	}
+	return &keyPair{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// newCA creates a self-signed certificate authority.
+func newCA(commonName string, now time.Time, validity time.Duration) (*keyPair, error) {
+	return newKeyPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-CLOCK_SKEW),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+}
+
+// newServingCert creates a serving certificate for the DNS names, signed by the CA.
+func newServingCert(ca *keyPair, dnsNames []string, now time.Time, validity time.Duration) (*keyPair, error) {
+	return newKeyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-CLOCK_SKEW),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+// parseKeyPair parses a certificate and its key, returning nil when either is missing
+// or invalid.
+func parseKeyPair(certPEM []byte, keyPEM []byte) *keyPair {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil
+	}
+	certs := parseCertificates(certPEM)
+	if len(certs) == 0 {
+		return nil
+	}
+	return &keyPair{
+		cert:    certs[0],
+		certPEM: certPEM,
+		keyPEM:  keyPEM,
+	}
+}
+
+// parseCertificates parses all certificates in PEM format, ignoring invalid ones.
+func parseCertificates(data []byte) []*x509.Certificate {
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	data := make([]byte, 0)
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return data
+}
+
+// needsRenewal returns true when less than a third of the validity of the certificate
+// remains.
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotAfter.Add(-validity / 3))
+}
+
+// coversDNSNames returns true when the certificate is valid for all DNS names.
+func coversDNSNames(cert *x509.Certificate, dnsNames []string) bool {
+	for _, dnsName := range dnsNames {
+		if !slices.Contains(cert.DNSNames, dnsName) {
+			return false
+		}
+	}
+	return true
+}
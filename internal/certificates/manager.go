@@ -0,0 +1,332 @@
+package certificates
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
+)
+
+const (
+	// Certificates are backdated to allow for clock skew between the server and clients.
+	CLOCK_SKEW = 5 * time.Minute
+	// Validity of the certificate authority. It is rotated like the serving certificate
+	// when less than a third of its validity remains.
+	CA_VALIDITY = 10 * 365 * 24 * time.Hour
+	// Interval for retrying after certificate management failed.
+	RETRY_INTERVAL = 10 * time.Second
+
+	// Keys in the secret in addition to the standard tls.crt and tls.key. The CA
+	// certificate can contain multiple certificates, the first is the current CA.
+	CA_CERT_KEY = "ca.crt"
+	CA_KEY_KEY  = "ca.key"
+)
+
+// Manager manages the certificate authority and serving certificate of the webhooks.
+// Both are stored in a secret that is shared by all replicas, and renewed when less than
+// a third of their validity remains. The CA bundle of the webhook configurations is kept
+// up to date. When the CA is renewed, the previous CA remains in the bundle until it
+// expires, so that serving certificates signed by it remain trusted.
+type Manager struct {
+	clientset                kubernetes.Interface
+	namespace                string
+	secretName               string
+	dnsNames                 []string
+	validity                 time.Duration
+	mutatingWebhookConfigs   []string
+	validatingWebhookConfigs []string
+
+	now         func() time.Time
+	certificate atomic.Pointer[tls.Certificate]
+	// CA certificates that were last written to the CA bundles of the webhook configurations.
+	trustedCAs []*x509.Certificate
+	// closed when the CA bundles of the webhook configurations were first updated.
+	trustedOnce sync.Once
+	trustedCh   chan struct{}
+}
+
+func NewManager(clientset kubernetes.Interface, namespace string, config config.Config) *Manager {
+	service := config.ServiceName
+	return &Manager{
+		clientset:  clientset,
+		namespace:  namespace,
+		secretName: config.CertificateSecret,
+		dnsNames: []string{
+			service + "." + namespace + ".svc",
+			service + "." + namespace,
+			service,
+		},
+		validity:                 config.CertificateValidity,
+		mutatingWebhookConfigs:   config.MutatingWebhookConfigs,
+		validatingWebhookConfigs: config.ValidatingWebhookConfigs,
+		now:                      time.Now,
+		trustedCh:                make(chan struct{}),
+	}
+}
+
+// GetCertificate returns the current serving certificate, for use in tls.Config.
+func (manager *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate := manager.certificate.Load()
+	if certificate == nil {
+		return nil, fmt.Errorf("No serving certificate available yet")
+	}
+	return certificate, nil
+}
+
+// Start blocks until a serving certificate is available, or the context is canceled.
+func (manager *Manager) Start(ctx context.Context) error {
+	for {
+		err := manager.Reconcile(ctx)
+		if manager.certificate.Load() != nil {
+			if err != nil {
+				klog.Errorf("Certificate management failed: %v", err)
+			}
+			return nil
+		}
+		klog.Errorf("Could not obtain serving certificate, retrying in %v: %v", RETRY_INTERVAL, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RETRY_INTERVAL):
+		}
+	}
+}
+
+// Trusted is closed once the CA bundles of all webhook configurations were updated, so
+// that the webhooks trust the serving certificate. Before that, a webhook configuration
+// can be missing or have an empty CA bundle, for instance on the first install of the
+// chart, and the server should not be reported ready.
+func (manager *Manager) Trusted() <-chan struct{} {
+	return manager.trustedCh
+}
+
+// Run reconciles every interval until the context is canceled. Other replicas can renew
+// the certificates as well, so that reconciliation also picks up their changes.
+func (manager *Manager) Run(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		next := interval
+		if err := manager.Reconcile(ctx); err != nil {
+			klog.Errorf("Certificate management failed, retrying in %v: %v", RETRY_INTERVAL, err)
+			next = min(interval, RETRY_INTERVAL)
+		}
+		timer.Reset(next)
+	}
+}
+
+// Reconcile renews the certificates when needed, updates the CA bundles of the webhook
+// configurations, and loads the serving certificate.
+func (manager *Manager) Reconcile(ctx context.Context) error {
+	secret, err := manager.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+	// The CA bundle is updated before the serving certificate is used so that a new
+	// serving certificate is always trusted.
+	bundleErr := manager.updateCABundles(ctx, secret.Data[CA_CERT_KEY])
+	if bundleErr == nil {
+		manager.trustedCAs = parseCertificates(secret.Data[CA_CERT_KEY])
+		manager.trustedOnce.Do(func() {
+			close(manager.trustedCh)
+		})
+	}
+	certificate, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("Invalid serving certificate in secret %s/%s: %v",
+			manager.namespace, manager.secretName, err)
+	}
+	if bundleErr != nil && manager.certificate.Load() != nil && !manager.trusted(&certificate) {
+		// The webhooks might not trust the new certificate yet, keep serving the current one
+		// until the CA bundles are updated.
+		return bundleErr
+	}
+	manager.setCertificate(&certificate)
+	return bundleErr
+}
+
+// trusted returns true when the certificate is signed by a CA that is already in the CA
+// bundles of the webhook configurations.
+func (manager *Manager) trusted(certificate *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(manager.trustedCAs, func(ca *x509.Certificate) bool {
+		return leaf.CheckSignatureFrom(ca) == nil
+	})
+}
+
+func (manager *Manager) setCertificate(certificate *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return
+	}
+	certificate.Leaf = leaf
+	previous := manager.certificate.Swap(certificate)
+	if previous == nil || !previous.Leaf.Equal(leaf) {
+		klog.Infof("Using serving certificate for %v valid until %v", leaf.DNSNames, leaf.NotAfter)
+		metrics.CertificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	}
+}
+
+// ensureSecret returns the secret with valid certificates, renewing them when needed.
+// When another replica changes the secret concurrently, the update fails and is retried
+// at the next reconciliation.
+func (manager *Manager) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	secrets := manager.clientset.CoreV1().Secrets(manager.namespace)
+	secret, err := secrets.Get(ctx, manager.secretName, metav1.GetOptions{})
+	exists := true
+	if errors.IsNotFound(err) {
+		exists = false
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      manager.secretName,
+				Namespace: manager.namespace,
+			},
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not get secret %s/%s: %v", manager.namespace, manager.secretName, err)
+	}
+
+	data, changed, err := manager.renew(secret.Data)
+	if err != nil || !changed {
+		return secret, err
+	}
+	secret = secret.DeepCopy()
+	secret.Data = data
+	if exists {
+		secret, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	} else {
+		secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not store certificates in secret %s/%s: %v",
+			manager.namespace, manager.secretName, err)
+	}
+	metrics.CertificateRenewals.Inc()
+	return secret, nil
+}
+
+// renew returns the secret data with a valid CA and serving certificate.
+func (manager *Manager) renew(data map[string][]byte) (map[string][]byte, bool, error) {
+	now := manager.now()
+	changed := false
+	bundle := parseCertificates(data[CA_CERT_KEY])
+	ca := parseKeyPair(data[CA_CERT_KEY], data[CA_KEY_KEY])
+	if ca == nil || needsRenewal(ca.cert, now) {
+		newca, err := newCA(manager.dnsNames[0]+"-ca", now, CA_VALIDITY)
+		if err != nil {
+			return nil, false, err
+		}
+		klog.Infof("Created certificate authority valid until %v", newca.cert.NotAfter)
+		ca = newca
+		bundle = append([]*x509.Certificate{ca.cert}, bundle...)
+		changed = true
+	}
+	bundle = slices.DeleteFunc(bundle, func(cert *x509.Certificate) bool {
+		return now.After(cert.NotAfter)
+	})
+
+	serving := parseKeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if serving == nil || needsRenewal(serving.cert, now) ||
+		!coversDNSNames(serving.cert, manager.dnsNames) ||
+		serving.cert.CheckSignatureFrom(ca.cert) != nil {
+		newserving, err := newServingCert(ca, manager.dnsNames, now, manager.validity)
+		if err != nil {
+			return nil, false, err
+		}
+		klog.Infof("Created serving certificate valid until %v", newserving.cert.NotAfter)
+		serving = newserving
+		changed = true
+	}
+
+	caBundle := encodeCertificates(bundle)
+	if !bytes.Equal(caBundle, data[CA_CERT_KEY]) {
+		changed = true
+	}
+	return map[string][]byte{
+		CA_CERT_KEY:             caBundle,
+		CA_KEY_KEY:              ca.keyPEM,
+		corev1.TLSCertKey:       serving.certPEM,
+		corev1.TLSPrivateKeyKey: serving.keyPEM,
+	}, changed, nil
+}
+
+// updateCABundles sets the CA bundle of all webhooks in the webhook configurations.
+func (manager *Manager) updateCABundles(ctx context.Context, caBundle []byte) error {
+	mutatingConfigs := manager.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	for _, name := range manager.mutatingWebhookConfigs {
+		webhookConfig, err := mutatingConfigs.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("The mutating webhook configuration %s does not exist yet", name)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not get mutating webhook configuration %s: %v", name, err)
+		}
+		clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, 0)
+		for i := range webhookConfig.Webhooks {
+			clientConfigs = append(clientConfigs, &webhookConfig.Webhooks[i].ClientConfig)
+		}
+		if !setCABundle(clientConfigs, caBundle) {
+			continue
+		}
+		if _, err := mutatingConfigs.Update(ctx, webhookConfig, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("Could not update mutating webhook configuration %s: %v", name, err)
+		}
+		klog.Infof("Updated CA bundle of mutating webhook configuration %s", name)
+	}
+
+	validatingConfigs := manager.clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	for _, name := range manager.validatingWebhookConfigs {
+		webhookConfig, err := validatingConfigs.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("The validating webhook configuration %s does not exist yet", name)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not get validating webhook configuration %s: %v", name, err)
+		}
+		clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, 0)
+		for i := range webhookConfig.Webhooks {
+			clientConfigs = append(clientConfigs, &webhookConfig.Webhooks[i].ClientConfig)
+		}
+		if !setCABundle(clientConfigs, caBundle) {
+			continue
+		}
+		if _, err := validatingConfigs.Update(ctx, webhookConfig, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("Could not update validating webhook configuration %s: %v", name, err)
+		}
+		klog.Infof("Updated CA bundle of validating webhook configuration %s", name)
+	}
+	return nil
+}
+
+// setCABundle sets the CA bundle, returning true when it was changed.
+func setCABundle(clientConfigs []*admissionregistrationv1.WebhookClientConfig, caBundle []byte) bool {
+	changed := false
+	for _, clientConfig := range clientConfigs {
+		if !bytes.Equal(clientConfig.CABundle, caBundle) {
+			clientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,306 @@
+package certificates
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wamblee.org/kubedock/dns/internal/config"
+)
+
+const (
+	NAMESPACE = "kubedock"
+	SECRET    = "webhook-cert"
+	MUTATING  = "kubedock-dns-mutator-config"
+	VALIDATOR = "kubedock-dns-workload-validator-config"
+	VALIDITY  = 90 * 24 * time.Hour
+)
+
+type ManagerTestSuite struct {
+	suite.Suite
+
+	ctx       context.Context
+	clientset *fake.Clientset
+	now       time.Time
+	manager   *Manager
+}
+
+func (s *ManagerTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.clientset = fake.NewClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: MUTATING},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{
+				{Name: "dns-mutator.kubedock.org"},
+			},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: VALIDATOR},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{Name: "dns-workload-validator.kubedock.org"},
+			},
+		})
+	s.now = time.Now()
+	s.manager = s.newManager()
+}
+
+func TestManagerTestSuite(t *testing.T) {
+	suite.Run(t, &ManagerTestSuite{})
+}
+
+func (s *ManagerTestSuite) newManager() *Manager {
+	manager := NewManager(s.clientset, NAMESPACE, config.Config{
+		ServiceName:              "kubedock-dns-server",
+		CertificateSecret:        SECRET,
+		CertificateValidity:      VALIDITY,
+		MutatingWebhookConfigs:   []string{MUTATING},
+		ValidatingWebhookConfigs: []string{VALIDATOR},
+	})
+	manager.now = func() time.Time {
+		return s.now
+	}
+	return manager
+}
+
+func (s *ManagerTestSuite) secret() *corev1.Secret {
+	secret, err := s.clientset.CoreV1().Secrets(NAMESPACE).Get(s.ctx, SECRET, metav1.GetOptions{})
+	s.Require().Nil(err)
+	return secret
+}
+
+func (s *ManagerTestSuite) certificate() *x509.Certificate {
+	certificate, err := s.manager.GetCertificate(nil)
+	s.Require().Nil(err)
+	return certificate.Leaf
+}
+
+// caBundles returns the CA bundles of all webhooks.
+func (s *ManagerTestSuite) caBundles() [][]byte {
+	mutating, err := s.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(
+		s.ctx, MUTATING, metav1.GetOptions{})
+	s.Require().Nil(err)
+	validating, err := s.clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(
+		s.ctx, VALIDATOR, metav1.GetOptions{})
+	s.Require().Nil(err)
+	return [][]byte{mutating.Webhooks[0].ClientConfig.CABundle, validating.Webhooks[0].ClientConfig.CABundle}
+}
+
+// assertTrusted verifies the serving certificate using the CA bundle of the webhooks.
+func (s *ManagerTestSuite) assertTrusted() {
+	for _, caBundle := range s.caBundles() {
+		roots := x509.NewCertPool()
+		s.True(roots.AppendCertsFromPEM(caBundle))
+		_, err := s.certificate().Verify(x509.VerifyOptions{
+			DNSName:     "kubedock-dns-server.kubedock.svc",
+			Roots:       roots,
+			CurrentTime: s.now,
+		})
+		s.Nil(err)
+	}
+}
+
+func (s *ManagerTestSuite) Test_NoCertificateBeforeStart() {
+	_, err := s.manager.GetCertificate(nil)
+	s.NotNil(err)
+}
+
+func (s *ManagerTestSuite) Test_CertificatesCreated() {
+	s.Require().Nil(s.manager.Start(s.ctx))
+	secret := s.secret()
+	for _, key := range []string{CA_CERT_KEY, CA_KEY_KEY, corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+		s.NotEmpty(secret.Data[key], key)
+	}
+	s.Equal([]string{"kubedock-dns-server.kubedock.svc", "kubedock-dns-server.kubedock", "kubedock-dns-server"},
+		s.certificate().DNSNames)
+	s.Equal(secret.Data[CA_CERT_KEY], s.caBundles()[0])
+	s.assertTrusted()
+}
+
+func (s *ManagerTestSuite) Test_SecretIsSharedBetweenReplicas() {
+	s.Require().Nil(s.manager.Start(s.ctx))
+	resourceVersion := s.secret().ResourceVersion
+
+	replica := s.newManager()
+	s.Require().Nil(replica.Start(s.ctx))
+	s.Equal(resourceVersion, s.secret().ResourceVersion)
+	certificate, err := replica.GetCertificate(nil)
+	s.Require().Nil(err)
+	s.True(s.certificate().Equal(certificate.Leaf))
+}
+
+func (s *ManagerTestSuite) Test_ServingCertificateRenewed() {
+	s.Require().Nil(s.manager.Start(s.ctx))
+	initial := s.certificate()
+	caBundle := s.secret().Data[CA_CERT_KEY]
+
+	// more than a third of the validity remains
+	s.now = s.now.Add(VALIDITY / 2)
+	s.Require().Nil(s.manager.Reconcile(s.ctx))
+	s.True(initial.Equal(s.certificate()))
+
+	s.now = s.now.Add(VALIDITY / 4)
+	s.Require().Nil(s.manager.Reconcile(s.ctx))
+	s.False(initial.Equal(s.certificate()))
+	s.True(s.certificate().NotAfter.After(s.now.Add(VALIDITY / 2)))
+	s.Equal(caBundle, s.secret().Data[CA_CERT_KEY])
+	s.assertTrusted()
+}
+
+func (s *ManagerTestSuite) Test_CARenewedAndPreviousCAKept() {
+	s.Require().Nil(s.manager.Start(s.ctx))
+	previousCA := parseCertificates(s.secret().Data[CA_CERT_KEY])
+	s.Require().Equal(1, len(previousCA))
+
+	s.now = s.now.Add(CA_VALIDITY * 3 / 4)
+	s.Require().Nil(s.manager.Reconcile(s.ctx))
+	bundle := parseCertificates(s.secret().Data[CA_CERT_KEY])
+	s.Require().Equal(2, len(bundle))
+	s.True(bundle[1].Equal(previousCA[0]))
+	s.Nil(s.certificate().CheckSignatureFrom(bundle[0]))
+	s.assertTrusted()
+
+	// expired CAs are removed
+	s.now = s.now.Add(CA_VALIDITY / 2)
+	s.Require().Nil(s.manager.Reconcile(s.ctx))
+	bundle = parseCertificates(s.secret().Data[CA_CERT_KEY])
+	s.Equal(1, len(bundle))
+	s.assertTrusted()
+}
+
+func (s *ManagerTestSuite) Test_CertificateKeptWhenCABundleUpdateFails() {
+	s.Require().Nil(s.manager.Start(s.ctx))
+	initial := s.certificate()
+
+	failing := true
+	s.clientset.PrependReactor("update", "mutatingwebhookconfigurations",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return failing, nil, fmt.Errorf("update failed")
+		})
+	s.now = s.now.Add(CA_VALIDITY * 3 / 4)
+	s.NotNil(s.manager.Reconcile(s.ctx))
+	s.Equal(2, len(parseCertificates(s.secret().Data[CA_CERT_KEY])))
+	s.True(initial.Equal(s.certificate()))
+
+	// the new certificate is used once the CA bundles are updated
+	failing = false
+	s.Require().Nil(s.manager.Reconcile(s.ctx))
+	s.False(initial.Equal(s.certificate()))
+	s.assertTrusted()
+}
+
+func (s *ManagerTestSuite) Test_RenewedCertificateUsedWhenCAIsTrusted() {
+	s.Require().Nil(s.manager.Start(s.ctx))
+	initial := s.certificate()
+
+	s.Require().Nil(s.clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(
+		s.ctx, VALIDATOR, metav1.DeleteOptions{}))
+	s.now = s.now.Add(VALIDITY * 3 / 4)
+	s.NotNil(s.manager.Reconcile(s.ctx))
+	s.False(initial.Equal(s.certificate()))
+}
+
+func (s *ManagerTestSuite) Test_SecretWithoutCAKeyIsReplaced() {
+	// secret as generated by helm, without the key of the CA.
+	ca, err := newCA("helm", s.now, CA_VALIDITY)
+	s.Require().Nil(err)
+	serving, err := newServingCert(ca, []string{"kubedock-dns-server.kubedock.svc"}, s.now, VALIDITY)
+	s.Require().Nil(err)
+	_, err = s.clientset.CoreV1().Secrets(NAMESPACE).Create(s.ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: SECRET, Namespace: NAMESPACE},
+		Data: map[string][]byte{
+			CA_CERT_KEY:             ca.certPEM,
+			corev1.TLSCertKey:       serving.certPEM,
+			corev1.TLSPrivateKeyKey: serving.keyPEM,
+		},
+	}, metav1.CreateOptions{})
+	s.Require().Nil(err)
+
+	s.Require().Nil(s.manager.Start(s.ctx))
+	s.NotEmpty(s.secret().Data[CA_KEY_KEY])
+	s.Equal(2, len(parseCertificates(s.secret().Data[CA_CERT_KEY])))
+	s.assertTrusted()
+}
+
+func (s *ManagerTestSuite) Test_MissingWebhookConfiguration() {
+	s.Require().Nil(s.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(
+		s.ctx, MUTATING, metav1.DeleteOptions{}))
+	// the certificate can still be served
+	s.Require().Nil(s.manager.Start(s.ctx))
+	s.NotNil(s.manager.Reconcile(s.ctx))
+	s.certificate()
+	s.assertNotTrusted()
+
+	// the CA bundle is set once the webhook configuration is created, for instance
+	// by helm after the deployment.
+	_, err := s.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(s.ctx,
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: MUTATING},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{
+				{Name: "dns-mutator.kubedock.org"},
+			},
+		}, metav1.CreateOptions{})
+	s.Require().Nil(err)
+	s.Nil(s.manager.Reconcile(s.ctx))
+	s.assertTrusted()
+	select {
+	case <-s.manager.Trusted():
+	default:
+		s.Fail("CA bundles were updated but not reported")
+	}
+}
+
+func (s *ManagerTestSuite) assertNotTrusted() {
+	select {
+	case <-s.manager.Trusted():
+		s.Fail("CA bundles reported as updated")
+	default:
+	}
+}
+
+func (s *ManagerTestSuite) Test_KeyPairFilesReloaded() {
+	dir := s.T().TempDir()
+	crtFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	write := func(modTime time.Time) *x509.Certificate {
+		ca, err := newCA("test", s.now, CA_VALIDITY)
+		s.Require().Nil(err)
+		serving, err := newServingCert(ca, []string{"kubedock-dns-server.kubedock.svc"}, s.now, VALIDITY)
+		s.Require().Nil(err)
+		s.Require().Nil(os.WriteFile(crtFile, serving.certPEM, 0600))
+		s.Require().Nil(os.WriteFile(keyFile, serving.keyPEM, 0600))
+		s.Require().Nil(os.Chtimes(crtFile, modTime, modTime))
+		s.Require().Nil(os.Chtimes(keyFile, modTime, modTime))
+		return serving.cert
+	}
+	getCertificate := func(files *KeyPairFiles) *tls.Certificate {
+		certificate, err := files.GetCertificate(nil)
+		s.Require().Nil(err)
+		return certificate
+	}
+
+	_, err := NewKeyPairFiles(crtFile, keyFile)
+	s.NotNil(err)
+
+	initial := write(s.now)
+	files, err := NewKeyPairFiles(crtFile, keyFile)
+	s.Require().Nil(err)
+	s.True(initial.Equal(getCertificate(files).Leaf))
+
+	renewed := write(s.now.Add(time.Minute))
+	s.True(renewed.Equal(getCertificate(files).Leaf))
+
+	// invalid files, the previous certificate is used.
+	s.Require().Nil(os.WriteFile(crtFile, []byte("invalid"), 0600))
+	s.True(renewed.Equal(getCertificate(files).Leaf))
+}
@@ -1,20 +1,74 @@
 package config
 
-import "time"
+import (
+	"time"
+	"wamblee.org/kubedock/dns/internal/networkdefinition"
+)
 
 type PodConfig struct {
 	HostAliasPrefix string
 	NetworkIdPrefix string
 	LabelName       string
+	// Annotation with the time after which the networks of a pod may be cleaned up.
+	ExpiresAnnotation string
+	// Annotation with the networks of a pod that are internal.
+	InternalNetworksAnnotation string
+
+	// Networks that are shared between namespaces, mapped to the namespaces that may
+	// join them. No namespaces means that all watched namespaces may join. Pods join
+	// them using a 'global:' prefix for the network id.
+	GlobalNetworks map[string][]string
+	// Allow pods to create global networks that are not in GlobalNetworks by using the
+	// 'global:' prefix. These may be joined by all watched namespaces.
+	UndeclaredGlobalNetworks bool
+
+	// Networks defined by label selectors. Pods matching these do not need the label
+	// and annotations. Nil when network definitions are not used.
+	NetworkDefinitions *networkdefinition.Definitions
+
+	// The hostname of a pod is set to its primary host alias, which is the host alias
+	// annotated as primary, or otherwise the first host alias. Optionally, the hostname is
+	// set as the fully qualified domain name.
+	SetHostname    bool
+	HostnameAsFQDN bool
+
+	// Kinds of admission warnings that lead to rejection of a pod instead.
+	RejectedWarnings []string
+
+	// Policy for host aliases that have the same name as a service, one of the
+	// SHADOW_POLICY_* constants of the model.
+	ShadowPolicy string
+
+	// Limits that are enforced at admission.
+	Quotas Quotas
+}
+
+// Quotas limit the size of networks so that a single runaway test cannot slow down DNS
+// updates for everyone. Zero means unlimited.
+type Quotas struct {
+	PodsPerNetwork       int
+	NetworksPerNamespace int
+	HostAliasesPerPod    int
+	NetworksPerPod       int
 }
 
 type Config struct {
-	ServiceName     string
-	PodConfig       PodConfig
-	CrtFile         string
-	KeyFile         string
+	ServiceName string
+	PodConfig   PodConfig
+	CrtFile     string
+	KeyFile     string
+	// File with the bearer token of the registration API. Empty disables the API.
+	ApiTokenFile    string
 	InternalDomains []string
 
+	// Namespaces in which pods are watched, either a list or a label selector. When both are
+	// empty, only the namespace of the DNS server is watched. Networks are always isolated
+	// per namespace.
+	Namespaces        []string
+	NamespaceSelector string
+	// Services that are annotated with host aliases and networks become network members.
+	WatchServices bool
+
 	// Time that instrumented pods will wait until a record becomes available.
 	// This is required since a container may do a DNS lookup so quickly after
 	// startup that it is not yet known with the DNS server.
@@ -22,4 +76,35 @@ type Config struct {
 
 	// Number of retries that pods should do before failing a DNS lookup.
 	DnsRetries int
+	// Maximum time to wait for in-flight DNS queries and admission requests
+	// to complete on shutdown.
+	ShutdownTimeout time.Duration
+	// Pod changes are batched into a single DNS update. The update is done when there
+	// were no changes for the quiet period, or at the latest after the max delay.
+	DnsUpdateQuietPeriod time.Duration
+	DnsUpdateMaxDelay    time.Duration
+	// Certificates of the webhooks are managed by the server instead of being read from
+	// CrtFile and KeyFile. These are stored in a secret and renewed when less than a third
+	// of their validity remains. The CA bundles of the webhook configurations are updated.
+	ManageCertificates       bool
+	CertificateSecret        string
+	CertificateValidity      time.Duration
+	CertificateCheckInterval time.Duration
+	MutatingWebhookConfigs   []string
+	ValidatingWebhookConfigs []string
+	// Interval at which the pod administration is compared with the cluster.
+	// Zero disables reconciliation.
+	ReconcileInterval time.Duration
+	// Changes in network membership and host alias conflicts are reported as events on
+	// the pods.
+	Events bool
+	// Pods are annotated with the host aliases that they can resolve in their networks.
+	AnnotateNetworkView bool
+	// Pods of networks that were idle for the network TTL, or of which the annotated expiry
+	// passed, are deleted at the janitor interval. A zero TTL only uses the annotations. In
+	// dry-run mode, pods are only reported.
+	Janitor         bool
+	NetworkTTL      time.Duration
+	JanitorDryRun   bool
+	JanitorInterval time.Duration
 }
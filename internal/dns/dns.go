@@ -1,6 +1,8 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"k8s.io/klog/v2"
 	"net"
@@ -38,6 +40,20 @@ func (dnsServer *ExternalDNSServer) Resolve(r *dns.Msg) *dns.Msg {
 	return resp
 }
 
+// errExternalName is returned for external names queried by pods that are only members of
+// internal networks. These are not resolved upstream but answered with NXDOMAIN.
+var errExternalName = errors.New("External name queried from internal networks only")
+
+// rcodeError is a final answer without records, such as for a service that shadows a host
+// alias but could not be resolved upstream. It is not retried.
+type rcodeError struct {
+	rcode int
+}
+
+func (err rcodeError) Error() string {
+	return fmt.Sprintf("Answered with %s", dns.RcodeToString[err.rcode])
+}
+
 type KubeDockDns struct {
 	mutex             sync.RWMutex
 	networks          *model.Networks
@@ -51,6 +67,21 @@ type KubeDockDns struct {
 	internalDomains []string
 
 	overrideSourceIP model.IPAddress
+	// called with the source IP of every query, nil when not used.
+	queried func(sourceIp model.IPAddress)
+	// Policy for host aliases that have the same name as a service. Services are only
+	// looked up when serviceExists is not nil.
+	shadowPolicy  string
+	serviceExists func(namespace string, name string) bool
+
+	packetConn net.PacketConn
+	listener   net.Listener
+
+	// closed when both the UDP and TCP servers have started.
+	started chan struct{}
+	// closed when the server is shutting down so that pending lookups stop waiting
+	// for pods to become known.
+	stopping chan struct{}
 }
 
 func NewKubeDockDns(upstreamDnsServer DNSServer, port string, searchDomains string,
@@ -63,6 +94,8 @@ func NewKubeDockDns(upstreamDnsServer DNSServer, port string, searchDomains stri
 		// final search suffix is the empty string for the case when we get
 		searchDomain:    searchDomains,
 		internalDomains: internalDomains,
+		started:         make(chan struct{}),
+		stopping:        make(chan struct{}),
 	}
 	return &server
 }
@@ -71,6 +104,21 @@ func (dnsServer *KubeDockDns) OverrideSourceIP(sourceIP model.IPAddress) {
 	dnsServer.overrideSourceIP = sourceIP
 }
 
+// OnQuery sets a function that is called with the source IP of every query. It must be
+// set before serving.
+func (dnsServer *KubeDockDns) OnQuery(queried func(sourceIp model.IPAddress)) {
+	dnsServer.queried = queried
+}
+
+// SetShadowPolicy sets the policy for host aliases that have the same name as a service,
+// together with a function that returns whether a service exists. It must be set before
+// serving.
+func (dnsServer *KubeDockDns) SetShadowPolicy(policy string,
+	serviceExists func(namespace string, name string) bool) {
+	dnsServer.shadowPolicy = policy
+	dnsServer.serviceExists = serviceExists
+}
+
 func (dnsServer *KubeDockDns) SetNetworks(networks *model.Networks) {
 	dnsServer.mutex.Lock()
 	defer dnsServer.mutex.Unlock()
@@ -78,20 +126,118 @@ func (dnsServer *KubeDockDns) SetNetworks(networks *model.Networks) {
 	dnsServer.networks = networks
 }
 
-func (dnsServer *KubeDockDns) Serve() {
-	dns.HandleFunc(".", dnsServer.handleDNSRequest)
-	server := &dns.Server{Addr: dnsServer.port, Net: "udp"}
-	klog.Infof("Starting DNS server on %s\n", server.Addr)
-	err := server.ListenAndServe()
+// Networks returns the networks that are currently used to answer queries.
+func (dnsServer *KubeDockDns) Networks() *model.Networks {
+	dnsServer.mutex.RLock()
+	defer dnsServer.mutex.RUnlock()
+
+	return dnsServer.networks
+}
+
+// Listen binds the UDP and TCP sockets of the DNS server. This is separate from Serve so that
+// the actual address is known before serving starts, which allows port 0 to be used.
+func (dnsServer *KubeDockDns) Listen() error {
+	packetConn, err := net.ListenPacket("udp", dnsServer.port)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s: %v", dnsServer.port, err)
+	}
+	// use the same port for TCP, which matters when port 0 is used.
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
 	if err != nil {
-		klog.Fatalf("Failed to start server: %s\n ", err.Error())
+		packetConn.Close()
+		return fmt.Errorf("Failed to listen on %s/tcp: %v", packetConn.LocalAddr(), err)
+	}
+	dnsServer.packetConn = packetConn
+	dnsServer.listener = listener
+	return nil
+}
+
+// Addr returns the address the DNS server is listening on. Only valid after Listen.
+func (dnsServer *KubeDockDns) Addr() string {
+	return dnsServer.packetConn.LocalAddr().String()
+}
+
+// Started returns a channel that is closed when the server is serving both UDP and TCP.
+func (dnsServer *KubeDockDns) Started() <-chan struct{} {
+	return dnsServer.started
+}
+
+// Serve serves DNS requests until the context is canceled. Listen must be called first.
+// On cancellation, no new requests are accepted and in-flight requests are given at most
+// shutdownTimeout to complete.
+func (dnsServer *KubeDockDns) Serve(ctx context.Context, shutdownTimeout time.Duration) error {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", dnsServer.handleDNSRequest)
+	servers := []*dns.Server{
+		{PacketConn: dnsServer.packetConn, Handler: mux},
+		{Listener: dnsServer.listener, Handler: mux},
+	}
+
+	go func() {
+		<-ctx.Done()
+		klog.Info("Stopping DNS server")
+		close(dnsServer.stopping)
+	}()
+	var started sync.WaitGroup
+	started.Add(len(servers))
+	go func() {
+		started.Wait()
+		close(dnsServer.started)
+	}()
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() {
+			started.Done()
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				if err := server.ShutdownContext(shutdownCtx); err != nil {
+					klog.Warningf("DNS server did not stop cleanly: %v", err)
+				}
+			}()
+		}
+		go func() {
+			errs <- server.ActivateAndServe()
+		}()
+	}
+	klog.Infof("Starting DNS server on %s\n", dnsServer.Addr())
+
+	var err error
+	for range servers {
+		if serverErr := <-errs; serverErr != nil && err == nil {
+			err = serverErr
+		}
+	}
+	klog.Info("DNS server stopped")
+	return err
+}
+
+// searchDomains returns the search domains of the pod with the given IP. Pods in other
+// namespaces than that of the DNS server use the search domain of their own namespace.
+func (dnsServer *KubeDockDns) searchDomains(networks *model.Networks, sourceIp model.IPAddress) []string {
+	searchDomains := []string{dnsServer.searchDomain}
+	namespace := networks.PodNamespace(sourceIp)
+	_, clusterDomain, found := strings.Cut(dnsServer.searchDomain, ".")
+	if namespace != "" && found {
+		searchDomains = append(searchDomains, namespace+"."+clusterDomain)
+	}
+	return searchDomains
+}
+
+func stripSearchDomain(host string, searchDomains []string) string {
+	for _, searchDomain := range searchDomains {
+		if stripped, found := strings.CutSuffix(host, "."+searchDomain); found {
+			return stripped
+		}
 	}
-	defer server.Shutdown()
+	return host
 }
 
-func (dnsServer *KubeDockDns) isInternal(host string) bool {
+func (dnsServer *KubeDockDns) isInternal(host string, searchDomains []string) bool {
 	host, _ = strings.CutSuffix(host, ".")
-	host, _ = strings.CutSuffix(host, "."+dnsServer.searchDomain)
+	host = stripSearchDomain(host, searchDomains)
 	if !strings.Contains(host, ".") {
 		return true
 	}
@@ -109,6 +255,9 @@ func (dnsServer *KubeDockDns) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg)
 		sourceIp = model.IPAddress(w.RemoteAddr().String())
 		sourceIp = model.IPAddress(strings.Split(string(sourceIp), ":")[0])
 	}
+	if dnsServer.queried != nil {
+		dnsServer.queried(sourceIp)
+	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -122,7 +271,10 @@ func (dnsServer *KubeDockDns) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg)
 	// Simple retry mechanism to wait for some time until the pod is known.
 	// This can occur if a pod does a name lookup so early after it has started
 	// that the IP address is not yet known in the DNS server.
+	// When the server is stopping, we stop waiting and let the client retry with another
+	// replica.
 	tend := time.Now().Add(20 * time.Second)
+retry:
 	for time.Now().Before(tend) {
 		answer, err := dnsServer.answerQuestionWithNetworkSnapshot(question, sourceIp, fallback)
 		if err == nil {
@@ -130,7 +282,24 @@ func (dnsServer *KubeDockDns) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg)
 			w.WriteMsg(m)
 			return
 		}
-		time.Sleep(1 * time.Second)
+		if errors.Is(err, errExternalName) {
+			klog.V(2).Infof("dns: %s: %s -> NXDOMAIN, only in internal networks", sourceIp, question[0].Name)
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		var rcodeErr rcodeError
+		if errors.As(err, &rcodeErr) {
+			klog.V(2).Infof("dns: %s: %s -> %s", sourceIp, question[0].Name, dns.RcodeToString[rcodeErr.rcode])
+			m.Rcode = rcodeErr.rcode
+			w.WriteMsg(m)
+			return
+		}
+		select {
+		case <-dnsServer.stopping:
+			break retry
+		case <-time.After(1 * time.Second):
+		}
 		klog.V(2).Infof("Retrying lookup")
 	}
 
@@ -159,9 +328,17 @@ func (dnsServer *KubeDockDns) answerQuestion(questions []dns.Question, networkSn
 		var rrs []dns.RR
 		internal := false
 		if question.Qtype == dns.TypeA {
-			internal = dnsServer.isInternal(question.Name)
+			searchDomains := dnsServer.searchDomains(networkSnapshot, sourceIp)
+			internal = dnsServer.isInternal(question.Name, searchDomains)
 			klog.V(2).Infof("dns: %s: A %s internal %v", sourceIp, question.Name, internal)
-			rrs = resolveHostname(networkSnapshot, question, sourceIp, dnsServer.searchDomain)
+			rrs = resolveHostname(networkSnapshot, question, sourceIp, searchDomains)
+			if len(rrs) > 0 {
+				var err error
+				rrs, err = dnsServer.applyShadowPolicy(networkSnapshot, question, sourceIp, searchDomains, rrs)
+				if err != nil {
+					return nil, err
+				}
+			}
 		} else if question.Qtype == dns.TypePTR {
 			klog.V(2).Infof("dns: %s: PTR %s", sourceIp, question.Name)
 			rrs = resolveIP(networkSnapshot, question, sourceIp)
@@ -175,6 +352,8 @@ func (dnsServer *KubeDockDns) answerQuestion(questions []dns.Question, networkSn
 		// when one question cannot be answered we delegate fully to the upstream server.
 		if internal {
 			return nil, fmt.Errorf("Internal hostname not (yet) found")
+		} else if networkSnapshot.OnlyInternal(sourceIp) {
+			return nil, errExternalName
 		} else {
 			upstreamResponse := fallback()
 			answer = append(answer, upstreamResponse.Answer...)
@@ -184,13 +363,10 @@ func (dnsServer *KubeDockDns) answerQuestion(questions []dns.Question, networkSn
 }
 
 func resolveHostname(networks *model.Networks, question dns.Question, sourceIp model.IPAddress,
-	searchDomain string) []dns.RR {
+	searchDomains []string) []dns.RR {
 	klog.V(3).Infof("dns: %s: A %s", sourceIp, question.Name)
 
-	hostname := question.Name[:len(question.Name)-1]
-	if strings.HasSuffix(hostname, "."+searchDomain) {
-		hostname = hostname[:len(hostname)-len(searchDomain)-1]
-	}
+	hostname := stripSearchDomain(question.Name[:len(question.Name)-1], searchDomains)
 	ips := networks.Lookup(sourceIp, model.Hostname(hostname))
 
 	rrs := make([]dns.RR, 0)
@@ -202,6 +378,59 @@ func resolveHostname(networks *model.Networks, question dns.Question, sourceIp m
 	return rrs
 }
 
+// applyShadowPolicy returns the answer for a hostname that was resolved locally, which
+// is that of the service when the hostname shadows a service and the service wins.
+func (dnsServer *KubeDockDns) applyShadowPolicy(networks *model.Networks, question dns.Question,
+	sourceIp model.IPAddress, searchDomains []string, rrs []dns.RR) ([]dns.RR, error) {
+	if dnsServer.serviceExists == nil {
+		return rrs, nil
+	}
+	hostname := stripSearchDomain(question.Name[:len(question.Name)-1], searchDomains)
+	namespace, service, ok := model.ServiceName(networks.PodNamespace(sourceIp), model.Hostname(hostname))
+	if !ok || !dnsServer.serviceExists(namespace, service) ||
+		networks.ResolvesToService(sourceIp, model.Hostname(hostname), namespace, service) {
+		return rrs, nil
+	}
+	if dnsServer.shadowPolicy != model.SHADOW_POLICY_SERVICE {
+		// with the reject policy, for pods admitted before the service was created.
+		klog.V(2).Infof("dns: %s: A %s shadows service %s/%s, local wins", sourceIp, question.Name,
+			namespace, service)
+		return rrs, nil
+	}
+	klog.V(2).Infof("dns: %s: A %s is shadowed by service %s/%s, service wins", sourceIp, question.Name,
+		namespace, service)
+	return dnsServer.resolveService(question, namespace, service)
+}
+
+// resolveService resolves a service by its fully qualified name using the upstream DNS
+// server. The answer uses the name that was asked for. Without records, the response code
+// of the upstream server is returned as an rcodeError, or NXDOMAIN when it succeeded.
+func (dnsServer *KubeDockDns) resolveService(question dns.Question, namespace string,
+	service string) ([]dns.RR, error) {
+	_, clusterDomain, _ := strings.Cut(dnsServer.searchDomain, ".")
+	name := dns.Fqdn(service + "." + namespace + "." + clusterDomain)
+	request := new(dns.Msg)
+	request.SetQuestion(name, question.Qtype)
+	response := dnsServer.upstreamDnsServer.Resolve(request)
+	rrs := make([]dns.RR, 0)
+	for _, rr := range response.Answer {
+		rr = dns.Copy(rr)
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = question.Name
+		}
+		klog.V(3).Infof("dns: %s -> %s", question.Name, rr)
+		rrs = append(rrs, rr)
+	}
+	if len(rrs) == 0 {
+		rcode := response.Rcode
+		if rcode == dns.RcodeSuccess {
+			rcode = dns.RcodeNameError
+		}
+		return nil, rcodeError{rcode: rcode}
+	}
+	return rrs, nil
+}
+
 func PTRtoIP(ptr string) string {
 	// Remove the .in-addr.arpa. suffix if present
 	ptr = strings.TrimSuffix(ptr, ".in-addr.arpa.")
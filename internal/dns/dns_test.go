@@ -79,6 +79,28 @@ func (s *DNSTestSuite) Test_LookupLocal() {
 
 }
 
+func (s *DNSTestSuite) Test_LookupUsesSearchDomainOfPodNamespace() {
+	pods := model.NewPods()
+	pods.AddOrUpdate(s.newPod(
+		"10.0.0.10", "team-a", "pod-a", []model.Hostname{"db"},
+		[]model.NetworkId{"test"},
+	))
+	pods.AddOrUpdate(s.newPod(
+		"10.0.0.12", "team-a", "pod-b", []model.Hostname{"service"},
+		[]model.NetworkId{"test"},
+	))
+	networks, err := pods.Networks()
+	s.Nil(err)
+
+	dnsServer := NewKubeDockDns(nil, ":1053", "xyz.svc.cluster.local", []string{})
+	dnsServer.networks = networks
+
+	s.verifyLookup("db.team-a.svc.cluster.local.", "10.0.0.12", "10.0.0.10", dnsServer, networks)
+	s.verifyLookup("db.xyz.svc.cluster.local.", "10.0.0.12", "10.0.0.10", dnsServer, networks)
+	// the search domain of another namespace is not stripped.
+	s.verifyLookup("db.team-b.svc.cluster.local.", "10.0.0.12", "100.101.102.103", dnsServer, networks)
+}
+
 func (s *DNSTestSuite) verifyLookup(hostname string, sourceIp string, expectedIp string, dnsServer *KubeDockDns, networks *model.Networks) {
 	questions := []dns.Question{
 		{
@@ -124,3 +146,107 @@ func (s *DNSTestSuite) verifyReverseLookup(ip string, sourceIp string, expectedH
 	s.Equal(1, len(rrs))
 	s.Equal(expectedHost, rrs[0].(*dns.PTR).Ptr)
 }
+
+func (s *DNSTestSuite) Test_ShadowPolicy() {
+	pods := model.NewPods()
+	pods.AddOrUpdate(s.newPod("10.0.0.10", "kubedock", "pod-a", []model.Hostname{"db", "ldap.fixtures"},
+		[]model.NetworkId{"test"}))
+	pods.AddOrUpdate(s.newPod("10.0.0.12", "kubedock", "pod-b", []model.Hostname{"service"},
+		[]model.NetworkId{"test"}))
+	networks, err := pods.Networks()
+	s.Nil(err)
+
+	questions := make([]string, 0)
+	upstream := DnsFunc(func(r *dns.Msg) *dns.Msg {
+		questions = append(questions, r.Question[0].Name)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, createAResponse(r.Question[0].Name, "10.96.0.10"))
+		return m
+	})
+	dnsServer := NewKubeDockDns(upstream, ":1053", "kubedock.svc.cluster.local", []string{})
+	dnsServer.networks = networks
+	services := map[string]bool{"kubedock/db": true, "fixtures/ldap": true}
+	serviceExists := func(namespace string, name string) bool {
+		return services[namespace+"/"+name]
+	}
+
+	dnsServer.SetShadowPolicy(model.SHADOW_POLICY_LOCAL, serviceExists)
+	s.verifyLookup("db.", "10.0.0.12", "10.0.0.10", dnsServer, networks)
+	s.Empty(questions)
+
+	dnsServer.SetShadowPolicy(model.SHADOW_POLICY_SERVICE, serviceExists)
+	s.verifyLookup("db.", "10.0.0.12", "10.96.0.10", dnsServer, networks)
+	s.verifyLookup("db.kubedock.svc.cluster.local.", "10.0.0.12", "10.96.0.10", dnsServer, networks)
+	s.verifyLookup("ldap.fixtures.", "10.0.0.12", "10.96.0.10", dnsServer, networks)
+	// host aliases that do not shadow a service
+	s.verifyLookup("service.", "10.0.0.10", "10.0.0.12", dnsServer, networks)
+	s.Equal([]string{
+		"db.kubedock.svc.cluster.local.",
+		"db.kubedock.svc.cluster.local.",
+		"ldap.fixtures.svc.cluster.local.",
+	}, questions)
+
+	rrs, answerErr := dnsServer.answerQuestion([]dns.Question{{Name: "db.", Qtype: dns.TypeA}}, networks,
+		"10.0.0.12", nil)
+	s.Require().Nil(answerErr)
+	s.Equal("db.", rrs[0].Header().Name)
+}
+
+func (s *DNSTestSuite) Test_ShadowPolicyServiceNotResolved() {
+	pods := model.NewPods()
+	pods.AddOrUpdate(s.newPod("10.0.0.10", "kubedock", "pod-a", []model.Hostname{"db"},
+		[]model.NetworkId{"test"}))
+	networks, err := pods.Networks()
+	s.Nil(err)
+
+	rcode := dns.RcodeSuccess
+	upstream := DnsFunc(func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		return m
+	})
+	dnsServer := NewKubeDockDns(upstream, ":1053", "kubedock.svc.cluster.local", []string{})
+	dnsServer.SetShadowPolicy(model.SHADOW_POLICY_SERVICE, func(namespace string, name string) bool {
+		return true
+	})
+
+	// the service wins, so the local host alias is not used and the lookup is not retried.
+	_, answerErr := dnsServer.answerQuestion([]dns.Question{{Name: "db.", Qtype: dns.TypeA}}, networks,
+		"10.0.0.10", nil)
+	s.Equal(rcodeError{rcode: dns.RcodeNameError}, answerErr)
+
+	rcode = dns.RcodeServerFailure
+	_, answerErr = dnsServer.answerQuestion([]dns.Question{{Name: "db.", Qtype: dns.TypeA}}, networks,
+		"10.0.0.10", nil)
+	s.Equal(rcodeError{rcode: dns.RcodeServerFailure}, answerErr)
+}
+
+func (s *DNSTestSuite) Test_InternalNetworks() {
+	pods := model.NewPods()
+	db := s.newPod("10.0.0.10", "kubedock", "pod-a", []model.Hostname{"db"}, []model.NetworkId{"offline"})
+	db.InternalNetworks = []model.NetworkId{"offline"}
+	pods.AddOrUpdate(db)
+	proxy := s.newPod("10.0.0.12", "kubedock", "pod-b", []model.Hostname{"proxy"},
+		[]model.NetworkId{"offline", "online"})
+	proxy.InternalNetworks = []model.NetworkId{"offline"}
+	pods.AddOrUpdate(proxy)
+	networks, err := pods.Networks()
+	s.Nil(err)
+	dnsServer := NewKubeDockDns(nil, ":1053", "xyz.svc.cluster.local", []string{})
+
+	fallback := func() *dns.Msg {
+		s.Fail("Upstream DNS should not be called")
+		return nil
+	}
+	for _, question := range []dns.Question{
+		{Name: "www.example.com.", Qtype: dns.TypeA},
+		{Name: "4.3.2.1.in-addr.arpa.", Qtype: dns.TypePTR},
+	} {
+		_, answerErr := dnsServer.answerQuestion([]dns.Question{question}, networks, "10.0.0.10", fallback)
+		s.ErrorIs(answerErr, errExternalName)
+	}
+	s.verifyLookup("proxy.", "10.0.0.10", "10.0.0.12", dnsServer, networks)
+	// pods that are also in other networks can resolve external names
+	s.verifyLookup("www.example.com.", "10.0.0.12", "100.101.102.103", dnsServer, networks)
+}
@@ -0,0 +1,144 @@
+package events
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"slices"
+	"strings"
+	"sync"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+const COMPONENT = "kubedock-dns"
+
+// Reasons of the events on pods.
+const (
+	REASON_NETWORK_JOINED      = "NetworkJoined"
+	REASON_DNS_REGISTERED      = "DnsRegistered"
+	REASON_DNS_UNREGISTERED    = "DnsUnregistered"
+	REASON_NETWORK_LEFT        = "NetworkLeft"
+	REASON_HOST_ALIAS_CONFLICT = "HostAliasConflict"
+	REASON_NETWORK_EXPIRED     = "NetworkExpired"
+)
+
+// NewEventRecorder creates a recorder that sends events to the API server until the
+// context is canceled.
+func NewEventRecorder(ctx context.Context, clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartStructuredLogging(3)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(""),
+	})
+	go func() {
+		<-ctx.Done()
+		broadcaster.Shutdown()
+	}()
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: COMPONENT})
+}
+
+// NetworkEvents reports the changes in network membership of pods as events on the pods,
+// so that these are shown by 'kubectl describe pod'.
+type NetworkEvents struct {
+	recorder record.EventRecorder
+
+	mutex    sync.Mutex
+	networks *model.Networks
+}
+
+func NewNetworkEvents(recorder record.EventRecorder) *NetworkEvents {
+	return &NetworkEvents{
+		recorder: recorder,
+	}
+}
+
+// NetworksChanged reports the changes since the previous networks. The first networks
+// are only used as reference, so that a restart of the server does not report all pods
+// again.
+func (events *NetworkEvents) NetworksChanged(networks *model.Networks) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	previous := events.networks
+	events.networks = networks
+	if previous == nil {
+		return
+	}
+	for _, change := range model.DiffNetworks(previous, networks) {
+		// services are no objects to report events on and pods that are not scheduled
+		// yet do not exist.
+		if change.Member == nil || change.Member.IsService() || change.Member.HasUnknownIP() {
+			continue
+		}
+		events.report(change)
+	}
+}
+
+func (events *NetworkEvents) report(change model.NetworkChange) {
+	pod := change.Member
+	ref := PodReference(pod)
+	network := change.Network.Id
+	klog.V(2).Infof("%s/%s: %s in network '%s'", pod.Namespace, pod.Name, change.Type, network)
+	switch change.Type {
+	case model.MEMBER_IP_ASSIGNED:
+		// pods join when they are admitted, but only exist once they are scheduled.
+		events.recorder.Eventf(ref, corev1.EventTypeNormal, REASON_NETWORK_JOINED,
+			"Joined network '%s' with host aliases %s", network, hostAliases(pod))
+	case model.MEMBER_READY:
+		events.recorder.Eventf(ref, corev1.EventTypeNormal, REASON_DNS_REGISTERED,
+			"Host aliases %s resolvable in network '%s'", hostAliases(pod), network)
+	case model.MEMBER_NOT_READY:
+		events.recorder.Eventf(ref, corev1.EventTypeNormal, REASON_DNS_UNREGISTERED,
+			"Host aliases %s no longer resolvable in network '%s' since the pod is not ready",
+			hostAliases(pod), network)
+	case model.MEMBER_LEFT:
+		events.recorder.Eventf(ref, corev1.EventTypeNormal, REASON_NETWORK_LEFT,
+			"Left network '%s'", network)
+	case model.HOSTALIAS_CONFLICT:
+		events.recorder.Eventf(ref, corev1.EventTypeWarning, REASON_HOST_ALIAS_CONFLICT,
+			"Host alias '%s' in network '%s' is also used by %s, lookups return the IPs of all of these",
+			change.HostAlias, network, others(pod, change.Others))
+	}
+}
+
+// PodReference returns the reference of a pod to report events on.
+func PodReference(pod *model.Pod) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  pod.Namespace,
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+}
+
+func hostAliases(pod *model.Pod) string {
+	res := make([]string, 0, len(pod.HostAliases))
+	for _, hostAlias := range pod.HostAliases {
+		res = append(res, string(hostAlias))
+	}
+	return strings.Join(res, ", ")
+}
+
+// others describes the other members, using only the name for pods in the same namespace.
+func others(pod *model.Pod, others []*model.Pod) string {
+	names := make([]string, 0, len(others))
+	for _, other := range others {
+		name := other.Name
+		if other.IsService() {
+			name = other.Service
+		}
+		if other.Namespace != pod.Namespace {
+			name = other.Namespace + "/" + name
+		}
+		if other.IsService() {
+			name = "service " + name
+		}
+		names = append(names, name)
+	}
+	return strings.Join(slices.Compact(names), ", ")
+}
@@ -0,0 +1,110 @@
+package events
+
+import (
+	"github.com/stretchr/testify/suite"
+	"k8s.io/client-go/tools/record"
+	"testing"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+type EventsTestSuite struct {
+	suite.Suite
+
+	pods     *model.Pods
+	recorder *record.FakeRecorder
+	events   *NetworkEvents
+}
+
+func (s *EventsTestSuite) SetupTest() {
+	s.pods = model.NewPods()
+	s.recorder = record.NewFakeRecorder(100)
+	s.events = NewNetworkEvents(s.recorder)
+}
+
+func TestEventsTestSuite(t *testing.T) {
+	suite.Run(t, &EventsTestSuite{})
+}
+
+func (s *EventsTestSuite) addPod(ip string, namespace string, name string, hostAlias string, ready bool,
+	network model.NetworkId) {
+	pod, err := model.NewPod(model.IPAddress(ip), namespace, name, []model.Hostname{model.Hostname(hostAlias)},
+		[]model.NetworkId{network}, ready)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+}
+
+// update reports the current networks and returns the recorded events.
+func (s *EventsTestSuite) update() []string {
+	networks, errors := s.pods.Networks()
+	s.Require().Nil(errors)
+	s.events.NetworksChanged(networks)
+	res := make([]string, 0)
+	for len(s.recorder.Events) > 0 {
+		res = append(res, <-s.recorder.Events)
+	}
+	return res
+}
+
+func (s *EventsTestSuite) Test_InitialNetworksNotReported() {
+	s.addPod("10.0.0.1", "kubedock", "db", "db", true, "test")
+	s.Empty(s.update())
+	s.addPod("10.0.0.2", "kubedock", "service", "service", true, "test")
+	s.Equal(2, len(s.update()))
+}
+
+func (s *EventsTestSuite) Test_Lifecycle() {
+	s.update()
+
+	s.addPod("10.0.0.1", "kubedock", "db", "db", false, "test")
+	s.Equal([]string{
+		"Normal NetworkJoined Joined network 'test' with host aliases db",
+	}, s.update())
+
+	s.addPod("10.0.0.1", "kubedock", "db", "db", true, "test")
+	s.Equal([]string{
+		"Normal DnsRegistered Host aliases db resolvable in network 'test'",
+	}, s.update())
+
+	s.addPod("10.0.0.1", "kubedock", "db", "db", false, "test")
+	s.Equal([]string{
+		"Normal DnsUnregistered Host aliases db no longer resolvable in network 'test' since the pod is not ready",
+	}, s.update())
+
+	s.pods.Delete("kubedock", "db")
+	s.Equal([]string{
+		"Normal NetworkLeft Left network 'test'",
+	}, s.update())
+	s.Empty(s.update())
+}
+
+func (s *EventsTestSuite) Test_Conflict() {
+	s.addPod("10.0.0.1", "kubedock", "db", "db", true, "test")
+	s.update()
+
+	s.addPod("10.0.0.2", "kubedock", "db2", "db", true, "test")
+	s.Equal([]string{
+		"Warning HostAliasConflict Host alias 'db' in network 'test' is also used by db2, " +
+			"lookups return the IPs of all of these",
+		"Normal NetworkJoined Joined network 'test' with host aliases db",
+		"Normal DnsRegistered Host aliases db resolvable in network 'test'",
+		"Warning HostAliasConflict Host alias 'db' in network 'test' is also used by db, " +
+			"lookups return the IPs of all of these",
+	}, s.update())
+}
+
+func (s *EventsTestSuite) Test_ServicesNotReported() {
+	s.addPod("10.0.0.1", "kubedock", "db", "db", true, "test")
+	s.update()
+
+	member, err := model.NewServiceMember("10.0.0.2", "other", "db", []model.Hostname{"db"},
+		[]model.NetworkId{"global:test"})
+	s.Require().Nil(err)
+	s.pods.SetServiceMembers("other", "db", []*model.Pod{member})
+	s.Empty(s.update())
+
+	s.pods.Delete("kubedock", "db")
+	s.addPod("10.0.0.1", "kubedock", "db", "db", true, "global:test")
+	events := s.update()
+	s.Contains(events, "Warning HostAliasConflict Host alias 'db' in network 'global:test' is also used by "+
+		"service other/db, lookups return the IPs of all of these")
+}
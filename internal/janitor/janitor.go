@@ -0,0 +1,240 @@
+package janitor
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+	"wamblee.org/kubedock/dns/internal/events"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// Janitor deletes the pods of abandoned networks, for instance of CI jobs that were killed
+// before kubedock could clean up. A network is abandoned when it was idle for longer than
+// the TTL, or when the latest expiry annotated on its members has passed. Activity is a
+// DNS query from a member or a change of the members. Global networks never expire.
+type Janitor struct {
+	clientset kubernetes.Interface
+	// Nil when events are disabled.
+	recorder record.EventRecorder
+	// Zero means that networks only expire through annotations.
+	ttl    time.Duration
+	dryRun bool
+	now    func() time.Time
+
+	mutex    sync.Mutex
+	networks *model.Networks
+	// time of the last activity by network.
+	activity map[model.NetworkKey]time.Time
+
+	// pods that were deleted or, in dry-run mode, reported. Only used by Collect.
+	handled map[string]bool
+}
+
+func NewJanitor(clientset kubernetes.Interface, recorder record.EventRecorder, ttl time.Duration,
+	dryRun bool) *Janitor {
+	return &Janitor{
+		clientset: clientset,
+		recorder:  recorder,
+		ttl:       ttl,
+		dryRun:    dryRun,
+		now:       time.Now,
+		activity:  make(map[model.NetworkKey]time.Time),
+		handled:   make(map[string]bool),
+	}
+}
+
+// NetworksChanged records activity in the networks that changed. Networks that are seen
+// for the first time, also after a restart, start out as active.
+func (janitor *Janitor) NetworksChanged(networks *model.Networks) {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+
+	now := janitor.now()
+	for _, change := range model.DiffNetworks(janitor.networks, networks) {
+		janitor.activity[change.Network] = now
+	}
+	janitor.networks = networks
+	maps.DeleteFunc(janitor.activity, func(key model.NetworkKey, _ time.Time) bool {
+		return networks.NameToNetwork[key] == nil
+	})
+}
+
+// Queried records activity in the networks of the source of a DNS query.
+func (janitor *Janitor) Queried(sourceIp model.IPAddress) {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+
+	if janitor.networks == nil {
+		return
+	}
+	now := janitor.now()
+	for key := range janitor.networks.IpToNetworks[sourceIp] {
+		janitor.activity[key] = now
+	}
+}
+
+// Run checks the networks at the interval until the context is canceled.
+func (janitor *Janitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			janitor.Collect(ctx)
+		}
+	}
+}
+
+// expiredPod is a pod to delete with the reason.
+type expiredPod struct {
+	pod    *model.Pod
+	reason string
+}
+
+// Collect deletes the pods of expired networks. Pods are only deleted when all of their
+// networks that are not global expired, so that pods are not removed from active networks.
+func (janitor *Janitor) Collect(ctx context.Context) {
+	expired, current := janitor.expiredPods()
+	for _, expired := range expired {
+		key := podKey(expired.pod)
+		if janitor.handled[key] {
+			continue
+		}
+		if janitor.delete(ctx, expired.pod, expired.reason) {
+			janitor.handled[key] = true
+		}
+	}
+	maps.DeleteFunc(janitor.handled, func(key string, _ bool) bool {
+		return !current[key]
+	})
+}
+
+// expiredPods returns the pods to delete and the keys of all current pods.
+func (janitor *Janitor) expiredPods() ([]expiredPod, map[string]bool) {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+
+	current := make(map[string]bool)
+	if janitor.networks == nil {
+		return nil, current
+	}
+	now := janitor.now()
+	reasons := make(map[model.NetworkKey]string)
+	for key, network := range janitor.networks.NameToNetwork {
+		if reason, expired := janitor.expired(key, network, now); expired {
+			reasons[key] = reason
+		}
+	}
+
+	for _, network := range janitor.networks.NameToNetwork {
+		for _, pod := range network.IPToPod {
+			current[podKey(pod)] = true
+		}
+	}
+
+	res := make([]expiredPod, 0)
+	seen := make(map[string]bool)
+	keys := slices.SortedFunc(maps.Keys(reasons), func(a, b model.NetworkKey) int {
+		return cmp.Compare(a.String(), b.String())
+	})
+	for _, key := range keys {
+		for _, pod := range janitor.networks.NameToNetwork[key].IPToPod {
+			if pod.IsService() || pod.HasUnknownIP() || seen[podKey(pod)] {
+				continue
+			}
+			seen[podKey(pod)] = true
+			if allExpired(pod, reasons) {
+				res = append(res, expiredPod{
+					pod:    pod,
+					reason: fmt.Sprintf("network '%s' %s", key.Id, reasons[key]),
+				})
+			}
+		}
+	}
+	return res, current
+}
+
+// expired returns whether a network expired and why.
+func (janitor *Janitor) expired(key model.NetworkKey, network *model.Network,
+	now time.Time) (string, bool) {
+	if key.Namespace == "" {
+		return "", false
+	}
+	var expires time.Time
+	for _, pod := range network.IPToPod {
+		if pod.Expires.After(expires) {
+			expires = pod.Expires
+		}
+	}
+	if !expires.IsZero() && now.After(expires) {
+		return fmt.Sprintf("expired at %s", expires.Format(time.RFC3339)), true
+	}
+	if janitor.ttl <= 0 {
+		return "", false
+	}
+	idle := now.Sub(janitor.activity[key])
+	if idle <= janitor.ttl {
+		return "", false
+	}
+	return fmt.Sprintf("was idle for %v", idle.Truncate(time.Second)), true
+}
+
+func allExpired(pod *model.Pod, reasons map[model.NetworkKey]string) bool {
+	for _, id := range pod.Networks {
+		key := model.NewNetworkKey(pod.Namespace, id)
+		if _, expired := reasons[key]; !expired && key.Namespace != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func podKey(pod *model.Pod) string {
+	return pod.Namespace + "/" + pod.Name + "/" + string(pod.UID)
+}
+
+// delete deletes a pod, or only reports it in dry-run mode. Returns false when deletion
+// must be retried.
+func (janitor *Janitor) delete(ctx context.Context, pod *model.Pod, reason string) bool {
+	if janitor.dryRun {
+		klog.Infof("%s/%s: dry run: pod would be deleted since %s", pod.Namespace, pod.Name, reason)
+		janitor.event(pod, "Pod would be deleted since %s (dry run)", reason)
+		return true
+	}
+	klog.Infof("%s/%s: deleting pod since %s", pod.Namespace, pod.Name, reason)
+	options := metav1.DeleteOptions{}
+	if pod.UID != "" {
+		// a pod that was recreated with the same name is not deleted.
+		options.Preconditions = metav1.NewUIDPreconditions(string(pod.UID))
+	}
+	err := janitor.clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, options)
+	if errors.IsNotFound(err) || errors.IsConflict(err) {
+		return true
+	}
+	if err != nil {
+		klog.Warningf("%s/%s: could not delete pod: %v", pod.Namespace, pod.Name, err)
+		return false
+	}
+	janitor.event(pod, "Deleted pod since %s", reason)
+	return true
+}
+
+func (janitor *Janitor) event(pod *model.Pod, message string, reason string) {
+	if janitor.recorder == nil {
+		return
+	}
+	janitor.recorder.Eventf(events.PodReference(pod), corev1.EventTypeWarning,
+		events.REASON_NETWORK_EXPIRED, message, reason)
+}
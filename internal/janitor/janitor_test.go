@@ -0,0 +1,186 @@
+package janitor
+
+import (
+	"context"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"testing"
+	"time"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+const TTL = time.Hour
+
+type JanitorTestSuite struct {
+	suite.Suite
+
+	ctx       context.Context
+	clientset *fake.Clientset
+	recorder  *record.FakeRecorder
+	pods      *model.Pods
+	now       time.Time
+	janitor   *Janitor
+}
+
+func (s *JanitorTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.clientset = fake.NewClientset()
+	s.recorder = record.NewFakeRecorder(100)
+	s.pods = model.NewPods()
+	s.now = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.janitor = s.newJanitor(false)
+}
+
+func TestJanitorTestSuite(t *testing.T) {
+	suite.Run(t, &JanitorTestSuite{})
+}
+
+func (s *JanitorTestSuite) newJanitor(dryRun bool) *Janitor {
+	janitor := NewJanitor(s.clientset, s.recorder, TTL, dryRun)
+	janitor.now = func() time.Time {
+		return s.now
+	}
+	return janitor
+}
+
+func (s *JanitorTestSuite) addPod(ip string, name string, expires time.Time, networks ...model.NetworkId) {
+	_, err := s.clientset.CoreV1().Pods("kubedock").Create(s.ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kubedock", Name: name, UID: types.UID(name + "-uid")},
+	}, metav1.CreateOptions{})
+	s.Require().Nil(err)
+	pod, err := model.NewPod(model.IPAddress(ip), "kubedock", name, []model.Hostname{model.Hostname(name)},
+		networks, true)
+	s.Require().Nil(err)
+	pod.UID = types.UID(name + "-uid")
+	pod.Expires = expires
+	s.pods.AddOrUpdate(pod)
+	s.update()
+}
+
+func (s *JanitorTestSuite) update() {
+	networks, errors := s.pods.Networks()
+	s.Require().Nil(errors)
+	s.janitor.NetworksChanged(networks)
+}
+
+// existing returns the names of the pods that were not deleted.
+func (s *JanitorTestSuite) existing() []string {
+	list, err := s.clientset.CoreV1().Pods("kubedock").List(s.ctx, metav1.ListOptions{})
+	s.Require().Nil(err)
+	res := make([]string, 0)
+	for _, pod := range list.Items {
+		res = append(res, pod.Name)
+	}
+	return res
+}
+
+func (s *JanitorTestSuite) events() []string {
+	res := make([]string, 0)
+	for len(s.recorder.Events) > 0 {
+		res = append(res, <-s.recorder.Events)
+	}
+	return res
+}
+
+func (s *JanitorTestSuite) Test_IdleNetwork() {
+	s.addPod("10.0.0.1", "db", time.Time{}, "test")
+	s.addPod("10.0.0.2", "service", time.Time{}, "test")
+
+	s.now = s.now.Add(TTL)
+	s.janitor.Collect(s.ctx)
+	s.ElementsMatch([]string{"db", "service"}, s.existing())
+
+	s.now = s.now.Add(time.Minute)
+	s.janitor.Collect(s.ctx)
+	s.Empty(s.existing())
+	s.Equal([]string{
+		"Warning NetworkExpired Deleted pod since network 'test' was idle for 1h1m0s",
+		"Warning NetworkExpired Deleted pod since network 'test' was idle for 1h1m0s",
+	}, s.events())
+}
+
+func (s *JanitorTestSuite) Test_ActivityKeepsNetwork() {
+	s.addPod("10.0.0.1", "db", time.Time{}, "test")
+	s.addPod("10.0.0.2", "service", time.Time{}, "other")
+
+	s.now = s.now.Add(TTL)
+	s.janitor.Queried("10.0.0.1")
+	// queries from unknown sources are no activity
+	s.janitor.Queried("10.0.0.3")
+	s.now = s.now.Add(time.Minute)
+	s.janitor.Collect(s.ctx)
+	s.Equal([]string{"db"}, s.existing())
+
+	// pod changes are activity
+	s.addPod("10.0.0.4", "web", time.Time{}, "test")
+	s.now = s.now.Add(TTL)
+	s.janitor.Collect(s.ctx)
+	s.ElementsMatch([]string{"db", "web"}, s.existing())
+}
+
+func (s *JanitorTestSuite) Test_Expiry() {
+	s.addPod("10.0.0.1", "db", s.now.Add(time.Minute), "test")
+	s.addPod("10.0.0.2", "service", s.now.Add(2*time.Minute), "test")
+
+	s.now = s.now.Add(time.Minute + time.Second)
+	s.janitor.Collect(s.ctx)
+	s.Equal(2, len(s.existing()))
+
+	s.now = s.now.Add(time.Minute)
+	s.janitor.Collect(s.ctx)
+	s.Empty(s.existing())
+	s.Contains(s.events(),
+		"Warning NetworkExpired Deleted pod since network 'test' expired at 2025-03-01T12:02:00Z")
+}
+
+func (s *JanitorTestSuite) Test_PodInActiveNetworkIsKept() {
+	s.addPod("10.0.0.1", "db", time.Time{}, "test", "other")
+	s.addPod("10.0.0.2", "service", s.now.Add(time.Minute), "test")
+	s.addPod("10.0.0.3", "web", time.Time{}, "global:shared")
+
+	s.now = s.now.Add(2 * time.Minute)
+	s.janitor.Collect(s.ctx)
+	s.ElementsMatch([]string{"db", "web"}, s.existing())
+
+	// global networks never expire
+	s.now = s.now.Add(2 * TTL)
+	s.janitor.Collect(s.ctx)
+	s.Equal([]string{"web"}, s.existing())
+}
+
+func (s *JanitorTestSuite) Test_DryRun() {
+	s.janitor = s.newJanitor(true)
+	s.addPod("10.0.0.1", "db", time.Time{}, "test")
+
+	s.now = s.now.Add(2 * TTL)
+	s.janitor.Collect(s.ctx)
+	s.janitor.Collect(s.ctx)
+	s.Equal([]string{"db"}, s.existing())
+	// reported only once
+	s.Equal([]string{
+		"Warning NetworkExpired Pod would be deleted since network 'test' was idle for 2h0m0s (dry run)",
+	}, s.events())
+}
+
+func (s *JanitorTestSuite) Test_DeletionRequiresSameUID() {
+	s.addPod("10.0.0.1", "db", time.Time{}, "test")
+	s.now = s.now.Add(2 * TTL)
+	s.janitor.Collect(s.ctx)
+
+	// a pod that was recreated with the same name is not deleted.
+	deletes := 0
+	for _, action := range s.clientset.Actions() {
+		if deleteAction, ok := action.(k8stesting.DeleteAction); ok {
+			deletes++
+			preconditions := deleteAction.GetDeleteOptions().Preconditions
+			s.Require().NotNil(preconditions)
+			s.Equal(types.UID("db-uid"), *preconditions.UID)
+		}
+	}
+	s.Equal(1, deletes)
+}
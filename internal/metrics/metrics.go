@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const NAMESPACE = "kubedock_dns"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	WatcherTombstones = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "watcher",
+		Name:      "tombstones_total",
+		Help:      "Deletes of pods for which the final state was unknown because a watch event was missed.",
+	})
+	WatcherUnexpectedObjects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "watcher",
+		Name:      "unexpected_objects_total",
+		Help:      "Objects received from the informer that could not be interpreted as pods.",
+	})
+	ReconcilerDrift = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "reconciler",
+		Name:      "drift_total",
+		Help:      "Differences found between the pod administration and the cluster by kind (added, updated, removed).",
+	}, []string{"kind"})
+	DnsUpdateBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "dns",
+		Name:      "update_batch_size",
+		Help:      "Number of pod changes combined into a single DNS update.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	DnsUpdateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "dns",
+		Name:      "update_duration_seconds",
+		Help:      "Time to build the networks for a DNS update.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	CertificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "webhook",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Time at which the serving certificate of the webhooks expires.",
+	})
+	CertificateRenewals = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "webhook",
+		Name:      "certificate_renewals_total",
+		Help:      "Renewals of the managed certificates of the webhooks.",
+	})
+	QuotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "quota",
+		Name:      "limit",
+		Help:      "Configured limit by quota, 0 means unlimited.",
+	}, []string{"quota"})
+	QuotaUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "quota",
+		Name:      "usage_max",
+		Help:      "Highest current usage by quota, for instance the number of pods in the largest network.",
+	}, []string{"quota"})
+	QuotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "quota",
+		Name:      "rejections_total",
+		Help:      "Pods and networks rejected because they would exceed a quota.",
+	}, []string{"quota"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		WatcherTombstones,
+		WatcherUnexpectedObjects,
+		ReconcilerDrift,
+		DnsUpdateBatchSize,
+		DnsUpdateDuration,
+		CertificateExpiry,
+		CertificateRenewals,
+		QuotaLimit,
+		QuotaUsage,
+		QuotaRejections,
+	)
+}
+
+// Handler serves the metrics in the prometheus format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,176 @@
+package model
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+type ChangeType string
+
+const (
+	// A member joined a network. Pods that are admitted but not yet scheduled join with
+	// an unknown IP.
+	MEMBER_JOINED ChangeType = "joined"
+	// A member got an IP, either because it was scheduled or because its IP changed.
+	MEMBER_IP_ASSIGNED ChangeType = "ipassigned"
+	// A member left a network.
+	MEMBER_LEFT ChangeType = "left"
+	// The host aliases of a member became resolvable in a network.
+	MEMBER_READY ChangeType = "ready"
+	// The host aliases of a member are no longer resolvable in a network.
+	MEMBER_NOT_READY ChangeType = "notready"
+	// A host alias of a member is also used by other members of the network.
+	HOSTALIAS_CONFLICT ChangeType = "conflict"
+	// The last member left a network.
+	NETWORK_EMPTIED ChangeType = "emptied"
+)
+
+// NetworkChange is a change of a network member between two network snapshots.
+type NetworkChange struct {
+	Type    ChangeType
+	Network NetworkKey
+	// The member, which is nil for changes of the network itself.
+	Member *Pod
+	// For conflicts, the host alias and the other members that use it.
+	HostAlias Hostname
+	Others    []*Pod
+}
+
+// memberKey identifies a network member independent of its IP, which changes when an
+// admitted pod is scheduled.
+type memberKey struct {
+	network NetworkKey
+	member  string
+}
+
+type conflictKey struct {
+	memberKey
+	hostAlias Hostname
+}
+
+type snapshot struct {
+	networks  map[NetworkKey]bool
+	members   map[memberKey]*Pod
+	conflicts map[conflictKey][]*Pod
+}
+
+func newSnapshot(networks *Networks) *snapshot {
+	snapshot := &snapshot{
+		networks:  make(map[NetworkKey]bool),
+		members:   make(map[memberKey]*Pod),
+		conflicts: make(map[conflictKey][]*Pod),
+	}
+	if networks == nil {
+		return snapshot
+	}
+	for key, network := range networks.NameToNetwork {
+		snapshot.networks[key] = len(network.IPToPod) > 0
+		for _, pod := range network.IPToPod {
+			snapshot.members[memberKey{key, pod.Namespace + "/" + pod.Name}] = pod
+		}
+		for hostAlias, pods := range network.HostAliasToPods {
+			if len(pods) < 2 {
+				continue
+			}
+			pods = slices.DeleteFunc(slices.Clone(pods), func(pod *Pod) bool {
+				return strings.HasPrefix(string(pod.IP), UNKNOWN_IP_PREFIX)
+			})
+			for _, pod := range pods {
+				// members of the same headless service share their host aliases.
+				others := slices.DeleteFunc(slices.Clone(pods), func(other *Pod) bool {
+					return other == pod || (pod.IsService() && other.Service == pod.Service)
+				})
+				if len(others) == 0 {
+					continue
+				}
+				slices.SortFunc(others, func(a, b *Pod) int {
+					return cmp.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+				})
+				snapshot.conflicts[conflictKey{memberKey{key, pod.Namespace + "/" + pod.Name}, hostAlias}] = others
+			}
+		}
+	}
+	return snapshot
+}
+
+// DiffNetworks returns the changes of the network members from the old to the new
+// networks. Old networks can be nil. The changes are ordered by network and member.
+func DiffNetworks(old *Networks, new *Networks) []NetworkChange {
+	before := newSnapshot(old)
+	after := newSnapshot(new)
+	changes := make([]NetworkChange, 0)
+
+	for key, pod := range after.members {
+		oldpod := before.members[key]
+		if oldpod == nil {
+			changes = append(changes, NetworkChange{Type: MEMBER_JOINED, Network: key.network, Member: pod})
+		}
+		if !pod.HasUnknownIP() && (oldpod == nil || oldpod.IP != pod.IP) {
+			changes = append(changes, NetworkChange{Type: MEMBER_IP_ASSIGNED, Network: key.network, Member: pod})
+		}
+		if pod.Ready && (oldpod == nil || !oldpod.Ready) {
+			changes = append(changes, NetworkChange{Type: MEMBER_READY, Network: key.network, Member: pod})
+		}
+		if !pod.Ready && oldpod != nil && oldpod.Ready {
+			changes = append(changes, NetworkChange{Type: MEMBER_NOT_READY, Network: key.network, Member: pod})
+		}
+	}
+	for key, pod := range before.members {
+		if after.members[key] == nil {
+			changes = append(changes, NetworkChange{Type: MEMBER_LEFT, Network: key.network, Member: pod})
+		}
+	}
+	for key, members := range before.networks {
+		if members && !after.networks[key] {
+			changes = append(changes, NetworkChange{Type: NETWORK_EMPTIED, Network: key})
+		}
+	}
+	for key, others := range after.conflicts {
+		if _, existed := before.conflicts[key]; existed {
+			continue
+		}
+		changes = append(changes, NetworkChange{
+			Type:      HOSTALIAS_CONFLICT,
+			Network:   key.network,
+			Member:    after.members[key.memberKey],
+			HostAlias: key.hostAlias,
+			Others:    others,
+		})
+	}
+
+	slices.SortStableFunc(changes, func(a, b NetworkChange) int {
+		return cmp.Or(
+			cmp.Compare(a.Network.String(), b.Network.String()),
+			// changes of the network itself come after those of its members.
+			compareNil(a.Member, b.Member),
+			cmp.Compare(memberName(a.Member), memberName(b.Member)),
+			cmp.Compare(changeOrder(a.Type), changeOrder(b.Type)),
+			cmp.Compare(a.HostAlias, b.HostAlias),
+		)
+	})
+	return changes
+}
+
+func compareNil(a *Pod, b *Pod) int {
+	switch {
+	case a == nil && b != nil:
+		return 1
+	case a != nil && b == nil:
+		return -1
+	}
+	return 0
+}
+
+func memberName(pod *Pod) string {
+	if pod == nil {
+		return ""
+	}
+	return pod.Namespace + "/" + pod.Name
+}
+
+// changeOrder orders the changes of a single member in a logical order.
+func changeOrder(changeType ChangeType) int {
+	return slices.Index([]ChangeType{MEMBER_JOINED, MEMBER_IP_ASSIGNED, MEMBER_READY, HOSTALIAS_CONFLICT,
+		MEMBER_NOT_READY, MEMBER_LEFT}, changeType)
+}
@@ -0,0 +1,151 @@
+package model
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type DiffTestSuite struct {
+	suite.Suite
+
+	pods *Pods
+}
+
+func (s *DiffTestSuite) SetupTest() {
+	s.pods = NewPods()
+}
+
+func TestDiffTestSuite(t *testing.T) {
+	suite.Run(t, &DiffTestSuite{})
+}
+
+func (s *DiffTestSuite) addPod(ip string, name string, hostAlias string, ready bool, networks ...NetworkId) {
+	pod, err := NewPod(IPAddress(ip), "kubedock", name, []Hostname{Hostname(hostAlias)}, networks, ready)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+}
+
+func (s *DiffTestSuite) networks() *Networks {
+	networks, errors := s.pods.Networks()
+	s.Require().Nil(errors)
+	return networks
+}
+
+// changes returns the changes in a readable form.
+func (s *DiffTestSuite) changes(old *Networks, new *Networks) []string {
+	res := make([]string, 0)
+	for _, change := range DiffNetworks(old, new) {
+		if change.Member == nil {
+			res = append(res, fmt.Sprintf("%s %s", change.Network, change.Type))
+			continue
+		}
+		description := fmt.Sprintf("%s %s %s", change.Network, change.Member.Name, change.Type)
+		if change.Type == MEMBER_IP_ASSIGNED {
+			description += " " + string(change.Member.IP)
+		}
+		if change.Type == HOSTALIAS_CONFLICT {
+			description += " " + string(change.HostAlias)
+			for _, other := range change.Others {
+				description += " " + other.Name
+			}
+		}
+		res = append(res, description)
+	}
+	return res
+}
+
+func (s *DiffTestSuite) Test_NoChanges() {
+	s.Empty(DiffNetworks(nil, s.networks()))
+	s.addPod("10.0.0.1", "db", "db", true, "test")
+	networks := s.networks()
+	s.Empty(s.changes(networks, networks))
+}
+
+func (s *DiffTestSuite) Test_JoinReadyAndLeave() {
+	s.addPod("10.0.0.1", "db", "db", false, "test", "other")
+	initial := s.networks()
+	s.Equal([]string{
+		"kubedock/other db joined",
+		"kubedock/other db ipassigned 10.0.0.1",
+		"kubedock/test db joined",
+		"kubedock/test db ipassigned 10.0.0.1",
+	}, s.changes(nil, initial))
+
+	s.addPod("10.0.0.1", "db", "db", true, "test", "other")
+	ready := s.networks()
+	s.Equal([]string{
+		"kubedock/other db ready",
+		"kubedock/test db ready",
+	}, s.changes(initial, ready))
+
+	s.addPod("10.0.0.1", "db", "db", false, "test")
+	s.Equal([]string{
+		"kubedock/other db left",
+		"kubedock/other emptied",
+		"kubedock/test db notready",
+	}, s.changes(ready, s.networks()))
+}
+
+func (s *DiffTestSuite) Test_IPAssigned() {
+	pod, err := NewPod(UNKNOWN_IP_PREFIX+"kubedock/db", "kubedock", "db", []Hostname{"db"},
+		[]NetworkId{"test"}, false)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+	admitted := s.networks()
+	s.Equal([]string{"kubedock/test db joined"}, s.changes(nil, admitted))
+
+	s.pods.Delete("kubedock", "db")
+	s.addPod("10.0.0.1", "db", "db", false, "test")
+	scheduled := s.networks()
+	s.Equal([]string{"kubedock/test db ipassigned 10.0.0.1"}, s.changes(admitted, scheduled))
+
+	s.pods.Delete("kubedock", "db")
+	s.addPod("10.0.0.2", "db", "db", false, "test")
+	changed := s.networks()
+	s.Equal([]string{"kubedock/test db ipassigned 10.0.0.2"}, s.changes(scheduled, changed))
+
+	s.pods.Delete("kubedock", "db")
+	s.Equal([]string{
+		"kubedock/test db left",
+		"kubedock/test emptied",
+	}, s.changes(changed, s.networks()))
+}
+
+func (s *DiffTestSuite) Test_Conflict() {
+	s.addPod("10.0.0.1", "db", "db", true, "test")
+	initial := s.networks()
+	s.addPod("10.0.0.2", "db2", "db", true, "test")
+	conflict := s.networks()
+	s.Equal([]string{
+		"kubedock/test db conflict db db2",
+		"kubedock/test db2 joined",
+		"kubedock/test db2 ipassigned 10.0.0.2",
+		"kubedock/test db2 ready",
+		"kubedock/test db2 conflict db db",
+	}, s.changes(initial, conflict))
+
+	// a conflict is only reported when it occurs.
+	s.addPod("10.0.0.3", "service", "service", true, "test")
+	s.Equal([]string{
+		"kubedock/test service joined",
+		"kubedock/test service ipassigned 10.0.0.3",
+		"kubedock/test service ready",
+	}, s.changes(conflict, s.networks()))
+}
+
+func (s *DiffTestSuite) Test_NoConflictWithinService() {
+	for _, ip := range []IPAddress{"10.0.0.1", "10.0.0.2"} {
+		member, err := NewServiceMember(ip, "kubedock", "db", []Hostname{"db"}, []NetworkId{"test"})
+		s.Require().Nil(err)
+		s.pods.AddOrUpdate(member)
+	}
+	s.Equal([]string{
+		"kubedock/test service/db/10.0.0.1 joined",
+		"kubedock/test service/db/10.0.0.1 ipassigned 10.0.0.1",
+		"kubedock/test service/db/10.0.0.1 ready",
+		"kubedock/test service/db/10.0.0.2 joined",
+		"kubedock/test service/db/10.0.0.2 ipassigned 10.0.0.2",
+		"kubedock/test service/db/10.0.0.2 ready",
+	}, s.changes(nil, s.networks()))
+}
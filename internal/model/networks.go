@@ -1,12 +1,20 @@
 package model
 
 import (
+	"errors"
 	"fmt"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/klog/v2"
+	"maps"
 	"reflect"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
 	"wamblee.org/kubedock/dns/internal/support"
 )
 
@@ -21,6 +29,16 @@ type PodName string
 // and ignore it.
 const UNKNOWN_IP_PREFIX = "unknownip:"
 
+// NewUnknownIP returns a unique IP for a pod whose IP is not yet known.
+func NewUnknownIP() IPAddress {
+	return IPAddress(UNKNOWN_IP_PREFIX + strconv.Itoa(time.Now().Nanosecond()) + strconv.Itoa(rand.Int()))
+}
+
+// HasUnknownIP returns true when the IP of the pod is not yet known.
+func (pod *Pod) HasUnknownIP() bool {
+	return strings.HasPrefix(string(pod.IP), UNKNOWN_IP_PREFIX)
+}
+
 type Pod struct {
 	IP          IPAddress
 	Namespace   string
@@ -28,6 +46,17 @@ type Pod struct {
 	HostAliases []Hostname
 	Networks    []NetworkId
 	Ready       bool
+	// Name of the service for network members that are services instead of pods.
+	Service string
+	// Hostname of the pod, possibly including a subdomain. A pod can always resolve its
+	// own hostname, even when it is not yet ready. Empty when not set.
+	Hostname Hostname
+	// UID of the pod, used to report events. Empty for pods that were not created yet.
+	UID types.UID
+	// Time after which the networks of the pod may be cleaned up. Zero when not set.
+	Expires time.Time
+	// Networks of the pod that are internal.
+	InternalNetworks []NetworkId
 }
 
 func NewPod(ip IPAddress, namespace string, name string, hostAliases []Hostname,
@@ -64,31 +93,103 @@ func (pod *Pod) Equal(otherPod *Pod) bool {
 
 func (pod *Pod) Copy() *Pod {
 	return &Pod{
-		IP:          pod.IP,
-		Namespace:   pod.Namespace,
-		Name:        pod.Name,
-		HostAliases: slices.Clone(pod.HostAliases),
-		Networks:    slices.Clone(pod.Networks),
-		Ready:       pod.Ready,
+		IP:               pod.IP,
+		Namespace:        pod.Namespace,
+		Name:             pod.Name,
+		HostAliases:      slices.Clone(pod.HostAliases),
+		Networks:         slices.Clone(pod.Networks),
+		Ready:            pod.Ready,
+		Service:          pod.Service,
+		Hostname:         pod.Hostname,
+		UID:              pod.UID,
+		Expires:          pod.Expires,
+		InternalNetworks: slices.Clone(pod.InternalNetworks),
+	}
+}
+
+// Prefix of the names of network members that are services. This cannot clash with pod
+// names since these cannot contain a '/'.
+const SERVICE_MEMBER_PREFIX = "service/"
+
+// NewServiceMember creates a network member for a service with a single IP. The service
+// is either reached through its cluster IP or, for headless services, through the IPs of
+// its endpoints, so that one service can have multiple members.
+func NewServiceMember(ip IPAddress, namespace string, service string, hostAliases []Hostname,
+	networks []NetworkId) (*Pod, error) {
+	member, err := NewPod(ip, namespace, SERVICE_MEMBER_PREFIX+service+"/"+string(ip),
+		hostAliases, networks, true)
+	if err != nil {
+		return nil, err
+	}
+	member.Service = service
+	return member, nil
+}
+
+// IsService returns true when the network member is a service instead of a pod.
+func (pod *Pod) IsService() bool {
+	return pod.Service != ""
+}
+
+// Networks with an id with this prefix are global networks.
+const GLOBAL_NETWORK_PREFIX = "global:"
+
+// IsGlobal returns true for networks that are shared between namespaces.
+func (id NetworkId) IsGlobal() bool {
+	return strings.HasPrefix(string(id), GLOBAL_NETWORK_PREFIX)
+}
+
+// NetworkKey identifies a network. Networks are isolated per namespace, so networks with
+// the same id in different namespaces are different networks. Global networks are the
+// exception, these have an empty namespace.
+type NetworkKey struct {
+	Namespace string
+	Id        NetworkId
+}
+
+func NewNetworkKey(namespace string, id NetworkId) NetworkKey {
+	if id.IsGlobal() {
+		namespace = ""
 	}
+	return NetworkKey{Namespace: namespace, Id: id}
+}
+
+func (key NetworkKey) String() string {
+	if key.Namespace == "" {
+		return string(key.Id)
+	}
+	return key.Namespace + "/" + string(key.Id)
 }
 
 type Network struct {
+	Namespace       string
 	Id              NetworkId
 	IPToPod         map[IPAddress]*Pod
 	HostAliasToPods map[Hostname][]*Pod
+	// Internal networks have no external connectivity, as docker networks created with
+	// '--internal'. A network is internal when all of its running pods declare it internal.
+	// Services and pods that do not have an IP yet are not taken into account.
+	Internal bool
 }
 
-func NewNetwork(id NetworkId) *Network {
+func NewNetwork(key NetworkKey) *Network {
 	network := Network{
-		Id:              id,
+		Namespace:       key.Namespace,
+		Id:              key.Id,
 		IPToPod:         make(map[IPAddress]*Pod),
 		HostAliasToPods: make(map[Hostname][]*Pod),
 	}
 	return &network
 }
 
+func (net *Network) Key() NetworkKey {
+	return NetworkKey{Namespace: net.Namespace, Id: net.Id}
+}
+
 func (net *Network) Add(pod *Pod) error {
+	if isRunningPod(pod) {
+		internal := slices.Contains(pod.InternalNetworks, net.Id)
+		net.Internal = internal && (net.Internal || !net.hasRunningPods())
+	}
 	net.IPToPod[pod.IP] = pod
 	for _, hostAlias := range pod.HostAliases {
 		pods := net.HostAliasToPods[hostAlias]
@@ -100,11 +201,24 @@ func (net *Network) Add(pod *Pod) error {
 	return nil
 }
 
+func isRunningPod(pod *Pod) bool {
+	return !pod.IsService() && !pod.HasUnknownIP()
+}
+
+func (net *Network) hasRunningPods() bool {
+	for _, pod := range net.IPToPod {
+		if isRunningPod(pod) {
+			return true
+		}
+	}
+	return false
+}
+
 // Networks is not thread-safe and is meant to be used using copy-on-write
 // This make the design a lot easier since it will support many change scenario's
 // out of the box.
 
-type NetworkMap map[NetworkId]*Network
+type NetworkMap map[NetworkKey]*Network
 
 type Networks struct {
 	NameToNetwork NetworkMap
@@ -144,10 +258,11 @@ func (net *Networks) Add(pod *Pod) *PodError {
 	}
 
 	for _, networkId := range pod.Networks {
+		key := NewNetworkKey(pod.Namespace, networkId)
 		// does the pod network already exist?
-		network := net.NameToNetwork[networkId]
+		network := net.NameToNetwork[key]
 		if network == nil {
-			network = NewNetwork(networkId)
+			network = NewNetwork(key)
 		}
 		err := network.Add(pod)
 		if err != nil {
@@ -157,8 +272,8 @@ func (net *Networks) Add(pod *Pod) *PodError {
 		if net.IpToNetworks[pod.IP] == nil {
 			net.IpToNetworks[pod.IP] = make(NetworkMap)
 		}
-		net.IpToNetworks[pod.IP][networkId] = network
-		net.NameToNetwork[networkId] = network
+		net.IpToNetworks[pod.IP][key] = network
+		net.NameToNetwork[key] = network
 	}
 
 	return nil
@@ -166,8 +281,8 @@ func (net *Networks) Add(pod *Pod) *PodError {
 
 func (net *Networks) Log() {
 	klog.Infof("Network count: %d", len(net.NameToNetwork))
-	for networkId, network := range net.NameToNetwork {
-		klog.Infof("Network %s", networkId)
+	for key, network := range net.NameToNetwork {
+		klog.Infof("Network %s", key)
 		for ip, pod := range network.IPToPod {
 			klog.Infof("  Pod: %s/%s ready %v", pod.Namespace, pod.Name, pod.Ready)
 			klog.Infof("    IP: %s", ip)
@@ -179,6 +294,30 @@ func (net *Networks) Log() {
 	}
 }
 
+// PodNamespace returns the namespace of the pod with the given IP, or the empty string
+// if the IP is unknown.
+func (net *Networks) PodNamespace(ip IPAddress) string {
+	for _, network := range net.IpToNetworks[ip] {
+		return network.IPToPod[ip].Namespace
+	}
+	return ""
+}
+
+// OnlyInternal returns true when the pod with the given IP is only a member of internal
+// networks, so that it cannot resolve external names. Unknown IPs are not restricted.
+func (net *Networks) OnlyInternal(ip IPAddress) bool {
+	networks := net.IpToNetworks[ip]
+	if len(networks) == 0 {
+		return false
+	}
+	for _, network := range networks {
+		if !network.Internal {
+			return false
+		}
+	}
+	return true
+}
+
 func (net *Networks) Lookup(sourceIp IPAddress, hostname Hostname) []IPAddress {
 	res := make([]IPAddress, 0)
 	if strings.HasPrefix(string(sourceIp), UNKNOWN_IP_PREFIX) {
@@ -196,10 +335,26 @@ func (net *Networks) Lookup(sourceIp IPAddress, hostname Hostname) []IPAddress {
 				res = append(res, pod.IP)
 			}
 		}
+		// Software that registers itself by hostname looks up its own hostname
+		// during startup, before the pod is ready.
+		self := network.IPToPod[sourceIp]
+		if self.isOwnHostname(hostname) && !slices.Contains(res, self.IP) {
+			res = append(res, self.IP)
+		}
 	}
 	return res
 }
 
+// isOwnHostname returns true when the hostname is the hostname of the pod, either with
+// or without its subdomain.
+func (pod *Pod) isOwnHostname(hostname Hostname) bool {
+	if pod.Hostname == "" {
+		return false
+	}
+	shortname, _, _ := strings.Cut(string(pod.Hostname), ".")
+	return hostname == pod.Hostname || string(hostname) == shortname
+}
+
 func (net *Networks) ReverseLookup(sourceIp IPAddress, ip IPAddress) []Hostname {
 	if strings.HasPrefix(string(sourceIp), UNKNOWN_IP_PREFIX) {
 		return nil
@@ -269,15 +424,54 @@ func (pods *Pods) AddOrUpdate(pod *Pod) bool {
 }
 
 func (pods *Pods) Get(namespace, name string) *Pod {
+	pods.mutex.RLock()
+	defer pods.mutex.RUnlock()
+
 	pod, _ := pods.Pods.Get(namespace + "/" + name)
 	return pod
 }
 
-func (pods *Pods) Delete(namespace, name string) {
+// Delete deletes a pod and returns true when it existed.
+func (pods *Pods) Delete(namespace, name string) bool {
+	pods.mutex.Lock()
+	defer pods.mutex.Unlock()
+
+	return pods.Pods.Delete(namespace + "/" + name)
+}
+
+// SetServiceMembers replaces the members of a service. Without members, the service is
+// removed. Returns true when the members were changed.
+func (pods *Pods) SetServiceMembers(namespace string, service string, members []*Pod) bool {
 	pods.mutex.Lock()
 	defer pods.mutex.Unlock()
 
-	pods.Pods.Delete(namespace + "/" + name)
+	changed := false
+	desired := make(map[string]*Pod)
+	for _, member := range members {
+		desired[member.Namespace+"/"+member.Name] = member
+	}
+	removed := make([]string, 0)
+	for key, pod := range pods.Pods.Iter() {
+		if pod.Namespace == namespace && pod.Service == service && desired[key] == nil {
+			removed = append(removed, key)
+		}
+	}
+	for _, key := range removed {
+		pods.Pods.Delete(key)
+		changed = true
+	}
+	// sorted for a deterministic insertion order.
+	for _, key := range slices.Sorted(maps.Keys(desired)) {
+		member := desired[key]
+		if oldmember, _ := pods.Pods.Get(key); oldmember == nil || !oldmember.Equal(member) {
+			pods.Pods.Put(key, member.Copy())
+			changed = true
+		}
+	}
+	if changed {
+		klog.Infof("%s/%s: service members updated", namespace, service)
+	}
+	return changed
 }
 
 type PodErrors struct {
@@ -310,6 +504,43 @@ func (e *PodErrors) FirstError(pod *Pod) error {
 	return nil
 }
 
+// AddAndValidate adds or updates the pod and returns the resulting networks. When the
+// pod has an error in these networks or exceeds the quotas, it is deleted again and the
+// error is returned. Pods that were admitted before are not subject to quotas, so that
+// lowering a quota does not affect running pods.
+//
+// Because of concurrency, other pods can have been added concurrently. But the order of
+// adding pods to the network is deterministic because of how LinkedMap works by adding
+// all pods to the network in the same order one by one.
+//
+// Errors from other pods are ignored. In this design, only pods with a valid network
+// config can be added, so errors in other pods should never occur.
+//
+// With more than one replica we cannot 100% guarantee that invalid pods will be
+// rejected, but in practice it should be close to 100%
+func (pods *Pods) AddAndValidate(pod *Pod, quotas config.Quotas) (*Networks, error) {
+	existing := pods.Get(pod.Namespace, pod.Name)
+	admitted := existing != nil && !existing.HasUnknownIP()
+	pods.AddOrUpdate(pod)
+	networks, podErrors := pods.Networks()
+	var err error
+	if podErrors != nil {
+		err = podErrors.FirstError(pod)
+	}
+	if err == nil && !admitted {
+		err = networks.CheckQuotas(pod, quotas)
+		var quotaError *QuotaError
+		if errors.As(err, &quotaError) {
+			metrics.QuotaRejections.WithLabelValues(quotaError.Quota).Inc()
+		}
+	}
+	if err == nil {
+		return networks, nil
+	}
+	pods.Delete(pod.Namespace, pod.Name)
+	return nil, err
+}
+
 func (pods *Pods) Networks() (*Networks, *PodErrors) {
 	pods.mutex.RLock()
 	defer pods.mutex.RUnlock()
@@ -1,10 +1,15 @@
 package model
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 	"slices"
 	"testing"
+	"time"
+	"wamblee.org/kubedock/dns/internal/config"
 	"wamblee.org/kubedock/dns/internal/support"
 )
 
@@ -44,14 +49,14 @@ func (s *NetworkTestSuite) checkNetwork(network *Network) {
 
 func (s *NetworkTestSuite) checkNetworks(networks *Networks) {
 
-	networkNames := make(map[NetworkId]*Network)
+	networkNames := make(map[NetworkKey]*Network)
 
 	for ip, networkMap := range networks.IpToNetworks {
 
 		// * for every IP, the networks in the value must contain the IP
 		for networkId, network := range networkMap {
 			networkNames[networkId] = network
-			s.Equal(networkId, network.Id)
+			s.Equal(networkId, network.Key())
 			// the IP must be in the network
 			s.NotNil(network.IPToPod[ip])
 			// Every IP contained in the network must be in IP to Network map
@@ -944,3 +949,345 @@ func (s *NetworkTestSuite) Test_UpdatePodReadyStatus() {
 
 	s.False(s.pods.AddOrUpdate(pod3))
 }
+
+func (s *NetworkTestSuite) Test_NetworksIsolatedPerNamespace() {
+	for _, podInfo := range []struct {
+		ip        string
+		namespace string
+		host      string
+	}{
+		{"a", "team-a", "db"},
+		{"b", "team-a", "service"},
+		{"c", "team-b", "db"},
+		{"d", "team-b", "service"},
+	} {
+		pod, err := NewPod(IPAddress(podInfo.ip), podInfo.namespace, podInfo.host,
+			[]Hostname{Hostname(podInfo.host)}, []NetworkId{"test1"}, true)
+		s.Require().Nil(err)
+		s.pods.AddOrUpdate(pod)
+	}
+	networks, err := s.pods.Networks()
+	s.Nil(err)
+	s.checkNetworks(networks)
+
+	s.Equal(2, len(networks.NameToNetwork))
+	s.Equal([]IPAddress{"a"}, networks.Lookup("b", "db"))
+	s.Equal([]IPAddress{"c"}, networks.Lookup("d", "db"))
+	s.Equal([]Hostname{"db"}, networks.ReverseLookup("b", "a"))
+	s.Nil(networks.ReverseLookup("b", "c"))
+	s.Equal("team-a", networks.PodNamespace("b"))
+	s.Equal("team-b", networks.PodNamespace("d"))
+	s.Equal("", networks.PodNamespace("e"))
+}
+
+func (s *NetworkTestSuite) Test_GlobalNetworksAreShared() {
+	for _, podInfo := range []struct {
+		ip        string
+		namespace string
+		host      string
+		network   NetworkId
+	}{
+		{"a", "team-a", "service", "test1"},
+		{"b", "team-b", "service", "test1"},
+		{"c", "fixtures", "ldap", "global:fixtures"},
+	} {
+		pod, err := NewPod(IPAddress(podInfo.ip), podInfo.namespace, podInfo.host,
+			[]Hostname{Hostname(podInfo.host)}, []NetworkId{podInfo.network, "global:fixtures"}, true)
+		s.Require().Nil(err)
+		s.pods.AddOrUpdate(pod)
+	}
+	networks, err := s.pods.Networks()
+	s.Nil(err)
+	s.checkNetworks(networks)
+
+	s.Equal(3, len(networks.NameToNetwork))
+	global := networks.NameToNetwork[NewNetworkKey("team-a", "global:fixtures")]
+	s.Require().NotNil(global)
+	s.Equal("global:fixtures", global.Key().String())
+	s.Equal(3, len(global.IPToPod))
+	s.Equal([]IPAddress{"c"}, networks.Lookup("a", "ldap"))
+	s.Equal([]IPAddress{"c"}, networks.Lookup("b", "ldap"))
+	s.Equal("team-b", networks.PodNamespace("b"))
+}
+
+func (s *NetworkTestSuite) Test_GlobalNetworkPolicy() {
+	podConfig := config.PodConfig{
+		GlobalNetworks: map[string][]string{
+			"fixtures": {"team-a"},
+			"shared":   {},
+		},
+	}
+	check := func(namespace string, network NetworkId) error {
+		pod, err := NewPod("a", namespace, "pod", []Hostname{"db"}, []NetworkId{"test", network}, true)
+		s.Require().Nil(err)
+		return CheckGlobalNetworks(pod, podConfig)
+	}
+	s.Nil(check("team-a", "global:fixtures"))
+	s.NotNil(check("team-b", "global:fixtures"))
+	s.Nil(check("team-b", "global:shared"))
+	s.NotNil(check("team-b", "global:other"))
+	podConfig.UndeclaredGlobalNetworks = true
+	s.Nil(check("team-b", "global:other"))
+	s.NotNil(check("team-b", "global:fixtures"))
+	// not global
+	s.Nil(check("team-b", "fixtures"))
+
+	s.Equal(NetworkId("global:fixtures"), GlobalNetworkId("fixtures", podConfig))
+	s.Equal(NetworkId("test"), GlobalNetworkId("test", podConfig))
+}
+
+func (s *NetworkTestSuite) Test_ServiceMembers() {
+	pod, err := NewPod("a", "kubedock", "ldap", []Hostname{"service"}, []NetworkId{"test"}, true)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+	member := func(ip IPAddress) *Pod {
+		member, err := NewServiceMember(ip, "kubedock", "ldap", []Hostname{"ldap"}, []NetworkId{"test"})
+		s.Require().Nil(err)
+		s.True(member.IsService())
+		return member
+	}
+
+	s.True(s.pods.SetServiceMembers("kubedock", "ldap", []*Pod{member("b"), member("c")}))
+	s.False(s.pods.SetServiceMembers("kubedock", "ldap", []*Pod{member("c"), member("b")}))
+	networks, errs := s.pods.Networks()
+	s.Nil(errs)
+	s.checkNetworks(networks)
+	s.Equal([]IPAddress{"b", "c"}, networks.Lookup("a", "ldap"))
+
+	s.True(s.pods.SetServiceMembers("kubedock", "ldap", []*Pod{member("d")}))
+	networks, _ = s.pods.Networks()
+	s.Equal([]IPAddress{"d"}, networks.Lookup("a", "ldap"))
+
+	// the pod with the same name as the service is not affected.
+	s.True(s.pods.SetServiceMembers("kubedock", "ldap", nil))
+	s.Equal(1, s.pods.Pods.Len())
+	s.False(s.pods.Get("kubedock", "ldap").IsService())
+}
+
+func (s *NetworkTestSuite) Test_OwnHostnameResolvesBeforeReady() {
+	kafka, err := NewPod("a", "kubedock", "kafka", []Hostname{"kafka.test", "broker"}, []NetworkId{"test"}, false)
+	s.Require().Nil(err)
+	kafka.Hostname = "kafka.test"
+	client, err := NewPod("b", "kubedock", "client", []Hostname{"client"}, []NetworkId{"test"}, true)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(kafka)
+	s.pods.AddOrUpdate(client)
+	networks, errs := s.pods.Networks()
+	s.Nil(errs)
+
+	s.Equal([]IPAddress{"a"}, networks.Lookup("a", "kafka.test"))
+	s.Equal([]IPAddress{"a"}, networks.Lookup("a", "kafka"))
+	s.Equal([]IPAddress{}, networks.Lookup("a", "broker"))
+	s.Equal([]IPAddress{}, networks.Lookup("b", "kafka.test"))
+	s.Equal([]IPAddress{}, networks.Lookup("b", "kafka"))
+
+	kafka = kafka.Copy()
+	kafka.Ready = true
+	s.pods.AddOrUpdate(kafka)
+	networks, _ = s.pods.Networks()
+	s.Equal([]IPAddress{"a"}, networks.Lookup("a", "kafka.test"))
+	s.Equal([]IPAddress{"a"}, networks.Lookup("b", "kafka.test"))
+	s.Equal([]IPAddress{}, networks.Lookup("b", "kafka"))
+}
+
+func (s *NetworkTestSuite) Test_Hostname() {
+	podConfig := config.PodConfig{
+		HostAliasPrefix: "kubedock.hostalias/",
+		NetworkIdPrefix: "kubedock.network/",
+		LabelName:       "kubedock",
+		SetHostname:     true,
+	}
+	hostname := func(annotations map[string]string, spec corev1.PodSpec) Hostname {
+		annotations["kubedock.network/0"] = "test"
+		k8spod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "kubedock",
+				Name:        "pod",
+				Labels:      map[string]string{"kubedock": "true"},
+				Annotations: annotations,
+			},
+			Spec: spec,
+		}
+		pod, err := GetPodEssentials(k8spod, "a", podConfig)
+		s.Require().Nil(err)
+		return pod.Hostname
+	}
+	aliases := map[string]string{
+		"kubedock.hostalias/1": "zookeeper",
+		"kubedock.hostalias/0": "kafka",
+	}
+	s.Equal(Hostname("kafka"), hostname(aliases, corev1.PodSpec{}))
+	s.Equal(Hostname("zookeeper"), hostname(map[string]string{
+		"kubedock.hostalias/0":       "kafka",
+		"kubedock.hostalias/primary": "zookeeper",
+	}, corev1.PodSpec{}))
+	// the suffixes of the annotation keys are ordered numerically
+	s.Equal(Hostname("kafka"), hostname(map[string]string{
+		"kubedock.hostalias/10": "zookeeper",
+		"kubedock.hostalias/2":  "kafka",
+	}, corev1.PodSpec{}))
+	s.Equal(Hostname("kafka.test"), hostname(map[string]string{
+		"kubedock.hostalias/0": "kafka.test",
+	}, corev1.PodSpec{}))
+	// not usable as hostname
+	s.Equal(Hostname(""), hostname(map[string]string{
+		"kubedock.hostalias/0": "kafka.test.local",
+	}, corev1.PodSpec{}))
+	s.Equal(Hostname(""), hostname(map[string]string{
+		"kubedock.hostalias/0": "Kafka",
+	}, corev1.PodSpec{}))
+	// hostname of the pod is kept
+	s.Equal(Hostname("web-0.nginx"), hostname(aliases, corev1.PodSpec{Hostname: "web-0", Subdomain: "nginx"}))
+
+	podConfig.SetHostname = false
+	s.Equal(Hostname(""), hostname(aliases, corev1.PodSpec{}))
+}
+
+func (s *NetworkTestSuite) Test_Expiry() {
+	expiry := func(value string) time.Time {
+		k8spod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "kubedock",
+				Name:      "pod",
+				Labels:    map[string]string{"kubedock": "true"},
+				Annotations: map[string]string{
+					"kubedock.hostalias/0": "db",
+					"kubedock.network/0":   "test",
+					EXPIRES_ANNOTATION:     value,
+				},
+			},
+		}
+		if value == "" {
+			delete(k8spod.Annotations, EXPIRES_ANNOTATION)
+		}
+		pod, err := GetPodEssentials(k8spod, "a", config.PodConfig{
+			HostAliasPrefix:   "kubedock.hostalias/",
+			NetworkIdPrefix:   "kubedock.network/",
+			LabelName:         "kubedock",
+			ExpiresAnnotation: EXPIRES_ANNOTATION,
+		})
+		s.Require().Nil(err)
+		return pod.Expires
+	}
+	s.True(expiry("").IsZero())
+	s.True(expiry("tomorrow").IsZero())
+	s.Equal(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), expiry("2025-03-01T12:00:00Z").UTC())
+}
+
+func (s *NetworkTestSuite) Test_InternalNetworks() {
+	pods := NewPods()
+	add := func(ip string, name string, internal string, networks ...string) {
+		annotations := map[string]string{
+			"kubedock.hostalias/0":       name,
+			INTERNAL_NETWORKS_ANNOTATION: internal,
+		}
+		for i, network := range networks {
+			annotations[fmt.Sprintf("kubedock.network/%d", i)] = network
+		}
+		pod, err := GetPodEssentials(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "kubedock",
+				Name:        name,
+				Labels:      map[string]string{"kubedock": "true"},
+				Annotations: annotations,
+			},
+		}, ip, config.PodConfig{
+			HostAliasPrefix:            "kubedock.hostalias/",
+			NetworkIdPrefix:            "kubedock.network/",
+			LabelName:                  "kubedock",
+			InternalNetworksAnnotation: INTERNAL_NETWORKS_ANNOTATION,
+		})
+		s.Require().Nil(err)
+		pods.AddOrUpdate(pod)
+	}
+	// networks that the pod is not a member of are ignored.
+	add("10.0.0.1", "db", "offline, other", "offline")
+	add("10.0.0.2", "service", "offline", "offline")
+	add("10.0.0.3", "proxy", "offline", "offline", "online")
+	// pods that are not running yet are not taken into account.
+	add(UNKNOWN_IP_PREFIX+"1", "web", "", "offline")
+
+	s.Equal([]NetworkId{"offline"}, pods.Get("kubedock", "db").InternalNetworks)
+	s.Nil(pods.Get("kubedock", "web").InternalNetworks)
+	networks, errs := pods.Networks()
+	s.Nil(errs)
+	s.True(networks.NameToNetwork[NewNetworkKey("kubedock", "offline")].Internal)
+	s.False(networks.NameToNetwork[NewNetworkKey("kubedock", "online")].Internal)
+	s.True(networks.OnlyInternal("10.0.0.1"))
+	s.True(networks.OnlyInternal("10.0.0.2"))
+	s.False(networks.OnlyInternal("10.0.0.3"))
+	s.False(networks.OnlyInternal("10.0.0.4"))
+
+	// a network is only internal when all its pods agree.
+	add("10.0.0.4", "web", "", "offline")
+	networks, errs = pods.Networks()
+	s.Nil(errs)
+	s.False(networks.NameToNetwork[NewNetworkKey("kubedock", "offline")].Internal)
+	s.False(networks.OnlyInternal("10.0.0.1"))
+
+	// the annotation can be disabled.
+	pod, err := GetPodEssentials(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kubedock",
+			Name:      "db",
+			Labels:    map[string]string{"kubedock": "true"},
+			Annotations: map[string]string{
+				"kubedock.hostalias/0":       "db",
+				"kubedock.network/0":         "offline",
+				INTERNAL_NETWORKS_ANNOTATION: "offline",
+			},
+		},
+	}, "10.0.0.1", config.PodConfig{
+		HostAliasPrefix: "kubedock.hostalias/",
+		NetworkIdPrefix: "kubedock.network/",
+		LabelName:       "kubedock",
+	})
+	s.Require().Nil(err)
+	s.Nil(pod.InternalNetworks)
+}
+
+func (s *NetworkTestSuite) Test_SplitHostname() {
+	split := func(hostalias Hostname) []string {
+		hostname, subdomain, err := SplitHostname(hostalias)
+		if err != nil {
+			return nil
+		}
+		return []string{hostname, subdomain}
+	}
+	s.Equal([]string{"kafka", ""}, split("kafka"))
+	s.Equal([]string{"kafka", "test"}, split("kafka.test"))
+	s.Nil(split("kafka.test.local"))
+	s.Nil(split("kafka_1"))
+}
+
+func (s *NetworkTestSuite) Test_View() {
+	db, _ := s.createPod("a", []string{"db", "database"}, []string{"test", "other"}, true)
+	service, _ := s.createPod("b", []string{"service"}, []string{"test"}, false)
+	service.Hostname = "service.test"
+	db2, _ := s.createPod("c", []string{"db"}, []string{"test"}, true)
+	for _, pod := range []*Pod{db, service, db2} {
+		s.pods.AddOrUpdate(pod)
+	}
+	networks, _ := s.pods.Networks()
+
+	s.Equal(map[NetworkKey]NetworkView{
+		NewNetworkKey("kubedock", "test"): {
+			"db":       {"a", "c"},
+			"database": {"a"},
+		},
+		NewNetworkKey("kubedock", "other"): {
+			"db":       {"a"},
+			"database": {"a"},
+		},
+	}, networks.View("a"))
+	// the own hostname is resolvable before the pod is ready.
+	s.Equal(map[NetworkKey]NetworkView{
+		NewNetworkKey("kubedock", "test"): {
+			"db":           {"a", "c"},
+			"database":     {"a"},
+			"service":      {"b"},
+			"service.test": {"b"},
+		},
+	}, networks.View("b"))
+	s.Empty(networks.View("unknown"))
+}
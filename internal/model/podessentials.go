@@ -1,11 +1,19 @@
 package model
 
 import (
+	"cmp"
 	"fmt"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog/v2"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/support"
 )
 
 func GetPodEssentials(k8spod *corev1.Pod, overrideIP string,
@@ -16,7 +24,9 @@ func GetPodEssentials(k8spod *corev1.Pod, overrideIP string,
 			k8spod.Namespace, k8spod.Name)
 	}
 
-	if k8spod.Labels[podConfig.LabelName] != "true" {
+	labeled := k8spod.Labels[podConfig.LabelName] == "true"
+	definedHostaliases, definedNetworks := lookupNetworkDefinitions(k8spod, podConfig)
+	if !labeled && len(definedNetworks) == 0 {
 		return nil, fmt.Errorf("%s/%s: Pod does not have label %s set to 'true'",
 			k8spod.Namespace, k8spod.Name, podConfig.LabelName)
 	}
@@ -26,17 +36,13 @@ func GetPodEssentials(k8spod *corev1.Pod, overrideIP string,
 		podIP = overrideIP
 	}
 
-	networks := make([]NetworkId, 0)
-	hostaliases := make([]Hostname, 0)
-
-	for key, value := range k8spod.Annotations {
-		if strings.HasPrefix(key, podConfig.HostAliasPrefix) {
-			hostaliases = append(hostaliases, Hostname(value))
-		} else if strings.HasPrefix(key, podConfig.NetworkIdPrefix) {
-			networks = append(networks, NetworkId(value))
-		}
+	hostaliases, networks := getNetworkConfig(k8spod.Annotations, podConfig)
+	if !labeled {
+		// annotations are only used for kubedock pods.
+		hostaliases, networks = nil, nil
 	}
-
+	hostaliases = append(hostaliases, definedHostaliases...)
+	networks = append(networks, definedNetworks...)
 	klog.Infof("%s/%s: hostaliases %v, networks %v",
 		k8spod.Namespace, k8spod.Name, hostaliases, networks)
 	if len(networks) == 0 || len(hostaliases) == 0 {
@@ -62,6 +68,201 @@ func GetPodEssentials(k8spod *corev1.Pod, overrideIP string,
 		networks,
 		ready,
 	)
+	if err != nil {
+		return nil, err
+	}
+	// the first host alias is the primary host alias
+	pod.Hostname = getHostname(k8spod, hostaliases[0], podConfig)
+	pod.UID = k8spod.UID
+	pod.Expires = getExpiry(k8spod, podConfig)
+	pod.InternalNetworks = getInternalNetworks(k8spod, pod.Networks, podConfig)
+	return pod, nil
+}
+
+// Default annotation with the time in RFC 3339 format after which the networks of a pod
+// may be cleaned up.
+const EXPIRES_ANNOTATION = "kubedock-dns/expires"
+
+// getExpiry returns the expiry of the pod, which is zero when not set or invalid.
+func getExpiry(k8spod *corev1.Pod, podConfig config.PodConfig) time.Time {
+	if podConfig.ExpiresAnnotation == "" {
+		return time.Time{}
+	}
+	value, ok := k8spod.Annotations[podConfig.ExpiresAnnotation]
+	if !ok {
+		return time.Time{}
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		klog.Warningf("%s/%s: ignoring invalid expiry '%s': %v", k8spod.Namespace, k8spod.Name, value, err)
+		return time.Time{}
+	}
+	return expires
+}
+
+// Default annotation with a comma separated list of networks of the pod that are internal,
+// as docker networks created with '--internal'.
+const INTERNAL_NETWORKS_ANNOTATION = "kubedock-dns/internal-networks"
+
+// getInternalNetworks returns the networks of the pod that are annotated as internal.
+// Networks that the pod is not a member of are ignored.
+func getInternalNetworks(k8spod *corev1.Pod, networks []NetworkId,
+	podConfig config.PodConfig) []NetworkId {
+	if podConfig.InternalNetworksAnnotation == "" {
+		return nil
+	}
+	value := k8spod.Annotations[podConfig.InternalNetworksAnnotation]
+	if value == "" {
+		return nil
+	}
+	res := make([]NetworkId, 0)
+	for _, network := range strings.Split(value, ",") {
+		id := GlobalNetworkId(strings.TrimSpace(network), podConfig)
+		if !slices.Contains(networks, id) {
+			klog.Warningf("%s/%s: ignoring internal network '%s' that is not a network of the pod",
+				k8spod.Namespace, k8spod.Name, id)
+			continue
+		}
+		res = append(res, id)
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// Annotation key suffix, appended to the host alias prefix, of the primary host alias.
+const PRIMARY_HOST_ALIAS = "primary"
+
+// getHostname returns the hostname of the pod when hostnames are set. This is the
+// hostname from the pod spec when the pod defines it, and otherwise the primary host
+// alias if it can be used as hostname.
+func getHostname(k8spod *corev1.Pod, primary Hostname, podConfig config.PodConfig) Hostname {
+	if !podConfig.SetHostname {
+		return ""
+	}
+	if k8spod.Spec.Hostname != "" {
+		if k8spod.Spec.Subdomain != "" {
+			return Hostname(k8spod.Spec.Hostname + "." + k8spod.Spec.Subdomain)
+		}
+		return Hostname(k8spod.Spec.Hostname)
+	}
+	if _, _, err := SplitHostname(primary); err != nil {
+		klog.V(2).Infof("%s/%s: %v", k8spod.Namespace, k8spod.Name, err)
+		return ""
+	}
+	return primary
+}
+
+// SplitHostname splits a host alias into the hostname and subdomain fields of a pod spec.
+// Both must be DNS labels so the host alias can have at most two labels.
+func SplitHostname(hostalias Hostname) (string, string, error) {
+	labels := strings.Split(string(hostalias), ".")
+	if len(labels) > 2 {
+		return "", "", fmt.Errorf("host alias '%s' cannot be used as hostname, it has more than 2 labels",
+			hostalias)
+	}
+	for _, label := range labels {
+		if errs := validation.IsDNS1123Label(label); len(errs) > 0 {
+			return "", "", fmt.Errorf("host alias '%s' cannot be used as hostname: %s",
+				hostalias, strings.Join(errs, ", "))
+		}
+	}
+	if len(labels) == 1 {
+		return labels[0], "", nil
+	}
+	return labels[0], labels[1], nil
+}
 
-	return pod, err
+// getNetworkConfig returns the host aliases and networks from the annotations. The host
+// aliases are ordered by the suffix of their annotation key, numerically for numbers, except
+// for the primary host alias which is first.
+func getNetworkConfig(annotations map[string]string, podConfig config.PodConfig) ([]Hostname, []NetworkId) {
+	networks := make([]NetworkId, 0)
+	hostaliases := make([]Hostname, 0)
+
+	primaryKey := podConfig.HostAliasPrefix + PRIMARY_HOST_ALIAS
+	if primary, ok := annotations[primaryKey]; ok {
+		hostaliases = append(hostaliases, Hostname(primary))
+	}
+	for _, key := range slices.SortedFunc(maps.Keys(annotations), compareAnnotationKeys) {
+		value := annotations[key]
+		if key == primaryKey {
+			continue
+		}
+		if strings.HasPrefix(key, podConfig.HostAliasPrefix) {
+			hostaliases = append(hostaliases, Hostname(value))
+		} else if strings.HasPrefix(key, podConfig.NetworkIdPrefix) {
+			networks = append(networks, GlobalNetworkId(value, podConfig))
+		}
+	}
+	return hostaliases, networks
+}
+
+// compareAnnotationKeys orders annotation keys such as 'kubedock.hostalias/2' before
+// 'kubedock.hostalias/10'. Keys that only differ in a numeric suffix are compared
+// numerically, all others as strings.
+func compareAnnotationKeys(a string, b string) int {
+	prefixA, numberA, okA := splitNumericSuffix(a)
+	prefixB, numberB, okB := splitNumericSuffix(b)
+	if !okA || !okB || prefixA != prefixB {
+		return strings.Compare(a, b)
+	}
+	return cmp.Or(cmp.Compare(numberA, numberB), strings.Compare(a, b))
+}
+
+// splitNumericSuffix splits a key into the part before its trailing digits and the number
+// formed by these digits.
+func splitNumericSuffix(key string) (string, int, bool) {
+	prefix := strings.TrimRightFunc(key, unicode.IsDigit)
+	number, err := strconv.Atoi(key[len(prefix):])
+	if err != nil {
+		return key, 0, false
+	}
+	return prefix, number, true
+}
+
+// lookupNetworkDefinitions returns the host aliases and networks of the network definitions
+// that match the pod.
+func lookupNetworkDefinitions(k8spod *corev1.Pod, podConfig config.PodConfig) ([]Hostname, []NetworkId) {
+	if podConfig.NetworkDefinitions == nil {
+		return nil, nil
+	}
+	hostaliases, networks := podConfig.NetworkDefinitions.Lookup(k8spod)
+	toHostname := func(hostalias string) Hostname {
+		return Hostname(hostalias)
+	}
+	toNetworkId := func(network string) NetworkId {
+		return GlobalNetworkId(network, podConfig)
+	}
+	return support.MapSlice(hostaliases, toHostname), support.MapSlice(networks, toNetworkId)
+}
+
+// GlobalNetworkId returns the id of the network, which includes the global prefix for
+// networks that are configured to be global.
+func GlobalNetworkId(network string, podConfig config.PodConfig) NetworkId {
+	if _, global := podConfig.GlobalNetworks[network]; global {
+		return NetworkId(GLOBAL_NETWORK_PREFIX + network)
+	}
+	return NetworkId(network)
+}
+
+// CheckGlobalNetworks verifies that the namespace of the pod may join the global networks
+// of the pod. Networks that are only global because of their prefix are rejected unless
+// undeclared global networks are allowed, these may then be joined by all namespaces.
+func CheckGlobalNetworks(pod *Pod, podConfig config.PodConfig) error {
+	for _, network := range pod.Networks {
+		if !network.IsGlobal() {
+			continue
+		}
+		name := strings.TrimPrefix(string(network), GLOBAL_NETWORK_PREFIX)
+		namespaces, declared := podConfig.GlobalNetworks[name]
+		if !declared && !podConfig.UndeclaredGlobalNetworks {
+			return fmt.Errorf("%s/%s: global network '%s' is not declared, declared global networks are %v",
+				pod.Namespace, pod.Name, name, slices.Sorted(maps.Keys(podConfig.GlobalNetworks)))
+		}
+		if len(namespaces) > 0 && !slices.Contains(namespaces, pod.Namespace) {
+			return fmt.Errorf("%s/%s: namespace %s may not join global network '%s', allowed namespaces are %v",
+				pod.Namespace, pod.Name, pod.Namespace, name, namespaces)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,122 @@
+package model
+
+import (
+	"fmt"
+	"wamblee.org/kubedock/dns/internal/config"
+)
+
+// Names of the quotas as used in metrics.
+const (
+	QUOTA_PODS_PER_NETWORK       = "pods_per_network"
+	QUOTA_NETWORKS_PER_NAMESPACE = "networks_per_namespace"
+	QUOTA_HOST_ALIASES_PER_POD   = "host_aliases_per_pod"
+	QUOTA_NETWORKS_PER_POD       = "networks_per_pod"
+)
+
+// QuotaError is the error for a pod or network that would exceed a quota.
+type QuotaError struct {
+	Quota string
+	Err   error
+}
+
+func (err *QuotaError) Error() string {
+	return err.Err.Error()
+}
+
+// QuotaLimits returns the configured limit of each quota, zero means unlimited.
+func QuotaLimits(quotas config.Quotas) map[string]int {
+	return map[string]int{
+		QUOTA_PODS_PER_NETWORK:       quotas.PodsPerNetwork,
+		QUOTA_NETWORKS_PER_NAMESPACE: quotas.NetworksPerNamespace,
+		QUOTA_HOST_ALIASES_PER_POD:   quotas.HostAliasesPerPod,
+		QUOTA_NETWORKS_PER_POD:       quotas.NetworksPerPod,
+	}
+}
+
+func exceeded(limit int, usage int) bool {
+	return limit > 0 && usage > limit
+}
+
+// CheckQuotas verifies that a pod that was added to the networks does not exceed the
+// quotas. A pod only exceeds the number of networks of a namespace when it creates a new
+// network. Services are not counted as pods.
+func (net *Networks) CheckQuotas(pod *Pod, quotas config.Quotas) error {
+	if exceeded(quotas.HostAliasesPerPod, len(pod.HostAliases)) {
+		return &QuotaError{Quota: QUOTA_HOST_ALIASES_PER_POD, Err: fmt.Errorf(
+			"%s/%s: pod has %d host aliases, the maximum is %d",
+			pod.Namespace, pod.Name, len(pod.HostAliases), quotas.HostAliasesPerPod)}
+	}
+	if exceeded(quotas.NetworksPerPod, len(pod.Networks)) {
+		return &QuotaError{Quota: QUOTA_NETWORKS_PER_POD, Err: fmt.Errorf(
+			"%s/%s: pod is in %d networks, the maximum is %d",
+			pod.Namespace, pod.Name, len(pod.Networks), quotas.NetworksPerPod)}
+	}
+	for _, id := range pod.Networks {
+		key := NewNetworkKey(pod.Namespace, id)
+		network := net.NameToNetwork[key]
+		if network == nil {
+			continue
+		}
+		if pods := network.pods(); exceeded(quotas.PodsPerNetwork, pods) {
+			return &QuotaError{Quota: QUOTA_PODS_PER_NETWORK, Err: fmt.Errorf(
+				"%s/%s: network '%s' would have %d pods, the maximum is %d",
+				pod.Namespace, pod.Name, id, pods, quotas.PodsPerNetwork)}
+		}
+		if len(network.IPToPod) > 1 || key.Namespace == "" {
+			continue
+		}
+		if networks := net.namespaceNetworks()[pod.Namespace]; exceeded(quotas.NetworksPerNamespace, networks) {
+			return &QuotaError{Quota: QUOTA_NETWORKS_PER_NAMESPACE, Err: fmt.Errorf(
+				"%s/%s: namespace %s would have %d networks, the maximum is %d",
+				pod.Namespace, pod.Name, pod.Namespace, networks, quotas.NetworksPerNamespace)}
+		}
+	}
+	return nil
+}
+
+// pods returns the number of pods in the network.
+func (network *Network) pods() int {
+	count := 0
+	for _, pod := range network.IPToPod {
+		if !pod.IsService() {
+			count++
+		}
+	}
+	return count
+}
+
+// namespaceNetworks returns the number of networks by namespace, global networks are not
+// counted.
+func (net *Networks) namespaceNetworks() map[string]int {
+	res := make(map[string]int)
+	for key := range net.NameToNetwork {
+		if key.Namespace != "" {
+			res[key.Namespace]++
+		}
+	}
+	return res
+}
+
+// QuotaUsage returns the highest usage of each quota.
+func (net *Networks) QuotaUsage() map[string]int {
+	res := map[string]int{
+		QUOTA_PODS_PER_NETWORK:       0,
+		QUOTA_NETWORKS_PER_NAMESPACE: 0,
+		QUOTA_HOST_ALIASES_PER_POD:   0,
+		QUOTA_NETWORKS_PER_POD:       0,
+	}
+	for _, network := range net.NameToNetwork {
+		res[QUOTA_PODS_PER_NETWORK] = max(res[QUOTA_PODS_PER_NETWORK], network.pods())
+		for _, pod := range network.IPToPod {
+			if pod.IsService() {
+				continue
+			}
+			res[QUOTA_HOST_ALIASES_PER_POD] = max(res[QUOTA_HOST_ALIASES_PER_POD], len(pod.HostAliases))
+			res[QUOTA_NETWORKS_PER_POD] = max(res[QUOTA_NETWORKS_PER_POD], len(pod.Networks))
+		}
+	}
+	for _, count := range net.namespaceNetworks() {
+		res[QUOTA_NETWORKS_PER_NAMESPACE] = max(res[QUOTA_NETWORKS_PER_NAMESPACE], count)
+	}
+	return res
+}
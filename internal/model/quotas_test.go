@@ -0,0 +1,94 @@
+package model
+
+import (
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"wamblee.org/kubedock/dns/internal/config"
+)
+
+type QuotasTestSuite struct {
+	suite.Suite
+
+	pods *Pods
+}
+
+func (s *QuotasTestSuite) SetupTest() {
+	s.pods = NewPods()
+}
+
+func TestQuotasTestSuite(t *testing.T) {
+	suite.Run(t, &QuotasTestSuite{})
+}
+
+func (s *QuotasTestSuite) add(ip string, name string, hostAliases []Hostname, networks []NetworkId,
+	quotas config.Quotas) error {
+	pod, err := NewPod(IPAddress(ip), "kubedock", name, hostAliases, networks, false)
+	s.Require().Nil(err)
+	_, err = s.pods.AddAndValidate(pod, quotas)
+	return err
+}
+
+// quota returns the quota of an error, which is empty for other errors.
+func (s *QuotasTestSuite) quota(err error) string {
+	var quotaError *QuotaError
+	if errors.As(err, &quotaError) {
+		return quotaError.Quota
+	}
+	return ""
+}
+
+func (s *QuotasTestSuite) Test_PodQuotas() {
+	quotas := config.Quotas{HostAliasesPerPod: 1, NetworksPerPod: 1}
+	err := s.add("10.0.0.1", "db", []Hostname{"db", "database"}, []NetworkId{"test"}, quotas)
+	s.Equal(QUOTA_HOST_ALIASES_PER_POD, s.quota(err))
+	s.Equal("kubedock/db: pod has 2 host aliases, the maximum is 1", err.Error())
+	s.Nil(s.pods.Get("kubedock", "db"))
+
+	err = s.add("10.0.0.1", "db", []Hostname{"db"}, []NetworkId{"test", "other"}, quotas)
+	s.Equal(QUOTA_NETWORKS_PER_POD, s.quota(err))
+	s.Nil(s.add("10.0.0.1", "db", []Hostname{"db"}, []NetworkId{"test"}, quotas))
+}
+
+func (s *QuotasTestSuite) Test_PodsPerNetwork() {
+	quotas := config.Quotas{PodsPerNetwork: 2}
+	s.Nil(s.add("10.0.0.1", "db", []Hostname{"db"}, []NetworkId{"test"}, quotas))
+	s.Nil(s.add("10.0.0.2", "service", []Hostname{"service"}, []NetworkId{"test"}, quotas))
+	err := s.add("10.0.0.3", "web", []Hostname{"web"}, []NetworkId{"other", "test"}, quotas)
+	s.Equal(QUOTA_PODS_PER_NETWORK, s.quota(err))
+	s.Equal("kubedock/web: network 'test' would have 3 pods, the maximum is 2", err.Error())
+	s.Nil(s.pods.Get("kubedock", "web"))
+
+	// services are not counted
+	member, err := NewServiceMember("10.0.0.4", "kubedock", "ldap", []Hostname{"ldap"}, []NetworkId{"test"})
+	s.Require().Nil(err)
+	s.pods.SetServiceMembers("kubedock", "ldap", []*Pod{member})
+	networks, _ := s.pods.Networks()
+	s.Equal(2, networks.QuotaUsage()[QUOTA_PODS_PER_NETWORK])
+}
+
+func (s *QuotasTestSuite) Test_NetworksPerNamespace() {
+	quotas := config.Quotas{NetworksPerNamespace: 1}
+	s.Nil(s.add("10.0.0.1", "db", []Hostname{"db"}, []NetworkId{"test"}, quotas))
+	// joining an existing network is allowed
+	s.Nil(s.add("10.0.0.2", "service", []Hostname{"service"}, []NetworkId{"test"}, quotas))
+	// global networks are not counted
+	s.Nil(s.add("10.0.0.3", "ldap", []Hostname{"ldap"}, []NetworkId{"global:shared"}, quotas))
+
+	err := s.add("10.0.0.4", "web", []Hostname{"web"}, []NetworkId{"other"}, quotas)
+	s.Equal(QUOTA_NETWORKS_PER_NAMESPACE, s.quota(err))
+	s.Equal("kubedock/web: namespace kubedock would have 2 networks, the maximum is 1", err.Error())
+}
+
+func (s *QuotasTestSuite) Test_Usage() {
+	s.Nil(s.add("10.0.0.1", "db", []Hostname{"db", "database"}, []NetworkId{"test"}, config.Quotas{}))
+	s.Nil(s.add("10.0.0.2", "service", []Hostname{"service"}, []NetworkId{"test", "other"},
+		config.Quotas{}))
+	networks, _ := s.pods.Networks()
+	s.Equal(map[string]int{
+		QUOTA_PODS_PER_NETWORK:       2,
+		QUOTA_NETWORKS_PER_NAMESPACE: 2,
+		QUOTA_HOST_ALIASES_PER_POD:   2,
+		QUOTA_NETWORKS_PER_POD:       2,
+	}, networks.QuotaUsage())
+}
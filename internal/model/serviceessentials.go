@@ -0,0 +1,57 @@
+package model
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/klog/v2"
+	"slices"
+	"wamblee.org/kubedock/dns/internal/config"
+)
+
+// GetServiceMembers returns the network members for a service that is annotated with host
+// aliases and networks in the same way as pods. The member is the cluster IP of the service,
+// or, for headless services, the ready addresses of its endpoint slices.
+func GetServiceMembers(service *corev1.Service, endpointSlices []*discoveryv1.EndpointSlice,
+	podConfig config.PodConfig) ([]*Pod, error) {
+
+	hostaliases, networks := getNetworkConfig(service.Annotations, podConfig)
+	klog.V(2).Infof("%s/%s: service hostaliases %v, networks %v",
+		service.Namespace, service.Name, hostaliases, networks)
+	if len(networks) == 0 || len(hostaliases) == 0 {
+		return nil, fmt.Errorf("%s/%s: Service not configured in DNS, either no host or no network defined",
+			service.Namespace, service.Name)
+	}
+
+	ips := make([]IPAddress, 0)
+	if service.Spec.ClusterIP != "" && service.Spec.ClusterIP != corev1.ClusterIPNone {
+		ips = append(ips, IPAddress(service.Spec.ClusterIP))
+	} else {
+		for _, endpointSlice := range endpointSlices {
+			if endpointSlice.AddressType != discoveryv1.AddressTypeIPv4 {
+				continue
+			}
+			for _, endpoint := range endpointSlice.Endpoints {
+				// nil means ready
+				if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+					continue
+				}
+				for _, address := range endpoint.Addresses {
+					ips = append(ips, IPAddress(address))
+				}
+			}
+		}
+		slices.Sort(ips)
+		ips = slices.Compact(ips)
+	}
+
+	members := make([]*Pod, 0, len(ips))
+	for _, ip := range ips {
+		member, err := NewServiceMember(ip, service.Namespace, service.Name, hostaliases, networks)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
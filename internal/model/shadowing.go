@@ -0,0 +1,64 @@
+package model
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Policies for host aliases that have the same name as a service.
+const (
+	// The host alias is resolved within the network, so the service can no longer be
+	// reached by that name from the network.
+	SHADOW_POLICY_LOCAL = "local"
+	// The service is resolved, so the host alias can no longer be reached by that name.
+	SHADOW_POLICY_SERVICE = "service"
+	// Pods with host aliases that shadow services are rejected at admission. Services
+	// that are created later are shadowed as for SHADOW_POLICY_LOCAL.
+	SHADOW_POLICY_REJECT = "reject"
+)
+
+var SHADOW_POLICIES = []string{
+	SHADOW_POLICY_LOCAL,
+	SHADOW_POLICY_SERVICE,
+	SHADOW_POLICY_REJECT,
+}
+
+// ValidateShadowPolicy verifies that the shadow policy is known.
+func ValidateShadowPolicy(policy string) error {
+	if !slices.Contains(SHADOW_POLICIES, policy) {
+		return fmt.Errorf("Unknown shadow policy '%s', expected one of %v", policy, SHADOW_POLICIES)
+	}
+	return nil
+}
+
+// ServiceName returns the service that a hostname would resolve to from a pod in the given
+// namespace, which is '<service>' in the namespace of the pod, or '<service>.<namespace>'
+// with an optional '.svc' suffix. Returns false for hostnames that cannot be a service.
+func ServiceName(namespace string, hostname Hostname) (string, string, bool) {
+	labels := strings.Split(string(hostname), ".")
+	if len(labels) == 3 && labels[2] == "svc" {
+		labels = labels[:2]
+	}
+	switch len(labels) {
+	case 1:
+		return namespace, labels[0], true
+	case 2:
+		return labels[1], labels[0], true
+	}
+	return "", "", false
+}
+
+// ResolvesToService returns true when the hostname resolves, from the source, to members of
+// the service itself. The hostname then does not shadow the service.
+func (net *Networks) ResolvesToService(sourceIp IPAddress, hostname Hostname, namespace string,
+	service string) bool {
+	for _, network := range net.IpToNetworks[sourceIp] {
+		for _, pod := range network.HostAliasToPods[hostname] {
+			if pod.Service == service && pod.Namespace == namespace {
+				return true
+			}
+		}
+	}
+	return false
+}
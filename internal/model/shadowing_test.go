@@ -0,0 +1,59 @@
+package model
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type ShadowingTestSuite struct {
+	suite.Suite
+}
+
+func TestShadowingTestSuite(t *testing.T) {
+	suite.Run(t, &ShadowingTestSuite{})
+}
+
+func (s *ShadowingTestSuite) Test_ValidateShadowPolicy() {
+	for _, policy := range SHADOW_POLICIES {
+		s.Nil(ValidateShadowPolicy(policy))
+	}
+	s.NotNil(ValidateShadowPolicy("pod"))
+	s.NotNil(ValidateShadowPolicy(""))
+}
+
+func (s *ShadowingTestSuite) Test_ServiceName() {
+	for _, test := range []struct {
+		hostname  Hostname
+		namespace string
+		service   string
+		ok        bool
+	}{
+		{"db", "kubedock", "db", true},
+		{"db.team-a", "team-a", "db", true},
+		{"db.team-a.svc", "team-a", "db", true},
+		{"db.team-a.svc.cluster.local", "", "", false},
+		{"www.example.com", "", "", false},
+	} {
+		namespace, service, ok := ServiceName("kubedock", test.hostname)
+		s.Equal(test.ok, ok, test.hostname)
+		s.Equal(test.namespace, namespace, test.hostname)
+		s.Equal(test.service, service, test.hostname)
+	}
+}
+
+func (s *ShadowingTestSuite) Test_ResolvesToService() {
+	pods := NewPods()
+	pod, err := NewPod("10.0.0.1", "kubedock", "db", []Hostname{"db"}, []NetworkId{"test"}, true)
+	s.Require().Nil(err)
+	pods.AddOrUpdate(pod)
+	member, err := NewServiceMember("10.96.0.10", "kubedock", "ldap", []Hostname{"ldap"}, []NetworkId{"test"})
+	s.Require().Nil(err)
+	pods.SetServiceMembers("kubedock", "ldap", []*Pod{member})
+	networks, _ := pods.Networks()
+
+	s.True(networks.ResolvesToService("10.0.0.1", "ldap", "kubedock", "ldap"))
+	s.False(networks.ResolvesToService("10.0.0.1", "ldap", "other", "ldap"))
+	s.False(networks.ResolvesToService("10.0.0.1", "db", "kubedock", "db"))
+	// unknown source
+	s.False(networks.ResolvesToService("10.0.0.2", "ldap", "kubedock", "ldap"))
+}
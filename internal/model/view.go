@@ -0,0 +1,45 @@
+package model
+
+import (
+	"slices"
+	"strings"
+)
+
+// NetworkView maps the host aliases that can be resolved in a network to their IPs.
+type NetworkView map[Hostname][]IPAddress
+
+// View returns what the pod with the given IP can resolve in each of its networks. This
+// is consistent with Lookup: host aliases of members that are not ready are not included,
+// except for the own hostname of the pod.
+func (net *Networks) View(sourceIp IPAddress) map[NetworkKey]NetworkView {
+	res := make(map[NetworkKey]NetworkView)
+	if strings.HasPrefix(string(sourceIp), UNKNOWN_IP_PREFIX) {
+		return res
+	}
+	for key, network := range net.IpToNetworks[sourceIp] {
+		view := make(NetworkView)
+		add := func(hostname Hostname, ip IPAddress) {
+			if !slices.Contains(view[hostname], ip) {
+				view[hostname] = append(view[hostname], ip)
+			}
+		}
+		for hostAlias, pods := range network.HostAliasToPods {
+			for _, pod := range pods {
+				if pod.Ready {
+					add(hostAlias, pod.IP)
+				}
+			}
+		}
+		self := network.IPToPod[sourceIp]
+		if self.Hostname != "" {
+			shortname, _, _ := strings.Cut(string(self.Hostname), ".")
+			add(self.Hostname, self.IP)
+			add(Hostname(shortname), self.IP)
+		}
+		for _, ips := range view {
+			slices.Sort(ips)
+		}
+		res[key] = view
+	}
+	return res
+}
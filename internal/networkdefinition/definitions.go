@@ -0,0 +1,150 @@
+package networkdefinition
+
+import (
+	"bytes"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"maps"
+	"sigs.k8s.io/yaml"
+	"slices"
+	"sync"
+	"text/template"
+)
+
+// Definition defines a network by a label selector instead of by annotations on the pods.
+// Every entry in the data of a network definition ConfigMap is a definition in YAML format:
+//
+//	network: test1
+//	selector: app in (db, ldap)
+//	hostAliases:
+//	  - "{{ .Labels.app }}"
+//
+// The host aliases are templates that are evaluated using the metadata of the pod. A
+// definition applies to pods in the namespace of the ConfigMap.
+type Definition struct {
+	Network     string   `json:"network"`
+	Selector    string   `json:"selector"`
+	HostAliases []string `json:"hostAliases"`
+}
+
+type definition struct {
+	source      string
+	namespace   string
+	network     string
+	selector    labels.Selector
+	hostAliases []*template.Template
+}
+
+// parse parses the definitions in a ConfigMap.
+func parse(configMap *corev1.ConfigMap) ([]*definition, error) {
+	definitions := make([]*definition, 0)
+	for _, key := range slices.Sorted(maps.Keys(configMap.Data)) {
+		source := configMap.Namespace + "/" + configMap.Name + "/" + key
+		var spec Definition
+		if err := yaml.UnmarshalStrict([]byte(configMap.Data[key]), &spec); err != nil {
+			return nil, fmt.Errorf("%s: Invalid network definition: %v", source, err)
+		}
+		if spec.Network == "" || spec.Selector == "" || len(spec.HostAliases) == 0 {
+			return nil, fmt.Errorf("%s: Network definition requires a network, selector, and host aliases",
+				source)
+		}
+		selector, err := labels.Parse(spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("%s: Invalid selector '%s': %v", source, spec.Selector, err)
+		}
+		def := &definition{
+			source:    source,
+			namespace: configMap.Namespace,
+			network:   spec.Network,
+			selector:  selector,
+		}
+		for i, hostAlias := range spec.HostAliases {
+			tmpl, err := template.New(fmt.Sprintf("%s/%d", source, i)).
+				Option("missingkey=zero").Parse(hostAlias)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Invalid host alias template '%s': %v", source, hostAlias, err)
+			}
+			def.hostAliases = append(def.hostAliases, tmpl)
+		}
+		definitions = append(definitions, def)
+	}
+	return definitions, nil
+}
+
+// Definitions holds the network definitions by ConfigMap. It is safe for concurrent use.
+type Definitions struct {
+	mutex sync.RWMutex
+	// maps namespace/name of the ConfigMap to its definitions
+	definitions map[string][]*definition
+}
+
+func NewDefinitions() *Definitions {
+	return &Definitions{
+		definitions: make(map[string][]*definition),
+	}
+}
+
+// Set replaces the definitions of a ConfigMap. An invalid ConfigMap is ignored as a
+// whole so that a partial configuration is never used.
+func (definitions *Definitions) Set(configMap *corev1.ConfigMap) error {
+	key := configMap.Namespace + "/" + configMap.Name
+	parsed, err := parse(configMap)
+	definitions.mutex.Lock()
+	defer definitions.mutex.Unlock()
+	if err != nil {
+		delete(definitions.definitions, key)
+		return err
+	}
+	definitions.definitions[key] = parsed
+	return nil
+}
+
+func (definitions *Definitions) Delete(namespace, name string) {
+	definitions.mutex.Lock()
+	defer definitions.mutex.Unlock()
+	delete(definitions.definitions, namespace+"/"+name)
+}
+
+// Lookup returns the host aliases and networks of the definitions that match the pod. These
+// are ordered by the namespace and name of the ConfigMap and by the key of the definition, so
+// that the primary host alias, which is the first, does not change between lookups.
+func (definitions *Definitions) Lookup(pod *corev1.Pod) ([]string, []string) {
+	definitions.mutex.RLock()
+	defer definitions.mutex.RUnlock()
+
+	hostAliases := make([]string, 0)
+	networks := make([]string, 0)
+	for _, key := range slices.Sorted(maps.Keys(definitions.definitions)) {
+		for _, def := range definitions.definitions[key] {
+			if def.namespace != pod.Namespace || !def.selector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			aliases := def.evaluate(pod)
+			if len(aliases) == 0 {
+				continue
+			}
+			hostAliases = append(hostAliases, aliases...)
+			networks = append(networks, def.network)
+		}
+	}
+	return hostAliases, networks
+}
+
+func (def *definition) evaluate(pod *corev1.Pod) []string {
+	hostAliases := make([]string, 0)
+	for _, tmpl := range def.hostAliases {
+		var hostAlias bytes.Buffer
+		if err := tmpl.Execute(&hostAlias, pod.ObjectMeta); err != nil {
+			klog.Warningf("%s: could not evaluate host alias for pod %s/%s: %v",
+				def.source, pod.Namespace, pod.Name, err)
+			continue
+		}
+		// a template can evaluate to the empty string, e.g. when a label is missing.
+		if hostAlias.Len() > 0 {
+			hostAliases = append(hostAliases, hostAlias.String())
+		}
+	}
+	return hostAliases
+}
@@ -0,0 +1,118 @@
+package networkdefinition
+
+import (
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+type DefinitionsTestSuite struct {
+	suite.Suite
+
+	definitions *Definitions
+}
+
+func (s *DefinitionsTestSuite) SetupTest() {
+	s.definitions = NewDefinitions()
+}
+
+func TestDefinitionsSuite(t *testing.T) {
+	suite.Run(t, &DefinitionsTestSuite{})
+}
+
+func (s *DefinitionsTestSuite) configMap(namespace string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "networks",
+			Namespace: namespace,
+		},
+		Data: data,
+	}
+}
+
+func (s *DefinitionsTestSuite) pod(namespace string, podLabels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod",
+			Namespace: namespace,
+			Labels:    podLabels,
+		},
+	}
+}
+
+func (s *DefinitionsTestSuite) Test_Lookup() {
+	s.Nil(s.definitions.Set(s.configMap("kubedock", map[string]string{
+		"fixtures": `
+network: test1
+selector: app in (db, ldap)
+hostAliases:
+  - "{{ .Labels.app }}"
+  - "{{ .Labels.app }}-{{ .Labels.version }}"
+`,
+		"other": `
+network: test2
+selector: tier=backend
+hostAliases: ["backend"]
+`,
+	})))
+
+	hostAliases, networks := s.definitions.Lookup(s.pod("kubedock", map[string]string{"app": "ldap"}))
+	s.Equal([]string{"ldap", "ldap-"}, hostAliases)
+	s.Equal([]string{"test1"}, networks)
+
+	hostAliases, networks = s.definitions.Lookup(s.pod("kubedock",
+		map[string]string{"app": "db", "version": "1", "tier": "backend"}))
+	s.Equal([]string{"db", "db-1", "backend"}, hostAliases)
+	s.Equal([]string{"test1", "test2"}, networks)
+
+	// definitions only apply to their own namespace.
+	hostAliases, networks = s.definitions.Lookup(s.pod("other", map[string]string{"app": "ldap"}))
+	s.Empty(hostAliases)
+	s.Empty(networks)
+
+	s.definitions.Delete("kubedock", "networks")
+	_, networks = s.definitions.Lookup(s.pod("kubedock", map[string]string{"app": "ldap"}))
+	s.Empty(networks)
+}
+
+func (s *DefinitionsTestSuite) Test_LookupOrderedByConfigMap() {
+	for _, name := range []string{"d", "c", "b", "a"} {
+		configMap := s.configMap("kubedock", map[string]string{
+			"fixtures": "{network: test-" + name + ", selector: app, hostAliases: ['" + name + "']}",
+		})
+		configMap.Name = name
+		s.Nil(s.definitions.Set(configMap))
+	}
+	for range 10 {
+		hostAliases, networks := s.definitions.Lookup(s.pod("kubedock", map[string]string{"app": "db"}))
+		s.Equal([]string{"a", "b", "c", "d"}, hostAliases)
+		s.Equal([]string{"test-a", "test-b", "test-c", "test-d"}, networks)
+	}
+}
+
+func (s *DefinitionsTestSuite) Test_EmptyHostAliasIsSkipped() {
+	s.Nil(s.definitions.Set(s.configMap("kubedock", map[string]string{
+		"fixtures": "{network: test1, selector: tier, hostAliases: ['{{ .Labels.app }}']}",
+	})))
+	_, networks := s.definitions.Lookup(s.pod("kubedock", map[string]string{"tier": "backend"}))
+	s.Empty(networks)
+}
+
+func (s *DefinitionsTestSuite) Test_InvalidDefinitions() {
+	for _, definition := range []string{
+		"network: test1",
+		"{network: test1, selector: 'app in (', hostAliases: [db]}",
+		"{network: test1, selector: app, hostAliases: ['{{ .Labels.app']}",
+		"{network: test1, selector: app, hostAliases: [db], unknown: field}",
+	} {
+		err := s.definitions.Set(s.configMap("kubedock", map[string]string{
+			"valid":   "{network: test2, selector: app, hostAliases: [db]}",
+			"invalid": definition,
+		}))
+		s.NotNil(err, definition)
+		// the valid definition is not used either.
+		_, networks := s.definitions.Lookup(s.pod("kubedock", map[string]string{"app": "db"}))
+		s.Empty(networks)
+	}
+}
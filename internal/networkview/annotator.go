@@ -0,0 +1,174 @@
+package networkview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// Annotation with the network view of a pod.
+const ANNOTATION = "kubedock-dns/networks"
+
+// Interval after which failed updates of annotations are retried.
+const RETRY_INTERVAL = 10 * time.Second
+
+// Network is what a pod can resolve in one of its networks, similar to the networks in
+// the NetworkSettings of 'docker inspect'. The annotation maps network ids to these.
+type Network struct {
+	// IP of the pod in the network.
+	IPAddress string `json:"ipAddress"`
+	// Host aliases of the pod in the network.
+	Aliases []string `json:"aliases"`
+	// Host aliases that can be resolved, mapped to their IPs.
+	Hosts map[string][]string `json:"hosts"`
+}
+
+// Annotator annotates pods with what they can resolve in their networks. The annotations
+// are updated in the background when the networks change.
+type Annotator struct {
+	clientset kubernetes.Interface
+	changed   chan struct{}
+
+	mutex    sync.Mutex
+	networks *model.Networks
+	// values of the annotations that were set, by namespace/name.
+	annotated map[string]string
+}
+
+func NewAnnotator(clientset kubernetes.Interface) *Annotator {
+	return &Annotator{
+		clientset: clientset,
+		changed:   make(chan struct{}, 1),
+		annotated: make(map[string]string),
+	}
+}
+
+// NetworksChanged schedules an update of the annotations.
+func (annotator *Annotator) NetworksChanged(networks *model.Networks) {
+	annotator.mutex.Lock()
+	annotator.networks = networks
+	annotator.mutex.Unlock()
+	select {
+	case annotator.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run updates the annotations after the networks changed until the context is canceled.
+func (annotator *Annotator) Run(ctx context.Context) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-annotator.changed:
+		case <-retry:
+		}
+		retry = nil
+		if !annotator.Annotate(ctx) {
+			retry = time.After(RETRY_INTERVAL)
+		}
+	}
+}
+
+// Annotate updates the annotations of pods for which the network view changed. Returns
+// false when not all pods could be annotated.
+func (annotator *Annotator) Annotate(ctx context.Context) bool {
+	annotator.mutex.Lock()
+	networks := annotator.networks
+	annotator.mutex.Unlock()
+	if networks == nil {
+		return true
+	}
+
+	ok := true
+	current := make(map[string]bool)
+	for ip, networkMap := range networks.IpToNetworks {
+		if strings.HasPrefix(string(ip), model.UNKNOWN_IP_PREFIX) {
+			continue
+		}
+		var pod *model.Pod
+		for _, network := range networkMap {
+			pod = network.IPToPod[ip]
+			break
+		}
+		if pod.IsService() {
+			continue
+		}
+		key := pod.Namespace + "/" + pod.Name
+		current[key] = true
+		value, err := Annotation(networks, pod)
+		if err != nil {
+			klog.Errorf("%s: could not determine network view: %v", key, err)
+			continue
+		}
+		if annotator.annotated[key] == value {
+			continue
+		}
+		if err := annotator.patch(ctx, pod, value); err != nil {
+			klog.Warningf("%s: could not annotate network view: %v", key, err)
+			ok = false
+			continue
+		}
+		annotator.annotated[key] = value
+	}
+	maps.DeleteFunc(annotator.annotated, func(key string, _ string) bool {
+		return !current[key]
+	})
+	return ok
+}
+
+func (annotator *Annotator) patch(ctx context.Context, pod *model.Pod, value string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{ANNOTATION: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = annotator.clientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name,
+		types.MergePatchType, patch, metav1.PatchOptions{})
+	if errors.IsNotFound(err) {
+		// deleted in the meantime
+		return nil
+	}
+	return err
+}
+
+// Annotation returns the value of the annotation for a pod.
+func Annotation(networks *model.Networks, pod *model.Pod) (string, error) {
+	res := make(map[string]Network)
+	for key, view := range networks.View(pod.IP) {
+		network := Network{
+			IPAddress: string(pod.IP),
+			Aliases:   make([]string, 0, len(pod.HostAliases)),
+			Hosts:     make(map[string][]string),
+		}
+		for _, hostAlias := range pod.HostAliases {
+			network.Aliases = append(network.Aliases, string(hostAlias))
+		}
+		for hostname, ips := range view {
+			for _, ip := range ips {
+				network.Hosts[string(hostname)] = append(network.Hosts[string(hostname)], string(ip))
+			}
+		}
+		res[string(key.Id)] = network
+	}
+	// maps are marshalled with sorted keys, so equal views have equal annotations.
+	value, err := json.Marshal(res)
+	if err != nil {
+		return "", fmt.Errorf("Could not marshal network view: %v", err)
+	}
+	return string(value), nil
+}
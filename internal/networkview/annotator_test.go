@@ -0,0 +1,135 @@
+package networkview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+type AnnotatorTestSuite struct {
+	suite.Suite
+
+	ctx       context.Context
+	clientset *fake.Clientset
+	pods      *model.Pods
+	annotator *Annotator
+}
+
+func (s *AnnotatorTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.clientset = fake.NewClientset()
+	s.pods = model.NewPods()
+	s.annotator = NewAnnotator(s.clientset)
+}
+
+func TestAnnotatorTestSuite(t *testing.T) {
+	suite.Run(t, &AnnotatorTestSuite{})
+}
+
+func (s *AnnotatorTestSuite) addPod(ip string, name string, hostAlias string, ready bool) {
+	_, err := s.clientset.CoreV1().Pods("kubedock").Create(s.ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kubedock", Name: name},
+	}, metav1.CreateOptions{})
+	s.Require().True(err == nil || errors.IsAlreadyExists(err), "%v", err)
+	pod, err := model.NewPod(model.IPAddress(ip), "kubedock", name, []model.Hostname{model.Hostname(hostAlias)},
+		[]model.NetworkId{"test"}, ready)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+}
+
+func (s *AnnotatorTestSuite) annotate() bool {
+	networks, podErrors := s.pods.Networks()
+	s.Require().Nil(podErrors)
+	s.annotator.NetworksChanged(networks)
+	return s.annotator.Annotate(s.ctx)
+}
+
+func (s *AnnotatorTestSuite) view(name string) map[string]Network {
+	pod, err := s.clientset.CoreV1().Pods("kubedock").Get(s.ctx, name, metav1.GetOptions{})
+	s.Require().Nil(err)
+	value, ok := pod.Annotations[ANNOTATION]
+	s.Require().True(ok, "annotation of %s", name)
+	var view map[string]Network
+	s.Require().Nil(json.Unmarshal([]byte(value), &view))
+	return view
+}
+
+// patches returns the number of patches of pods.
+func (s *AnnotatorTestSuite) patches() int {
+	count := 0
+	for _, action := range s.clientset.Actions() {
+		if action.GetVerb() == "patch" {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *AnnotatorTestSuite) Test_Annotate() {
+	s.addPod("10.0.0.1", "db", "db", true)
+	s.addPod("10.0.0.2", "service", "service", false)
+	s.True(s.annotate())
+
+	s.Equal(map[string]Network{
+		"test": {
+			IPAddress: "10.0.0.1",
+			Aliases:   []string{"db"},
+			Hosts:     map[string][]string{"db": {"10.0.0.1"}},
+		},
+	}, s.view("db"))
+	s.Equal(map[string]Network{
+		"test": {
+			IPAddress: "10.0.0.2",
+			Aliases:   []string{"service"},
+			Hosts:     map[string][]string{"db": {"10.0.0.1"}},
+		},
+	}, s.view("service"))
+
+	s.addPod("10.0.0.2", "service", "service", true)
+	s.True(s.annotate())
+	s.Equal(map[string][]string{"db": {"10.0.0.1"}, "service": {"10.0.0.2"}}, s.view("db")["test"].Hosts)
+}
+
+func (s *AnnotatorTestSuite) Test_OnlyChangedViewsArePatched() {
+	s.addPod("10.0.0.1", "db", "db", true)
+	s.True(s.annotate())
+	s.Equal(1, s.patches())
+	s.True(s.annotate())
+	s.Equal(1, s.patches())
+
+	// not ready, so the view of db does not change.
+	s.addPod("10.0.0.2", "service", "service", false)
+	s.True(s.annotate())
+	s.Equal(2, s.patches())
+}
+
+func (s *AnnotatorTestSuite) Test_FailedPatchesAreRetried() {
+	s.addPod("10.0.0.1", "db", "db", true)
+	fail := true
+	s.clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			return true, nil, fmt.Errorf("unavailable")
+		}
+		return false, nil, nil
+	})
+	s.False(s.annotate())
+
+	fail = false
+	s.True(s.annotator.Annotate(s.ctx))
+	s.Equal("10.0.0.1", s.view("db")["test"].IPAddress)
+}
+
+func (s *AnnotatorTestSuite) Test_DeletedPodIsIgnored() {
+	s.addPod("10.0.0.1", "db", "db", true)
+	s.Require().Nil(s.clientset.CoreV1().Pods("kubedock").Delete(s.ctx, "db", metav1.DeleteOptions{}))
+	s.True(s.annotate())
+}
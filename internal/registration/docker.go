@@ -0,0 +1,157 @@
+package registration
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// NetworkResource is a network in the shape of the NetworkResource of the Docker Engine
+// API, as returned by 'GET /networks/{id}'.
+type NetworkResource struct {
+	Name       string                      `json:"Name"`
+	ID         string                      `json:"Id"`
+	Scope      string                      `json:"Scope"`
+	Driver     string                      `json:"Driver"`
+	EnableIPv6 bool                        `json:"EnableIPv6"`
+	IPAM       IPAM                        `json:"IPAM"`
+	Internal   bool                        `json:"Internal"`
+	Attachable bool                        `json:"Attachable"`
+	Ingress    bool                        `json:"Ingress"`
+	Containers map[string]EndpointResource `json:"Containers"`
+	Options    map[string]string           `json:"Options"`
+	Labels     map[string]string           `json:"Labels"`
+}
+
+type IPAM struct {
+	Driver  string            `json:"Driver"`
+	Options map[string]string `json:"Options"`
+	Config  []any             `json:"Config"`
+}
+
+// EndpointResource is a container in a network. In addition to the fields of the Docker
+// Engine API, it contains the host aliases of the container.
+type EndpointResource struct {
+	Name        string   `json:"Name"`
+	EndpointID  string   `json:"EndpointID"`
+	MacAddress  string   `json:"MacAddress"`
+	IPv4Address string   `json:"IPv4Address"`
+	IPv6Address string   `json:"IPv6Address"`
+	Aliases     []string `json:"Aliases"`
+}
+
+const (
+	// Label of docker networks with the namespace of the network, which is empty for
+	// global networks.
+	NAMESPACE_LABEL = "kubedock-dns/namespace"
+	// Prefix of the names of containers that are services.
+	SERVICE_PREFIX = "service:"
+)
+
+// dockerId returns a docker style id, which is stable for the same names.
+func dockerId(names ...string) string {
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + "/"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// networkResource renders a network of the snapshot of the DNS server. Pods that are not
+// running yet are not included. The network is nil for declared networks without members.
+func networkResource(key model.NetworkKey, network *model.Network) NetworkResource {
+	res := NetworkResource{
+		Name:   string(key.Id),
+		ID:     dockerId(key.Namespace, string(key.Id)),
+		Scope:  "local",
+		Driver: "bridge",
+		IPAM: IPAM{
+			Driver: "default",
+			Config: []any{},
+		},
+		Containers: make(map[string]EndpointResource),
+		Options:    map[string]string{},
+		Labels:     map[string]string{NAMESPACE_LABEL: key.Namespace},
+	}
+	if network == nil {
+		return res
+	}
+	res.Internal = network.Internal
+	for ip, pod := range network.IPToPod {
+		if pod.HasUnknownIP() {
+			continue
+		}
+		name := pod.Name
+		if pod.IsService() {
+			name = SERVICE_PREFIX + pod.Service
+		}
+		if pod.Namespace != key.Namespace {
+			name = pod.Namespace + "/" + name
+		}
+		endpoint := EndpointResource{
+			Name:        name,
+			EndpointID:  dockerId(key.Namespace, string(key.Id), string(ip)),
+			IPv4Address: string(ip) + "/32",
+			Aliases:     make([]string, 0, len(pod.HostAliases)),
+		}
+		for _, hostAlias := range pod.HostAliases {
+			endpoint.Aliases = append(endpoint.Aliases, string(hostAlias))
+		}
+		res.Containers[dockerId(pod.Namespace, pod.Name)] = endpoint
+	}
+	return res
+}
+
+// dockerNetworks returns the networks that can be used from the namespace, that is,
+// the networks in the namespace and the global networks that the namespace may join.
+func (registry *Registry) dockerNetworks(namespace string) []NetworkResource {
+	networks := registry.snapshot()
+	keys := make(map[model.NetworkKey]bool)
+	for key := range registry.declared {
+		keys[key] = true
+	}
+	for key := range networks.NameToNetwork {
+		keys[key] = true
+	}
+	res := make([]NetworkResource, 0)
+	for key := range keys {
+		pod := &model.Pod{Namespace: namespace, Networks: []model.NetworkId{key.Id}}
+		if key.Namespace != namespace && (key.Namespace != "" ||
+			model.CheckGlobalNetworks(pod, registry.podConfig) != nil) {
+			continue
+		}
+		res = append(res, networkResource(key, networks.NameToNetwork[key]))
+	}
+	slices.SortFunc(res, func(a, b NetworkResource) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+func (registry *Registry) listDockerNetworks(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	writeJson(w, http.StatusOK, registry.dockerNetworks(r.PathValue("namespace")))
+}
+
+// getDockerNetwork returns a network by name or id, like 'docker network inspect'.
+func (registry *Registry) getDockerNetwork(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	id := r.PathValue("id")
+	namespace := r.PathValue("namespace")
+	name := string(model.GlobalNetworkId(id, registry.podConfig))
+	for _, network := range registry.dockerNetworks(namespace) {
+		if network.ID == id || network.Name == name {
+			writeJson(w, http.StatusOK, network)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("Network '%s' not found", id))
+}
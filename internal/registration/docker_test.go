@@ -0,0 +1,79 @@
+package registration
+
+import (
+	"encoding/json"
+	"net/http"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+func (s *RegistryTestSuite) dockerNetwork(namespace string, id string) (int, NetworkResource) {
+	status, body := s.request("GET", "/namespaces/"+namespace+"/docker/networks/"+id, nil, TOKEN)
+	var network NetworkResource
+	if status == http.StatusOK {
+		s.Require().Nil(json.Unmarshal(body, &network))
+	}
+	return status, network
+}
+
+func (s *RegistryTestSuite) Test_DockerNetwork() {
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/test", nil))
+	status, network := s.dockerNetwork("kubedock", "test")
+	s.Equal(http.StatusOK, status)
+	s.Equal("test", network.Name)
+	s.Equal(64, len(network.ID))
+	s.Empty(network.Containers)
+
+	s.Equal(http.StatusOK, s.status("PUT", "/namespaces/kubedock/reservations/service",
+		Reservation{Networks: []string{"test"}, HostAliases: []string{"service"}}))
+	db, err := model.NewPod("10.0.0.1", "kubedock", "db", []model.Hostname{"db", "database"},
+		[]model.NetworkId{"test"}, true)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(db)
+
+	// by id, reservations are not included
+	status, network = s.dockerNetwork("kubedock", network.ID)
+	s.Equal(http.StatusOK, status)
+	s.Equal(map[string]EndpointResource{
+		dockerId("kubedock", "db"): {
+			Name:        "db",
+			EndpointID:  dockerId("kubedock", "test", "10.0.0.1"),
+			IPv4Address: "10.0.0.1/32",
+			Aliases:     []string{"database", "db"},
+		},
+	}, network.Containers)
+	s.False(network.Internal)
+
+	internal := db.Copy()
+	internal.InternalNetworks = []model.NetworkId{"test"}
+	s.pods.AddOrUpdate(internal)
+	_, network = s.dockerNetwork("kubedock", "test")
+	s.True(network.Internal)
+
+	status, _ = s.dockerNetwork("other", "test")
+	s.Equal(http.StatusNotFound, status)
+}
+
+func (s *RegistryTestSuite) Test_DockerNetworksOfNamespace() {
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/test", nil))
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/team-a/networks/restricted", nil))
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/shared", nil))
+
+	names := func(namespace string) []string {
+		status, body := s.request("GET", "/namespaces/"+namespace+"/docker/networks", nil, TOKEN)
+		s.Equal(http.StatusOK, status)
+		var networks []NetworkResource
+		s.Require().Nil(json.Unmarshal(body, &networks))
+		res := make([]string, 0)
+		for _, network := range networks {
+			res = append(res, network.Name)
+		}
+		return res
+	}
+	s.Equal([]string{"global:shared", "test"}, names("kubedock"))
+	s.Equal([]string{"global:restricted", "global:shared"}, names("team-a"))
+
+	// global networks by name
+	status, network := s.dockerNetwork("team-a", "restricted")
+	s.Equal(http.StatusOK, status)
+	s.Equal("", network.Labels[NAMESPACE_LABEL])
+}
@@ -0,0 +1,402 @@
+package registration
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"k8s.io/klog/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// Path prefix of the registration API.
+const PREFIX = "/api/v1"
+
+// Network is the state of a network.
+type Network struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Created through the API, otherwise the network only exists because it has members.
+	Declared bool     `json:"declared"`
+	Members  []Member `json:"members"`
+}
+
+// Member is a pod in a network. Reserved members are pods that are not yet running,
+// which were either reserved through the API or admitted but not yet scheduled.
+type Member struct {
+	Name        string   `json:"name"`
+	IP          string   `json:"ip,omitempty"`
+	HostAliases []string `json:"hostAliases"`
+	Ready       bool     `json:"ready"`
+	Reserved    bool     `json:"reserved"`
+}
+
+// Reservation reserves host aliases in networks for a pod that is created later.
+type Reservation struct {
+	Networks    []string `json:"networks"`
+	HostAliases []string `json:"hostAliases"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+}
+
+// Registry lets clients such as kubedock declare networks and reserve host aliases for
+// pods before these are created, so that invalid configurations fail immediately instead
+// of at admission. Reservations are pods with an unknown IP, which are replaced at
+// admission of the pod, and which are removed by the reconciler when the pod is not
+// created.
+type Registry struct {
+	pods *model.Pods
+	// Networks currently used by the DNS server.
+	snapshot  func() *model.Networks
+	podConfig config.PodConfig
+	token     string
+	// Nil means all namespaces are watched.
+	watched func(namespace string) bool
+	// Changes of the networks for the watch API, nil when watching is not supported.
+	changes *Changes
+
+	mutex sync.Mutex
+	// networks created through the API. These are only known to this process, so the API
+	// supports a single replica, and declarations are lost on restart.
+	declared map[model.NetworkKey]bool
+}
+
+func NewRegistry(pods *model.Pods, snapshot func() *model.Networks, podConfig config.PodConfig,
+	token string, watched func(namespace string) bool, changes *Changes) *Registry {
+	return &Registry{
+		pods:      pods,
+		snapshot:  snapshot,
+		podConfig: podConfig,
+		token:     token,
+		watched:   watched,
+		changes:   changes,
+		declared:  make(map[model.NetworkKey]bool),
+	}
+}
+
+// Handler returns the HTTP handler of the API. All requests require the token as bearer
+// token and are limited to watched namespaces.
+func (registry *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	networks := PREFIX + "/namespaces/{namespace}/networks"
+	reservations := PREFIX + "/namespaces/{namespace}/reservations"
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, registry.authenticated(handler))
+	}
+	handle("GET "+networks, registry.listNetworks)
+	handle("GET "+networks+"/{network}", registry.getNetwork)
+	handle("POST "+networks+"/{network}", registry.createNetwork)
+	handle("DELETE "+networks+"/{network}", registry.deleteNetwork)
+	handle("PUT "+reservations+"/{pod}", registry.reserve)
+	handle("DELETE "+reservations+"/{pod}", registry.release)
+	handle("GET "+PREFIX+"/namespaces/{namespace}/docker/networks", registry.listDockerNetworks)
+	handle("GET "+PREFIX+"/namespaces/{namespace}/docker/networks/{id}", registry.getDockerNetwork)
+	if registry.changes != nil {
+		handle("GET "+PREFIX+"/namespaces/{namespace}/watch", registry.watchNetworks)
+	}
+	return mux
+}
+
+// authenticated verifies the bearer token and the namespace of the request.
+func (registry *Registry) authenticated(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(registry.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("Invalid or missing bearer token"))
+			return
+		}
+		namespace := r.PathValue("namespace")
+		if registry.watched != nil && !registry.watched(namespace) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("Namespace %s is not watched", namespace))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// networkKey returns the key of the network in the request and verifies that the
+// namespace may use the network.
+func (registry *Registry) networkKey(r *http.Request) (model.NetworkKey, error) {
+	return registry.key(r.PathValue("namespace"), r.PathValue("network"))
+}
+
+func (registry *Registry) key(namespace string, network string) (model.NetworkKey, error) {
+	id := model.GlobalNetworkId(network, registry.podConfig)
+	pod := &model.Pod{Namespace: namespace, Name: "", Networks: []model.NetworkId{id}}
+	if err := model.CheckGlobalNetworks(pod, registry.podConfig); err != nil {
+		return model.NetworkKey{}, err
+	}
+	return model.NewNetworkKey(namespace, id), nil
+}
+
+// exists returns true when the network was declared or has members.
+func (registry *Registry) exists(networks *model.Networks, key model.NetworkKey) bool {
+	return registry.declared[key] || networks.NameToNetwork[key] != nil
+}
+
+func (registry *Registry) listNetworks(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	namespace := r.PathValue("namespace")
+	networks, _ := registry.pods.Networks()
+	keys := make([]model.NetworkKey, 0)
+	for key := range registry.declared {
+		keys = append(keys, key)
+	}
+	for key, network := range networks.NameToNetwork {
+		if !registry.declared[key] && hasMemberInNamespace(network, namespace) {
+			keys = append(keys, key)
+		}
+	}
+	res := make([]Network, 0, len(keys))
+	for _, key := range keys {
+		if key.Namespace == namespace || key.Namespace == "" {
+			res = append(res, registry.network(networks, key))
+		}
+	}
+	slices.SortFunc(res, func(a, b Network) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	writeJson(w, http.StatusOK, res)
+}
+
+func (registry *Registry) getNetwork(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	key, err := registry.networkKey(r)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	networks, _ := registry.pods.Networks()
+	if !registry.exists(networks, key) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Network '%s' not found", key.Id))
+		return
+	}
+	writeJson(w, http.StatusOK, registry.network(networks, key))
+}
+
+func (registry *Registry) createNetwork(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	key, err := registry.networkKey(r)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	networks, _ := registry.pods.Networks()
+	if registry.exists(networks, key) {
+		writeError(w, http.StatusConflict, fmt.Errorf("Network '%s' already exists", key.Id))
+		return
+	}
+	if err := registry.checkNetworkQuota(networks, key); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	klog.Infof("%s: network declared", key)
+	registry.declared[key] = true
+	writeJson(w, http.StatusCreated, registry.network(networks, key))
+}
+
+// checkNetworkQuota verifies that a new network does not exceed the number of networks
+// of the namespace, counting both declared networks and networks with members.
+func (registry *Registry) checkNetworkQuota(networks *model.Networks, key model.NetworkKey) error {
+	limit := registry.podConfig.Quotas.NetworksPerNamespace
+	if limit <= 0 || key.Namespace == "" {
+		return nil
+	}
+	keys := make(map[model.NetworkKey]bool)
+	for declared := range registry.declared {
+		keys[declared] = true
+	}
+	for existing := range networks.NameToNetwork {
+		keys[existing] = true
+	}
+	count := 1
+	for existing := range keys {
+		if existing.Namespace == key.Namespace {
+			count++
+		}
+	}
+	if count <= limit {
+		return nil
+	}
+	metrics.QuotaRejections.WithLabelValues(model.QUOTA_NETWORKS_PER_NAMESPACE).Inc()
+	return fmt.Errorf("Namespace %s would have %d networks, the maximum is %d", key.Namespace, count, limit)
+}
+
+func (registry *Registry) deleteNetwork(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	key, err := registry.networkKey(r)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	networks, _ := registry.pods.Networks()
+	if !registry.exists(networks, key) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Network '%s' not found", key.Id))
+		return
+	}
+	if network := networks.NameToNetwork[key]; network != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("Network '%s' has %d members",
+			key.Id, len(network.IPToPod)))
+		return
+	}
+	klog.Infof("%s: network deleted", key)
+	delete(registry.declared, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (registry *Registry) reserve(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	namespace := r.PathValue("namespace")
+	name := r.PathValue("pod")
+	var reservation Reservation
+	if err := json.NewDecoder(r.Body).Decode(&reservation); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Could not unmarshal reservation: %v", err))
+		return
+	}
+	if len(reservation.Networks) == 0 || len(reservation.HostAliases) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s/%s: no host or no network defined",
+			namespace, name))
+		return
+	}
+	hostAliases := make([]model.Hostname, 0, len(reservation.HostAliases))
+	for _, hostAlias := range reservation.HostAliases {
+		hostAliases = append(hostAliases, model.Hostname(hostAlias))
+	}
+	networkIds := make([]model.NetworkId, 0, len(reservation.Networks))
+	for _, network := range reservation.Networks {
+		networkIds = append(networkIds, model.GlobalNetworkId(network, registry.podConfig))
+	}
+	pod, err := model.NewPod(model.NewUnknownIP(), namespace, name, hostAliases, networkIds, false)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.CheckGlobalNetworks(pod, registry.podConfig); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	networks, _ := registry.pods.Networks()
+	for _, id := range pod.Networks {
+		if key := model.NewNetworkKey(namespace, id); !registry.exists(networks, key) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Network '%s' not found", id))
+			return
+		}
+	}
+	if existing := registry.pods.Get(namespace, name); existing != nil && !existing.HasUnknownIP() {
+		writeError(w, http.StatusConflict, fmt.Errorf("%s/%s: pod already exists", namespace, name))
+		return
+	}
+	if _, err := registry.pods.AddAndValidate(pod, registry.podConfig.Quotas); err != nil {
+		var quotaError *model.QuotaError
+		if errors.As(err, &quotaError) {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	klog.Infof("%s/%s: reserved host aliases %v in networks %v", namespace, name,
+		pod.HostAliases, pod.Networks)
+	writeJson(w, http.StatusOK, reservation)
+}
+
+func (registry *Registry) release(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	namespace := r.PathValue("namespace")
+	name := r.PathValue("pod")
+	existing := registry.pods.Get(namespace, name)
+	if existing == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s/%s: reservation not found", namespace, name))
+		return
+	}
+	if !existing.HasUnknownIP() {
+		writeError(w, http.StatusConflict, fmt.Errorf("%s/%s: pod already exists", namespace, name))
+		return
+	}
+	klog.Infof("%s/%s: reservation released", namespace, name)
+	registry.pods.Delete(namespace, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (registry *Registry) network(networks *model.Networks, key model.NetworkKey) Network {
+	res := Network{
+		Name:      string(key.Id),
+		Namespace: key.Namespace,
+		Declared:  registry.declared[key],
+		Members:   make([]Member, 0),
+	}
+	network := networks.NameToNetwork[key]
+	if network == nil {
+		return res
+	}
+	for _, pod := range network.IPToPod {
+		res.Members = append(res.Members, newMember(key, pod))
+	}
+	slices.SortFunc(res.Members, func(a, b Member) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+func newMember(key model.NetworkKey, pod *model.Pod) Member {
+	member := Member{
+		Name:        pod.Name,
+		HostAliases: make([]string, 0, len(pod.HostAliases)),
+		Ready:       pod.Ready,
+		Reserved:    pod.HasUnknownIP(),
+	}
+	if pod.Namespace != key.Namespace {
+		member.Name = pod.Namespace + "/" + pod.Name
+	}
+	if !member.Reserved {
+		member.IP = string(pod.IP)
+	}
+	for _, hostAlias := range pod.HostAliases {
+		member.HostAliases = append(member.HostAliases, string(hostAlias))
+	}
+	return member
+}
+
+func hasMemberInNamespace(network *model.Network, namespace string) bool {
+	for _, pod := range network.IPToPod {
+		if pod.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJson(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		klog.Warningf("Could not write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	klog.V(2).Infof("Registration API: %d: %v", status, err)
+	writeJson(w, status, Error{Message: err.Error()})
+}
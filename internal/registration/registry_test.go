@@ -0,0 +1,141 @@
+package registration
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+const TOKEN = "secret"
+
+type RegistryTestSuite struct {
+	suite.Suite
+
+	pods     *model.Pods
+	changes  *Changes
+	registry *Registry
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	s.pods = model.NewPods()
+	s.changes = NewChanges()
+	s.registry = NewRegistry(s.pods, s.networks, config.PodConfig{
+		GlobalNetworks: map[string][]string{
+			"restricted": {"team-a"},
+			"shared":     {},
+		},
+	}, TOKEN, func(namespace string) bool {
+		return namespace != "unwatched"
+	}, s.changes)
+}
+
+// networks returns the networks of the pods as a snapshot of the DNS server would.
+func (s *RegistryTestSuite) networks() *model.Networks {
+	networks, _ := s.pods.Networks()
+	return networks
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, &RegistryTestSuite{})
+}
+
+// request sends a request and returns the status and the decoded body.
+func (s *RegistryTestSuite) request(method string, path string, body any, token string) (int, []byte) {
+	data, err := json.Marshal(body)
+	s.Require().Nil(err)
+	request := httptest.NewRequest(method, PREFIX+path, bytes.NewReader(data))
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	s.registry.Handler().ServeHTTP(recorder, request)
+	return recorder.Code, recorder.Body.Bytes()
+}
+
+func (s *RegistryTestSuite) status(method string, path string, body any) int {
+	status, _ := s.request(method, path, body, TOKEN)
+	return status
+}
+
+func (s *RegistryTestSuite) Test_Authentication() {
+	status, _ := s.request("GET", "/namespaces/kubedock/networks", nil, "invalid")
+	s.Equal(http.StatusUnauthorized, status)
+	s.Equal(http.StatusOK, s.status("GET", "/namespaces/kubedock/networks", nil))
+	s.Equal(http.StatusForbidden, s.status("GET", "/namespaces/unwatched/networks", nil))
+}
+
+func (s *RegistryTestSuite) Test_NetworkLifecycle() {
+	s.Equal(http.StatusNotFound, s.status("GET", "/namespaces/kubedock/networks/test", nil))
+	s.Equal(http.StatusNotFound, s.status("DELETE", "/namespaces/kubedock/networks/test", nil))
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/test", nil))
+
+	status, body := s.request("GET", "/namespaces/kubedock/networks/test", nil, TOKEN)
+	s.Equal(http.StatusOK, status)
+	var network Network
+	s.Require().Nil(json.Unmarshal(body, &network))
+	s.Equal(Network{Name: "test", Namespace: "kubedock", Declared: true, Members: []Member{}}, network)
+
+	// networks are isolated per namespace
+	s.Equal(http.StatusNotFound, s.status("GET", "/namespaces/other/networks/test", nil))
+
+	s.Equal(http.StatusNoContent, s.status("DELETE", "/namespaces/kubedock/networks/test", nil))
+	s.Equal(http.StatusNotFound, s.status("GET", "/namespaces/kubedock/networks/test", nil))
+}
+
+func (s *RegistryTestSuite) Test_GlobalNetworks() {
+	s.Equal(http.StatusForbidden, s.status("POST", "/namespaces/kubedock/networks/restricted", nil))
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/team-a/networks/restricted", nil))
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/shared", nil))
+	// global networks are shared between namespaces.
+	s.Equal(http.StatusConflict, s.status("POST", "/namespaces/team-b/networks/shared", nil))
+
+	status, body := s.request("GET", "/namespaces/team-b/networks", nil, TOKEN)
+	s.Equal(http.StatusOK, status)
+	var networks []Network
+	s.Require().Nil(json.Unmarshal(body, &networks))
+	s.Equal(2, len(networks))
+	s.Equal("global:restricted", networks[0].Name)
+	s.Equal("global:shared", networks[1].Name)
+}
+
+func (s *RegistryTestSuite) Test_Reservations() {
+	reservation := Reservation{Networks: []string{"test"}, HostAliases: []string{"db"}}
+	s.Equal(http.StatusNotFound, s.status("PUT", "/namespaces/kubedock/reservations/db", reservation))
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/test", nil))
+	s.Equal(http.StatusBadRequest, s.status("PUT", "/namespaces/kubedock/reservations/db",
+		Reservation{Networks: []string{"test"}}))
+	s.Equal(http.StatusOK, s.status("PUT", "/namespaces/kubedock/reservations/db", reservation))
+	s.NotNil(s.pods.Get("kubedock", "db"))
+	// a reservation can be changed
+	s.Equal(http.StatusOK, s.status("PUT", "/namespaces/kubedock/reservations/db",
+		Reservation{Networks: []string{"test"}, HostAliases: []string{"database"}}))
+	s.Equal([]model.Hostname{"database"}, s.pods.Get("kubedock", "db").HostAliases)
+
+	s.Equal(http.StatusNoContent, s.status("DELETE", "/namespaces/kubedock/reservations/db", nil))
+	s.Nil(s.pods.Get("kubedock", "db"))
+	s.Equal(http.StatusNotFound, s.status("DELETE", "/namespaces/kubedock/reservations/db", nil))
+
+	// existing pods cannot be reserved
+	pod, err := model.NewPod("10.0.0.1", "kubedock", "db", []model.Hostname{"db"}, []model.NetworkId{"test"}, true)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+	s.Equal(http.StatusConflict, s.status("PUT", "/namespaces/kubedock/reservations/db", reservation))
+	s.Equal(http.StatusConflict, s.status("DELETE", "/namespaces/kubedock/reservations/db", nil))
+}
+
+func (s *RegistryTestSuite) Test_Quotas() {
+	s.registry.podConfig.Quotas = config.Quotas{NetworksPerNamespace: 1, HostAliasesPerPod: 1}
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/kubedock/networks/test", nil))
+	s.Equal(http.StatusForbidden, s.status("POST", "/namespaces/kubedock/networks/other", nil))
+	// other namespaces have their own quota
+	s.Equal(http.StatusCreated, s.status("POST", "/namespaces/other/networks/other", nil))
+
+	s.Equal(http.StatusForbidden, s.status("PUT", "/namespaces/kubedock/reservations/db",
+		Reservation{Networks: []string{"test"}, HostAliases: []string{"db", "database"}}))
+	s.Nil(s.pods.Get("kubedock", "db"))
+	s.Equal(http.StatusOK, s.status("PUT", "/namespaces/kubedock/reservations/db",
+		Reservation{Networks: []string{"test"}, HostAliases: []string{"db"}}))
+}
@@ -0,0 +1,203 @@
+package registration
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/klog/v2"
+	"net/http"
+	"sync"
+	"time"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// Number of changes that are buffered for a watcher in addition to the current state.
+// Watchers that fall further behind are disconnected and get the current state when they
+// reconnect.
+const WATCH_BUFFER_SIZE = 1000
+
+// Interval of comments sent to idle watchers to keep connections through proxies open.
+const WATCH_KEEPALIVE_INTERVAL = 30 * time.Second
+
+// Change is a change of a network as sent to watchers. The member is absent when the
+// network was emptied.
+type Change struct {
+	Type      model.ChangeType `json:"type"`
+	Network   string           `json:"network"`
+	Namespace string           `json:"namespace"`
+	Member    *Member          `json:"member,omitempty"`
+}
+
+type watcher struct {
+	filter  func(key model.NetworkKey) bool
+	changes chan Change
+}
+
+// Changes distributes the changes between consecutive snapshots of the networks of the
+// DNS server to watchers.
+type Changes struct {
+	mutex    sync.Mutex
+	networks *model.Networks
+	watchers map[*watcher]bool
+	closed   bool
+}
+
+func NewChanges() *Changes {
+	return &Changes{
+		watchers: make(map[*watcher]bool),
+	}
+}
+
+// NetworksChanged sends the changes since the previous snapshot to the watchers.
+func (changes *Changes) NetworksChanged(networks *model.Networks) {
+	changes.mutex.Lock()
+	defer changes.mutex.Unlock()
+
+	previous := changes.networks
+	changes.networks = networks
+	for _, change := range model.DiffNetworks(previous, networks) {
+		if change.Type == model.HOSTALIAS_CONFLICT {
+			continue
+		}
+		for watcher := range changes.watchers {
+			if !watcher.filter(change.Network) {
+				continue
+			}
+			select {
+			case watcher.changes <- newChange(change):
+			default:
+				klog.Warningf("Disconnecting watcher that is %d changes behind", WATCH_BUFFER_SIZE)
+				changes.remove(watcher)
+			}
+		}
+	}
+}
+
+// Close disconnects all watchers and refuses new ones.
+func (changes *Changes) Close() {
+	changes.mutex.Lock()
+	defer changes.mutex.Unlock()
+
+	changes.closed = true
+	for watcher := range changes.watchers {
+		changes.remove(watcher)
+	}
+}
+
+// watch registers a watcher for the networks that match the filter. The current members
+// of these networks are sent first as changes from an empty state, so that watchers do not
+// miss changes between looking up the state and watching. Returns nil when closed.
+func (changes *Changes) watch(filter func(key model.NetworkKey) bool) *watcher {
+	changes.mutex.Lock()
+	defer changes.mutex.Unlock()
+
+	if changes.closed {
+		return nil
+	}
+	current := make([]Change, 0)
+	for _, change := range model.DiffNetworks(nil, changes.networks) {
+		if change.Type != model.HOSTALIAS_CONFLICT && filter(change.Network) {
+			current = append(current, newChange(change))
+		}
+	}
+	watcher := &watcher{
+		filter:  filter,
+		changes: make(chan Change, len(current)+WATCH_BUFFER_SIZE),
+	}
+	for _, change := range current {
+		watcher.changes <- change
+	}
+	changes.watchers[watcher] = true
+	return watcher
+}
+
+// unwatch removes a watcher when it disconnects.
+func (changes *Changes) unwatch(watcher *watcher) {
+	changes.mutex.Lock()
+	defer changes.mutex.Unlock()
+
+	if changes.watchers[watcher] {
+		changes.remove(watcher)
+	}
+}
+
+func (changes *Changes) remove(watcher *watcher) {
+	delete(changes.watchers, watcher)
+	close(watcher.changes)
+}
+
+func newChange(change model.NetworkChange) Change {
+	res := Change{
+		Type:      change.Type,
+		Network:   string(change.Network.Id),
+		Namespace: change.Network.Namespace,
+	}
+	if change.Member != nil {
+		member := newMember(change.Network, change.Member)
+		res.Member = &member
+	}
+	return res
+}
+
+// watchNetworks streams changes of networks as server-sent events. Without network query
+// parameters, changes of all networks that can be used from the namespace are sent.
+func (registry *Registry) watchNetworks(w http.ResponseWriter, r *http.Request) {
+	namespace := r.PathValue("namespace")
+	keys := make(map[model.NetworkKey]bool)
+	for _, id := range r.URL.Query()["network"] {
+		key, err := registry.key(namespace, id)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		keys[key] = true
+	}
+	filter := func(key model.NetworkKey) bool {
+		if len(keys) > 0 {
+			return keys[key]
+		}
+		pod := &model.Pod{Namespace: namespace, Networks: []model.NetworkId{key.Id}}
+		return key.Namespace == namespace ||
+			(key.Namespace == "" && model.CheckGlobalNetworks(pod, registry.podConfig) == nil)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	watcher := registry.changes.watch(filter)
+	if watcher == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("Server is shutting down"))
+		return
+	}
+	defer registry.changes.unwatch(watcher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(WATCH_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case change, ok := <-watcher.changes:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				klog.Warningf("Could not marshal change: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,134 @@
+package registration
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// watch starts watching and returns the received changes as '<network> <member> <type>'.
+func (s *RegistryTestSuite) watch(path string) (<-chan string, func()) {
+	server := httptest.NewServer(s.registry.Handler())
+	request, err := http.NewRequest("GET", server.URL+PREFIX+path, nil)
+	s.Require().Nil(err)
+	request.Header.Set("Authorization", "Bearer "+TOKEN)
+	response, err := http.DefaultClient.Do(request)
+	s.Require().Nil(err)
+	s.Require().Equal(http.StatusOK, response.StatusCode)
+	s.Equal("text/event-stream", response.Header.Get("Content-Type"))
+
+	received := make(chan string, 100)
+	go func() {
+		defer close(received)
+		scanner := bufio.NewScanner(response.Body)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if value, found := strings.CutPrefix(line, "event: "); found {
+				event = value
+			}
+			if value, found := strings.CutPrefix(line, "data: "); found {
+				var change Change
+				if err := json.Unmarshal([]byte(value), &change); err != nil || string(change.Type) != event {
+					received <- "invalid: " + line
+					continue
+				}
+				description := change.Network + " - " + string(change.Type)
+				if change.Member != nil {
+					description = change.Network + " " + change.Member.Name + " " + string(change.Type)
+				}
+				if change.Type == model.MEMBER_IP_ASSIGNED {
+					description += " " + change.Member.IP
+				}
+				received <- description
+			}
+		}
+	}()
+	return received, func() {
+		response.Body.Close()
+		server.Close()
+	}
+}
+
+func (s *RegistryTestSuite) expect(received <-chan string, expected ...string) {
+	for _, change := range expected {
+		select {
+		case actual := <-received:
+			s.Equal(change, actual)
+		case <-time.After(5 * time.Second):
+			s.Fail("no change received", "expected %s", change)
+			return
+		}
+	}
+}
+
+func (s *RegistryTestSuite) addPod(ip string, name string, ready bool, networks ...model.NetworkId) {
+	pod, err := model.NewPod(model.IPAddress(ip), "kubedock", name, []model.Hostname{model.Hostname(name)},
+		networks, ready)
+	s.Require().Nil(err)
+	s.pods.AddOrUpdate(pod)
+	s.changes.NetworksChanged(s.networks())
+}
+
+func (s *RegistryTestSuite) Test_Watch() {
+	s.addPod("10.0.0.1", "db", true, "test")
+	received, stop := s.watch("/namespaces/kubedock/watch")
+	defer stop()
+
+	// the current state comes first
+	s.expect(received,
+		"test db joined",
+		"test db ipassigned 10.0.0.1",
+		"test db ready")
+
+	s.Equal(http.StatusOK, s.status("PUT", "/namespaces/kubedock/reservations/service",
+		Reservation{Networks: []string{"test"}, HostAliases: []string{"service"}}))
+	s.changes.NetworksChanged(s.networks())
+	s.expect(received, "test service joined")
+
+	s.addPod("10.0.0.2", "service", false, "test")
+	s.addPod("10.0.0.2", "service", true, "test")
+	s.pods.Delete("kubedock", "db")
+	s.pods.Delete("kubedock", "service")
+	s.changes.NetworksChanged(s.networks())
+	s.expect(received,
+		"test service ipassigned 10.0.0.2",
+		"test service ready",
+		"test db left",
+		"test service left",
+		"test - emptied")
+}
+
+func (s *RegistryTestSuite) Test_WatchFilter() {
+	s.addPod("10.0.0.1", "db", true, "test")
+	s.addPod("10.0.0.2", "other", true, "other")
+	received, stop := s.watch("/namespaces/kubedock/watch?network=other")
+	defer stop()
+	s.expect(received,
+		"other other joined",
+		"other other ipassigned 10.0.0.2",
+		"other other ready")
+
+	s.addPod("10.0.0.1", "db", false, "test")
+	s.addPod("10.0.0.2", "other", false, "other")
+	s.expect(received, "other other notready")
+
+	s.Equal(http.StatusForbidden, s.status("GET", "/namespaces/kubedock/watch?network=restricted", nil))
+}
+
+func (s *RegistryTestSuite) Test_WatchClosed() {
+	received, stop := s.watch("/namespaces/kubedock/watch")
+	defer stop()
+	s.changes.Close()
+	select {
+	case _, ok := <-received:
+		s.False(ok)
+	case <-time.After(5 * time.Second):
+		s.Fail("watch not closed")
+	}
+	s.Equal(http.StatusServiceUnavailable, s.status("GET", "/namespaces/kubedock/watch", nil))
+}
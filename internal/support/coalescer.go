@@ -0,0 +1,88 @@
+package support
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Coalescer combines triggers that occur in quick succession into a single run of an
+// action. The action runs when there were no triggers during the quiet period, or at the
+// latest after the maximum latency since the first trigger of a batch. The action is
+// called with the number of triggers in the batch.
+type Coalescer struct {
+	quietPeriod time.Duration
+	maxLatency  time.Duration
+	action      func(batchSize int)
+
+	mutex   sync.Mutex
+	pending int
+	signal  chan struct{}
+}
+
+func NewCoalescer(quietPeriod time.Duration, maxLatency time.Duration,
+	action func(batchSize int)) *Coalescer {
+	return &Coalescer{
+		quietPeriod: quietPeriod,
+		maxLatency:  maxLatency,
+		action:      action,
+		signal:      make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests the action to be run. It never blocks.
+func (coalescer *Coalescer) Trigger() {
+	coalescer.mutex.Lock()
+	coalescer.pending++
+	coalescer.mutex.Unlock()
+
+	select {
+	case coalescer.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the action for batches of triggers until the context is canceled.
+func (coalescer *Coalescer) Run(ctx context.Context) {
+	quiet := time.NewTimer(coalescer.quietPeriod)
+	quiet.Stop()
+	deadline := time.NewTimer(coalescer.maxLatency)
+	deadline.Stop()
+	defer quiet.Stop()
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-coalescer.signal:
+		}
+
+		quiet.Reset(coalescer.quietPeriod)
+		deadline.Reset(coalescer.maxLatency)
+	batch:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-coalescer.signal:
+				quiet.Reset(coalescer.quietPeriod)
+			case <-quiet.C:
+				break batch
+			case <-deadline.C:
+				break batch
+			}
+		}
+		quiet.Stop()
+		deadline.Stop()
+
+		coalescer.mutex.Lock()
+		batchSize := coalescer.pending
+		coalescer.pending = 0
+		coalescer.mutex.Unlock()
+		// a signal can be pending for triggers that are already in this batch.
+		if batchSize > 0 {
+			coalescer.action(batchSize)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package support
+
+import (
+	"context"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type CoalescerTestSuite struct {
+	suite.Suite
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	batches chan int
+}
+
+func (s *CoalescerTestSuite) SetupTest() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.batches = make(chan int, 100)
+}
+
+func (s *CoalescerTestSuite) TearDownTest() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func TestCoalescerSuite(t *testing.T) {
+	suite.Run(t, &CoalescerTestSuite{})
+}
+
+func (s *CoalescerTestSuite) start(quietPeriod time.Duration, maxLatency time.Duration) *Coalescer {
+	coalescer := NewCoalescer(quietPeriod, maxLatency, func(batchSize int) {
+		s.batches <- batchSize
+	})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		coalescer.Run(s.ctx)
+	}()
+	return coalescer
+}
+
+func (s *CoalescerTestSuite) nextBatch(timeout time.Duration) int {
+	select {
+	case batchSize := <-s.batches:
+		return batchSize
+	case <-time.After(timeout):
+		return 0
+	}
+}
+
+func (s *CoalescerTestSuite) Test_TriggersAreCombined() {
+	coalescer := s.start(50*time.Millisecond, 10*time.Second)
+	for range 10 {
+		coalescer.Trigger()
+	}
+	s.Equal(10, s.nextBatch(5*time.Second))
+	s.Equal(0, s.nextBatch(200*time.Millisecond))
+
+	coalescer.Trigger()
+	s.Equal(1, s.nextBatch(5*time.Second))
+}
+
+func (s *CoalescerTestSuite) Test_MaxLatency() {
+	coalescer := s.start(200*time.Millisecond, 300*time.Millisecond)
+	t0 := time.Now()
+	// continuous triggers never give a quiet period
+	stop := time.Now().Add(1 * time.Second)
+	go func() {
+		for time.Now().Before(stop) {
+			coalescer.Trigger()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	s.Greater(s.nextBatch(5*time.Second), 1)
+	s.Less(time.Since(t0), 800*time.Millisecond)
+}
@@ -0,0 +1,69 @@
+package support
+
+import (
+	"slices"
+	"sync"
+)
+
+// Readiness tracks a set of named conditions that must all be met before
+// the server is ready. Once ready, it stays ready.
+type Readiness struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+	ready   chan struct{}
+}
+
+func NewReadiness(conditions ...string) *Readiness {
+	readiness := Readiness{
+		pending: make(map[string]bool),
+		ready:   make(chan struct{}),
+	}
+	for _, condition := range conditions {
+		readiness.pending[condition] = true
+	}
+	if len(readiness.pending) == 0 {
+		close(readiness.ready)
+	}
+	return &readiness
+}
+
+// Set marks the condition as met. Setting a condition more than once is allowed.
+func (readiness *Readiness) Set(condition string) {
+	readiness.mutex.Lock()
+	defer readiness.mutex.Unlock()
+
+	if !readiness.pending[condition] {
+		return
+	}
+	delete(readiness.pending, condition)
+	if len(readiness.pending) == 0 {
+		close(readiness.ready)
+	}
+}
+
+// Pending returns the conditions that are not met yet in sorted order.
+func (readiness *Readiness) Pending() []string {
+	readiness.mutex.Lock()
+	defer readiness.mutex.Unlock()
+
+	res := make([]string, 0, len(readiness.pending))
+	for condition := range readiness.pending {
+		res = append(res, condition)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Ready returns a channel that is closed when all conditions are met.
+func (readiness *Readiness) Ready() <-chan struct{} {
+	return readiness.ready
+}
+
+func (readiness *Readiness) IsReady() bool {
+	select {
+	case <-readiness.ready:
+		return true
+	default:
+		return false
+	}
+}
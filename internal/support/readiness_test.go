@@ -0,0 +1,44 @@
+package support
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type ReadinessTestSuite struct {
+	suite.Suite
+}
+
+func TestReadinessSuite(t *testing.T) {
+	suite.Run(t, &ReadinessTestSuite{})
+}
+
+func (s *ReadinessTestSuite) Test_NoConditions() {
+	readiness := NewReadiness()
+	s.True(readiness.IsReady())
+	s.Equal([]string{}, readiness.Pending())
+}
+
+func (s *ReadinessTestSuite) Test_AllConditionsRequired() {
+	readiness := NewReadiness("pods", "dns")
+	s.False(readiness.IsReady())
+	s.Equal([]string{"dns", "pods"}, readiness.Pending())
+
+	readiness.Set("dns")
+	s.False(readiness.IsReady())
+	s.Equal([]string{"pods"}, readiness.Pending())
+
+	// unknown conditions and setting twice are ignored
+	readiness.Set("unknown")
+	readiness.Set("dns")
+	s.False(readiness.IsReady())
+
+	readiness.Set("pods")
+	s.True(readiness.IsReady())
+	s.Equal([]string{}, readiness.Pending())
+	select {
+	case <-readiness.Ready():
+	default:
+		s.Fail("Ready channel should be closed")
+	}
+}
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"slices"
+)
+
+// Namespaces determines the namespaces in which pods are watched. This is either a fixed
+// list of namespaces or all namespaces matching a label selector. With a single namespace,
+// the watcher only needs access to that namespace, otherwise it is cluster-scoped.
+type Namespaces struct {
+	names    []string
+	selector labels.Selector
+
+	// only for a label selector. The selector is evaluated here instead of by the API server
+	// so that label changes of a namespace are seen as updates.
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   corev1listers.NamespaceLister
+}
+
+// NewNamespaceList watches pods in a fixed list of namespaces.
+func NewNamespaceList(names ...string) *Namespaces {
+	return &Namespaces{
+		names: slices.Clone(names),
+	}
+}
+
+// NewNamespaceSelector watches pods in all namespaces matching the label selector.
+func NewNamespaceSelector(clientset kubernetes.Interface, selector string) (*Namespaces, error) {
+	labelSelector, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid namespace selector '%s': %v", selector, err)
+	}
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	namespaceInformer := factory.Core().V1().Namespaces()
+	return &Namespaces{
+		selector: labelSelector,
+		factory:  factory,
+		informer: namespaceInformer.Informer(),
+		lister:   namespaceInformer.Lister(),
+	}, nil
+}
+
+// ClusterScoped returns true when pods must be watched in all namespaces.
+func (namespaces *Namespaces) ClusterScoped() bool {
+	return namespaces.lister != nil || len(namespaces.names) != 1
+}
+
+// informerNamespace is the namespace for the pod informer.
+func (namespaces *Namespaces) informerNamespace() string {
+	if namespaces.ClusterScoped() {
+		return corev1.NamespaceAll
+	}
+	return namespaces.names[0]
+}
+
+// Watched returns true when pods in the namespace are watched.
+func (namespaces *Namespaces) Watched(namespace string) bool {
+	if namespaces.lister == nil {
+		return slices.Contains(namespaces.names, namespace)
+	}
+	k8snamespace, err := namespaces.lister.Get(namespace)
+	return err == nil && namespaces.matches(k8snamespace)
+}
+
+func (namespaces *Namespaces) matches(namespace *corev1.Namespace) bool {
+	return namespaces.selector.Matches(labels.Set(namespace.Labels))
+}
+
+func (namespaces *Namespaces) String() string {
+	if namespaces.lister == nil {
+		return fmt.Sprintf("%v", namespaces.names)
+	}
+	return fmt.Sprintf("selected by '%s'", namespaces.selector)
+}
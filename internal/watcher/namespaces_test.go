@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+func (s *WatcherTestSuite) k8sPodInNamespace(namespace string, name string, ip string) *corev1.Pod {
+	pod := s.k8sPod(name, ip, true)
+	pod.Namespace = namespace
+	return pod
+}
+
+func (s *WatcherTestSuite) k8sNamespace(name string, team string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"team": team},
+		},
+	}
+}
+
+func (s *WatcherTestSuite) createNamespace(namespace *corev1.Namespace) {
+	_, err := s.clientset.CoreV1().Namespaces().Create(s.ctx, namespace, metav1.CreateOptions{})
+	s.Require().Nil(err)
+}
+
+func (s *WatcherTestSuite) updateNamespace(namespace *corev1.Namespace) {
+	_, err := s.clientset.CoreV1().Namespaces().Update(s.ctx, namespace, metav1.UpdateOptions{})
+	s.Require().Nil(err)
+}
+
+func (s *WatcherTestSuite) Test_NamespaceList() {
+	namespaces := NewNamespaceList("team-a", "team-b")
+	s.True(namespaces.ClusterScoped())
+	s.False(NewNamespaceList("team-a").ClusterScoped())
+	s.watcher = NewPodWatcher(s.clientset, namespaces, s.recorder, s.podConfig)
+
+	s.createPod(s.k8sPodInNamespace("team-a", "db", "10.0.0.1"))
+	s.createPod(s.k8sPodInNamespace("team-b", "db", "10.0.0.2"))
+	s.createPod(s.k8sPodInNamespace("team-c", "db", "10.0.0.3"))
+	s.start()
+	s.waitForPods("team-a/db", "team-b/db")
+
+	s.createPod(s.k8sPodInNamespace("team-c", "service", "10.0.0.4"))
+	s.createPod(s.k8sPodInNamespace("team-b", "service", "10.0.0.5"))
+	s.waitForPods("team-a/db", "team-b/db", "team-b/service")
+}
+
+func (s *WatcherTestSuite) Test_NamespaceSelector() {
+	_, err := NewNamespaceSelector(s.clientset, "team in (")
+	s.NotNil(err)
+
+	namespaces, err := NewNamespaceSelector(s.clientset, "team=ci")
+	s.Require().Nil(err)
+	s.True(namespaces.ClusterScoped())
+	s.watcher = NewPodWatcher(s.clientset, namespaces, s.recorder, s.podConfig)
+
+	teamB := s.k8sNamespace("team-b", "other")
+	s.createNamespace(s.k8sNamespace("team-a", "ci"))
+	s.createNamespace(teamB)
+	s.createPod(s.k8sPodInNamespace("team-a", "db", "10.0.0.1"))
+	s.createPod(s.k8sPodInNamespace("team-b", "db", "10.0.0.2"))
+	s.start()
+	s.waitForPods("team-a/db")
+	s.True(s.watcher.Watched("team-a"))
+	s.False(s.watcher.Watched("team-b"))
+
+	// namespace starts matching
+	teamB.Labels["team"] = "ci"
+	s.updateNamespace(teamB)
+	s.waitForPods("team-a/db", "team-b/db")
+
+	// namespace stops matching
+	teamB.Labels["team"] = "other"
+	s.updateNamespace(teamB)
+	s.waitForPods("team-a/db")
+}
+
+// ServiceAdminRecorder records whether the initial services were added.
+type ServiceAdminRecorder struct {
+	synced chan struct{}
+}
+
+func (recorder *ServiceAdminRecorder) SetServiceMembers(namespace string, service string, members []*model.Pod) {
+}
+
+func (recorder *ServiceAdminRecorder) ServicesSynced() {
+	close(recorder.synced)
+}
+
+func (s *WatcherTestSuite) Test_NamespaceEventsAfterServiceWatcherStopped() {
+	namespaces, err := NewNamespaceSelector(s.clientset, "team=ci")
+	s.Require().Nil(err)
+	s.watcher = NewPodWatcher(s.clientset, namespaces, s.recorder, s.podConfig)
+	teamA := s.k8sNamespace("team-a", "ci")
+	s.createNamespace(teamA)
+	_, err = s.clientset.CoreV1().Services("team-a").Create(s.ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "db"},
+	}, metav1.CreateOptions{})
+	s.Require().Nil(err)
+	s.createPod(s.k8sPodInNamespace("team-a", "db", "10.0.0.1"))
+	s.start()
+	s.waitForPods("team-a/db")
+
+	// the namespace informer is owned by the pod watcher, which keeps running.
+	services := &ServiceAdminRecorder{synced: make(chan struct{})}
+	serviceWatcher := NewServiceWatcher(s.clientset, namespaces, services, s.podConfig)
+	ctx, cancel := context.WithCancel(s.ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Nil(serviceWatcher.Run(ctx))
+	}()
+	select {
+	case <-services.synced:
+	case <-time.After(10 * time.Second):
+		s.Require().Fail("service watcher did not sync")
+	}
+	cancel()
+	<-stopped
+
+	for _, team := range []string{"other", "ci", "other"} {
+		teamA.Labels["team"] = team
+		s.updateNamespace(teamA)
+	}
+	s.waitForPods()
+}
@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"context"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"strings"
+	"time"
+	"wamblee.org/kubedock/dns/internal/metrics"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// Reconciler periodically compares the pods in the model with the informer cache of
+// the pod watcher. The model is modified by both the admission controller and the watcher
+// and can therefore drift from the cluster, for instance when a pod was admitted but
+// its creation failed afterwards.
+type Reconciler struct {
+	pods    *model.Pods
+	watcher *PodWatcher
+	// Called after the model was changed.
+	onChange func()
+
+	// Pods with an unknown IP that were not in the cluster at the previous
+	// reconciliation. Admitted pods are not in the cluster yet, so these
+	// are only removed when they are still missing at the next reconciliation.
+	missing map[string]bool
+}
+
+func NewReconciler(pods *model.Pods, watcher *PodWatcher, onChange func()) *Reconciler {
+	return &Reconciler{
+		pods:     pods,
+		watcher:  watcher,
+		onChange: onChange,
+		missing:  make(map[string]bool),
+	}
+}
+
+// Run reconciles every interval until the context is canceled.
+func (reconciler *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reconciler.Reconcile()
+		}
+	}
+}
+
+// Reconcile brings the model in line with the informer cache. It returns true when
+// the model was changed. The model is changed in the same goroutine as that of the watch
+// events of the pod watcher, so that a pod that is deleted concurrently is not added again.
+func (reconciler *Reconciler) Reconcile() bool {
+	if !reconciler.watcher.HasSynced() {
+		klog.V(2).Info("Skipping reconciliation, pods are not synchronized yet")
+		return false
+	}
+	changed := false
+	if !reconciler.watcher.Serialize(func() {
+		changed = reconciler.reconcile()
+	}) {
+		klog.V(2).Info("Skipping reconciliation, the pod watcher is not running")
+		return false
+	}
+	if changed {
+		reconciler.onChange()
+	}
+	return changed
+}
+
+func (reconciler *Reconciler) reconcile() bool {
+	changed := false
+	drift := func(kind string, key string, format string, args ...any) {
+		klog.Warningf("%s: drift: "+format, append([]any{key}, args...)...)
+		metrics.ReconcilerDrift.WithLabelValues(kind).Inc()
+		changed = true
+	}
+
+	missing := make(map[string]bool)
+	known := make(map[string]bool)
+	for key, pod := range reconciler.pods.Copy().Pods.Iter() {
+		if pod.IsService() {
+			// services are not reconciled
+			continue
+		}
+		known[key] = true
+		if !reconciler.watcher.Watched(pod.Namespace) {
+			reconciler.pods.Delete(pod.Namespace, pod.Name)
+			drift("removed", key, "namespace is not watched")
+			continue
+		}
+		k8spod, err := reconciler.watcher.Lister().Pods(pod.Namespace).Get(pod.Name)
+		if errors.IsNotFound(err) {
+			if strings.HasPrefix(string(pod.IP), model.UNKNOWN_IP_PREFIX) && !reconciler.missing[key] {
+				missing[key] = true
+				continue
+			}
+			reconciler.pods.Delete(pod.Namespace, pod.Name)
+			drift("removed", key, "pod no longer exists")
+			continue
+		}
+		if err != nil {
+			klog.Errorf("%s: could not reconcile: %v", key, err)
+			continue
+		}
+		if k8spod.Status.PodIP == "" {
+			// admitted but no IP yet
+			continue
+		}
+		actual, err := model.GetPodEssentials(k8spod, "", reconciler.watcher.podConfig)
+		if err != nil {
+			reconciler.pods.Delete(pod.Namespace, pod.Name)
+			drift("removed", key, "%v", err)
+			continue
+		}
+		if reconciler.pods.AddOrUpdate(actual) {
+			drift("updated", key, "was %+v, now %+v", pod, actual)
+		}
+	}
+	reconciler.missing = missing
+
+	k8spods, err := reconciler.watcher.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Could not list pods: %v", err)
+	}
+	for _, k8spod := range k8spods {
+		key := k8spod.Namespace + "/" + k8spod.Name
+		if known[key] || !reconciler.watcher.Watched(k8spod.Namespace) {
+			continue
+		}
+		pod, err := model.GetPodEssentials(k8spod, "", reconciler.watcher.podConfig)
+		if err != nil {
+			continue
+		}
+		reconciler.pods.AddOrUpdate(pod)
+		drift("added", key, "pod was missing")
+	}
+	return changed
+}
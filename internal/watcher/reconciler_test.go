@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"wamblee.org/kubedock/dns/internal/metrics"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+func (s *WatcherTestSuite) newReconciler() (*model.Pods, *Reconciler, *int) {
+	pods := model.NewPods()
+	changes := 0
+	reconciler := NewReconciler(pods, s.watcher, func() {
+		changes++
+	})
+	return pods, reconciler, &changes
+}
+
+func (s *WatcherTestSuite) modelPod(name string, ip string, ready bool) *model.Pod {
+	pod, err := model.NewPod(model.IPAddress(ip), "kubedock", name,
+		[]model.Hostname{model.Hostname(name)}, []model.NetworkId{"test"}, ready)
+	s.Require().Nil(err)
+	return pod
+}
+
+func (s *WatcherTestSuite) drift(kind string) float64 {
+	return testutil.ToFloat64(metrics.ReconcilerDrift.WithLabelValues(kind))
+}
+
+func (s *WatcherTestSuite) Test_ReconcileNoDrift() {
+	s.createPod(s.k8sPod("db", "10.0.0.1", true))
+	s.start()
+	pods, reconciler, changes := s.newReconciler()
+	pods.AddOrUpdate(s.modelPod("db", "10.0.0.1", false))
+
+	s.False(reconciler.Reconcile())
+	s.Equal(0, *changes)
+}
+
+func (s *WatcherTestSuite) Test_ReconcileDrift() {
+	s.createPod(s.k8sPod("db", "10.0.0.1", true))
+	s.createPod(s.k8sPod("service", "10.0.0.2", true))
+	s.start()
+	pods, reconciler, changes := s.newReconciler()
+	added, updated, removed := s.drift("added"), s.drift("updated"), s.drift("removed")
+
+	// db has a different IP, service is missing, and old no longer exists.
+	pods.AddOrUpdate(s.modelPod("db", "10.0.0.100", false))
+	pods.AddOrUpdate(s.modelPod("old", "10.0.0.3", false))
+
+	s.True(reconciler.Reconcile())
+	s.Equal(1, *changes)
+	s.Equal(model.IPAddress("10.0.0.1"), pods.Get("kubedock", "db").IP)
+	s.NotNil(pods.Get("kubedock", "service"))
+	s.Nil(pods.Get("kubedock", "old"))
+	s.Equal(added+1, s.drift("added"))
+	s.Equal(updated+1, s.drift("updated"))
+	s.Equal(removed+1, s.drift("removed"))
+
+	s.False(reconciler.Reconcile())
+	s.Equal(1, *changes)
+}
+
+func (s *WatcherTestSuite) Test_ReconcileAdmittedPodsRemovedWhenNotCreated() {
+	s.start()
+	pods, reconciler, changes := s.newReconciler()
+
+	// admitted pod that was never created.
+	pods.AddOrUpdate(s.modelPod("db", model.UNKNOWN_IP_PREFIX+"1", false))
+
+	s.False(reconciler.Reconcile())
+	s.NotNil(pods.Get("kubedock", "db"))
+
+	s.True(reconciler.Reconcile())
+	s.Nil(pods.Get("kubedock", "db"))
+	s.Equal(1, *changes)
+}
+
+func (s *WatcherTestSuite) Test_ReconcileAdmittedPodsWithoutIPAreKept() {
+	s.createPod(s.k8sPod("db", "", true))
+	s.start()
+	pods, reconciler, _ := s.newReconciler()
+	pods.AddOrUpdate(s.modelPod("db", model.UNKNOWN_IP_PREFIX+"1", false))
+
+	s.False(reconciler.Reconcile())
+	s.False(reconciler.Reconcile())
+	s.NotNil(pods.Get("kubedock", "db"))
+}
+
+func (s *WatcherTestSuite) Test_ReconcileSkippedWhenWatcherStopped() {
+	s.start()
+	pods, reconciler, changes := s.newReconciler()
+	pods.AddOrUpdate(s.modelPod("old", "10.0.0.3", false))
+
+	// the model is only changed together with the watch events.
+	s.cancel()
+	s.wg.Wait()
+	s.False(reconciler.Reconcile())
+	s.NotNil(pods.Get("kubedock", "old"))
+	s.Equal(0, *changes)
+}
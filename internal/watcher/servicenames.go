@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"context"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// ServiceNames keeps track of the services in the watched namespaces, regardless of their
+// annotations, so that the DNS server and the admission controller can detect host aliases
+// that shadow services.
+type ServiceNames struct {
+	namespaces *Namespaces
+	factory    informers.SharedInformerFactory
+	informer   cache.SharedIndexInformer
+	lister     corev1listers.ServiceLister
+}
+
+func NewServiceNames(clientset kubernetes.Interface, namespaces *Namespaces) *ServiceNames {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespaces.informerNamespace()))
+	serviceInformer := factory.Core().V1().Services()
+	return &ServiceNames{
+		namespaces: namespaces,
+		factory:    factory,
+		informer:   serviceInformer.Informer(),
+		lister:     serviceInformer.Lister(),
+	}
+}
+
+// Run watches services and blocks until the context is canceled. The synced function is
+// called once the initial services are known.
+func (names *ServiceNames) Run(ctx context.Context, synced func()) {
+	names.factory.Start(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), names.informer.HasSynced) {
+		synced()
+	}
+	<-ctx.Done()
+	names.factory.Shutdown()
+}
+
+// Exists returns true when the service exists in a watched namespace. Services in other
+// namespaces are not known.
+func (names *ServiceNames) Exists(namespace string, name string) bool {
+	if !names.namespaces.Watched(namespace) {
+		return false
+	}
+	_, err := names.lister.Services(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("%s/%s: could not get service: %v", namespace, name, err)
+	}
+	return err == nil
+}
@@ -0,0 +1,78 @@
+package watcher
+
+import (
+	"context"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ServiceNamesTestSuite struct {
+	suite.Suite
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	clientset *fake.Clientset
+	names     *ServiceNames
+	stopped   chan struct{}
+}
+
+func (s *ServiceNamesTestSuite) SetupTest() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.clientset = fake.NewClientset(
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "kubedock", Name: "db"}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "ldap"}},
+	)
+	// the fake clientset misses objects that are created before the watch is established.
+	watching := make(chan struct{})
+	var watchingOnce sync.Once
+	s.clientset.PrependWatchReactor("services", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher, err := s.clientset.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		watchingOnce.Do(func() { close(watching) })
+		return true, watcher, err
+	})
+	s.names = NewServiceNames(s.clientset, NewNamespaceList("kubedock", "fixtures"))
+	synced := make(chan struct{})
+	s.stopped = make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		s.names.Run(s.ctx, func() { close(synced) })
+	}()
+	for _, started := range []chan struct{}{watching, synced} {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			s.FailNow("services not synchronized")
+		}
+	}
+}
+
+func (s *ServiceNamesTestSuite) TearDownTest() {
+	s.cancel()
+	<-s.stopped
+}
+
+func TestServiceNamesTestSuite(t *testing.T) {
+	suite.Run(t, &ServiceNamesTestSuite{})
+}
+
+func (s *ServiceNamesTestSuite) Test_Exists() {
+	s.True(s.names.Exists("kubedock", "db"))
+	s.False(s.names.Exists("kubedock", "ldap"))
+	// namespaces that are not watched
+	s.False(s.names.Exists("other", "ldap"))
+
+	_, err := s.clientset.CoreV1().Services("fixtures").Create(s.ctx,
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "fixtures", Name: "ldap"}},
+		metav1.CreateOptions{})
+	s.Require().Nil(err)
+	s.Eventually(func() bool {
+		return s.names.Exists("fixtures", "ldap")
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,236 @@
+package watcher
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	discoveryv1listers "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sync"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+type ServiceAdmin interface {
+	// Replaces the network members of a service, no members means the service is removed.
+	SetServiceMembers(namespace string, service string, members []*model.Pod)
+	// Called once after the initial services have been added.
+	ServicesSynced()
+}
+
+// ServiceWatcher watches services in the watched namespaces that are annotated with host
+// aliases and networks. Services cannot be filtered by the API server since annotations
+// cannot be selected on, so all services are watched. For headless services, the
+// endpoint slices are watched as well.
+type ServiceWatcher struct {
+	services   ServiceAdmin
+	podConfig  config.PodConfig
+	namespaces *Namespaces
+	factory    informers.SharedInformerFactory
+
+	serviceInformer       cache.SharedIndexInformer
+	serviceLister         corev1listers.ServiceLister
+	endpointSliceInformer cache.SharedIndexInformer
+	endpointSliceLister   discoveryv1listers.EndpointSliceLister
+
+	serializer chan func()
+	// protects the serializer from being used after it was closed.
+	serializerMutex sync.RWMutex
+	running         bool
+}
+
+func NewServiceWatcher(
+	clientset kubernetes.Interface,
+	namespaces *Namespaces,
+	services ServiceAdmin,
+	podConfig config.PodConfig) *ServiceWatcher {
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespaces.informerNamespace()))
+	serviceInformer := factory.Core().V1().Services()
+	endpointSliceInformer := factory.Discovery().V1().EndpointSlices()
+	return &ServiceWatcher{
+		services:              services,
+		podConfig:             podConfig,
+		namespaces:            namespaces,
+		factory:               factory,
+		serviceInformer:       serviceInformer.Informer(),
+		serviceLister:         serviceInformer.Lister(),
+		endpointSliceInformer: endpointSliceInformer.Informer(),
+		endpointSliceLister:   endpointSliceInformer.Lister(),
+		serializer:            make(chan func()),
+	}
+}
+
+// Run watches services and blocks until the context is canceled.
+func (watcher *ServiceWatcher) Run(ctx context.Context) error {
+	go func() {
+		for action := range watcher.serializer {
+			action()
+		}
+	}()
+	watcher.serializerMutex.Lock()
+	watcher.running = true
+	watcher.serializerMutex.Unlock()
+
+	serviceRegistration, err := watcher.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.serviceChanged,
+		UpdateFunc: func(_ any, obj any) {
+			watcher.serviceChanged(obj)
+		},
+		DeleteFunc: watcher.serviceChanged,
+	})
+	if err != nil {
+		watcher.stopSerializer()
+		return err
+	}
+	endpointSliceRegistration, err := watcher.endpointSliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.endpointSliceChanged,
+		UpdateFunc: func(_ any, obj any) {
+			watcher.endpointSliceChanged(obj)
+		},
+		DeleteFunc: watcher.endpointSliceChanged,
+	})
+	if err != nil {
+		watcher.stopSerializer()
+		return err
+	}
+	// the namespace informer is owned by the pod watcher and can outlive this watcher.
+	var namespaceRegistration cache.ResourceEventHandlerRegistration
+	if watcher.namespaces.informer != nil {
+		namespaceRegistration, err = watcher.namespaces.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: watcher.namespaceChanged,
+			UpdateFunc: func(_ any, obj any) {
+				watcher.namespaceChanged(obj)
+			},
+			DeleteFunc: watcher.namespaceChanged,
+		})
+		if err != nil {
+			watcher.stopSerializer()
+			return err
+		}
+	}
+
+	watcher.factory.Start(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), serviceRegistration.HasSynced, endpointSliceRegistration.HasSynced) {
+		// through the serializer so that this is done after the initial services were added.
+		watcher.serialize(watcher.services.ServicesSynced)
+	}
+	<-ctx.Done()
+	watcher.factory.Shutdown()
+	if namespaceRegistration != nil {
+		if err := watcher.namespaces.informer.RemoveEventHandler(namespaceRegistration); err != nil {
+			klog.Errorf("Could not remove namespace handler: %v", err)
+		}
+	}
+	// the own informers have stopped, actions of namespace events that are still being
+	// handled are dropped.
+	watcher.stopSerializer()
+	return nil
+}
+
+func (watcher *ServiceWatcher) serviceChanged(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		klog.Errorf("Ignoring object of unexpected type %T: %v", obj, obj)
+		metrics.WatcherUnexpectedObjects.Inc()
+		return
+	}
+	watcher.update(service.Namespace, service.Name)
+}
+
+func (watcher *ServiceWatcher) endpointSliceChanged(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	endpointSlice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		klog.Errorf("Ignoring object of unexpected type %T: %v", obj, obj)
+		metrics.WatcherUnexpectedObjects.Inc()
+		return
+	}
+	service := endpointSlice.Labels[discoveryv1.LabelServiceName]
+	if service != "" {
+		watcher.update(endpointSlice.Namespace, service)
+	}
+}
+
+func (watcher *ServiceWatcher) namespaceChanged(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	services, err := watcher.serviceLister.Services(namespace.Name).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Could not list services in namespace %s: %v", namespace.Name, err)
+		return
+	}
+	for _, service := range services {
+		watcher.update(service.Namespace, service.Name)
+	}
+}
+
+// update determines the members of a service from the informer caches. This is done
+// in the serializer so that the latest state is always applied last.
+func (watcher *ServiceWatcher) update(namespace string, name string) {
+	watcher.serialize(func() {
+		members := watcher.getMembers(namespace, name)
+		watcher.services.SetServiceMembers(namespace, name, members)
+	})
+}
+
+func (watcher *ServiceWatcher) stopSerializer() {
+	watcher.serializerMutex.Lock()
+	defer watcher.serializerMutex.Unlock()
+	watcher.running = false
+	close(watcher.serializer)
+}
+
+// serialize sends the action to the serializer, it is dropped when the watcher is not running.
+func (watcher *ServiceWatcher) serialize(action func()) {
+	watcher.serializerMutex.RLock()
+	defer watcher.serializerMutex.RUnlock()
+	if !watcher.running {
+		return
+	}
+	watcher.serializer <- action
+}
+
+func (watcher *ServiceWatcher) getMembers(namespace string, name string) []*model.Pod {
+	if !watcher.namespaces.Watched(namespace) {
+		return nil
+	}
+	service, err := watcher.serviceLister.Services(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		klog.Errorf("%s/%s: could not get service: %v", namespace, name, err)
+		return nil
+	}
+	endpointSlices, err := watcher.endpointSliceLister.EndpointSlices(namespace).List(
+		labels.Set{discoveryv1.LabelServiceName: name}.AsSelector())
+	if err != nil {
+		klog.Errorf("%s/%s: could not list endpoint slices: %v", namespace, name, err)
+		return nil
+	}
+	members, err := model.GetServiceMembers(service, endpointSlices, watcher.podConfig)
+	if err != nil {
+		klog.V(3).Infof("Ignoring service: %v", err)
+		return nil
+	}
+	return members
+}
@@ -1,81 +1,383 @@
 package watcher
 
 import (
+	"context"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
+	"sync"
 	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
 	"wamblee.org/kubedock/dns/internal/model"
 )
 
 type PodAdmin interface {
 	AddOrUpdate(pod *model.Pod)
 	Delete(namespace, name string)
+	// Called once after the initial pods have been added.
+	Synced()
 }
 
-func WatchPods(
-	clientset *kubernetes.Clientset,
-	namespace string,
+// PodWatcher watches the kubedock pods in the watched namespaces. Only pods with the kubedock
+// label are listed and watched, the filtering is done by the API server. When namespaces are
+// selected by labels, pods are added or removed when their namespace starts or stops matching.
+//
+// With network definitions, pods without the kubedock label can also be network members, so
+// then all pods are watched, together with the ConfigMaps containing the network definitions.
+type PodWatcher struct {
+	pods       PodAdmin
+	podConfig  config.PodConfig
+	namespaces *Namespaces
+	factory    informers.SharedInformerFactory
+	informer   cache.SharedIndexInformer
+	lister     corev1listers.PodLister
+
+	// only with network definitions
+	definitionFactory  informers.SharedInformerFactory
+	definitionInformer cache.SharedIndexInformer
+
+	serializer chan func()
+	// protects the serializer from being used after it was closed.
+	serializerMutex sync.RWMutex
+	running         bool
+}
+
+// NetworkDefinitionLabel is the label for ConfigMaps that contain network definitions.
+func NetworkDefinitionLabel(podConfig config.PodConfig) string {
+	return podConfig.LabelName + "-network-definition"
+}
+
+func NewPodWatcher(
+	clientset kubernetes.Interface,
+	namespaces *Namespaces,
 	pods PodAdmin,
-	podConfig config.PodConfig) {
+	podConfig config.PodConfig) *PodWatcher {
+
+	podSelector := labels.Set{podConfig.LabelName: "true"}.String()
+	if podConfig.NetworkDefinitions != nil {
+		podSelector = ""
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespaces.informerNamespace()),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = podSelector
+		}))
+	podInformer := factory.Core().V1().Pods()
+	watcher := PodWatcher{
+		pods:       pods,
+		podConfig:  podConfig,
+		namespaces: namespaces,
+		factory:    factory,
+		informer:   podInformer.Informer(),
+		lister:     podInformer.Lister(),
+		serializer: make(chan func()),
+	}
+	if podConfig.NetworkDefinitions != nil {
+		watcher.definitionFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+			informers.WithNamespace(namespaces.informerNamespace()),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = labels.Set{NetworkDefinitionLabel(podConfig): "true"}.String()
+			}))
+		watcher.definitionInformer = watcher.definitionFactory.Core().V1().ConfigMaps().Informer()
+	}
+	return &watcher
+}
 
-	serializer := make(chan func())
+// Lister returns a lister for the informer cache of kubedock pods.
+func (watcher *PodWatcher) Lister() corev1listers.PodLister {
+	return watcher.lister
+}
+
+// HasSynced returns true when the informer cache contains the initial pods.
+func (watcher *PodWatcher) HasSynced() bool {
+	return watcher.informer.HasSynced()
+}
+
+// Watched returns true when pods in the namespace are watched.
+func (watcher *PodWatcher) Watched(namespace string) bool {
+	return watcher.namespaces.Watched(namespace)
+}
+
+// Run watches pods and blocks until the context is canceled.
+func (watcher *PodWatcher) Run(ctx context.Context) error {
 	go func() {
-		for action := range serializer {
+		for action := range watcher.serializer {
 			action()
 		}
 	}()
+	watcher.serializerMutex.Lock()
+	watcher.running = true
+	watcher.serializerMutex.Unlock()
 
-	watchlist := cache.NewListWatchFromClient(
-		clientset.CoreV1().RESTClient(),
-		"pods",
-		namespace,
-		fields.Everything(),
-	)
-
-	addOrUpdate := func(obj interface{}) {
-		serializer <- func() {
-			k8spod := getPod(obj)
-			pod, err := model.GetPodEssentials(k8spod, "", podConfig)
-			if err == nil {
-				pods.AddOrUpdate(pod)
-			} else {
-				klog.Infof("Ignoring pod %s/%s: %v", k8spod.Namespace, k8spod.Name, err)
+	if err := watcher.watchNamespaces(ctx); err != nil {
+		watcher.stopSerializer()
+		return err
+	}
+
+	if err := watcher.watchDefinitions(ctx); err != nil {
+		watcher.stopSerializer()
+		return err
+	}
+
+	registration, err := watcher.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.addOrUpdate,
+		UpdateFunc: func(_ any, obj any) {
+			watcher.addOrUpdate(obj)
+		},
+		DeleteFunc: watcher.delete,
+	})
+	if err != nil {
+		watcher.stopSerializer()
+		return err
+	}
+
+	watcher.factory.Start(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), registration.HasSynced) {
+		// through the serializer so that this is done after the initial pods were added.
+		watcher.serializer <- watcher.pods.Synced
+	}
+	<-ctx.Done()
+	watcher.factory.Shutdown()
+	if watcher.namespaces.factory != nil {
+		watcher.namespaces.factory.Shutdown()
+	}
+	if watcher.definitionFactory != nil {
+		watcher.definitionFactory.Shutdown()
+	}
+	// the informer has stopped so no more actions will be sent.
+	watcher.stopSerializer()
+	return nil
+}
+
+func (watcher *PodWatcher) stopSerializer() {
+	watcher.serializerMutex.Lock()
+	defer watcher.serializerMutex.Unlock()
+	watcher.running = false
+	close(watcher.serializer)
+}
+
+// Serialize runs the action in the goroutine that applies the watch events to the model and
+// waits for it to complete. It returns false without running the action when the watcher is
+// not running.
+func (watcher *PodWatcher) Serialize(action func()) bool {
+	watcher.serializerMutex.RLock()
+	defer watcher.serializerMutex.RUnlock()
+	if !watcher.running {
+		return false
+	}
+	done := make(chan struct{})
+	watcher.serializer <- func() {
+		defer close(done)
+		action()
+	}
+	<-done
+	return true
+}
+
+// watchNamespaces starts watching namespaces when these are selected by labels. The
+// namespaces are synchronized before pods are watched so that the initial pods are
+// filtered correctly.
+func (watcher *PodWatcher) watchNamespaces(ctx context.Context) error {
+	namespaces := watcher.namespaces
+	if namespaces.factory == nil {
+		return nil
+	}
+	registration, err := namespaces.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.namespaceChanged,
+		UpdateFunc: func(oldObj any, obj any) {
+			old, ok1 := oldObj.(*corev1.Namespace)
+			updated, ok2 := obj.(*corev1.Namespace)
+			if ok1 && ok2 && namespaces.matches(old) == namespaces.matches(updated) {
+				return
 			}
-		}
+			watcher.namespaceChanged(obj)
+		},
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			watcher.namespaceChanged(obj)
+		},
+	})
+	if err != nil {
+		return err
 	}
+	namespaces.factory.Start(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), registration.HasSynced)
+	return nil
+}
 
-	options := cache.InformerOptions{
-		ListerWatcher: watchlist,
-		ObjectType:    &corev1.Pod{},
-		Handler: cache.ResourceEventHandlerFuncs{
-			AddFunc: addOrUpdate,
-			UpdateFunc: func(_ any, obj any) {
-				addOrUpdate(obj)
-			},
-			DeleteFunc: func(obj any) {
-				pod := getPod(obj)
-				serializer <- func() {
-					pods.Delete(pod.Namespace, pod.Name)
-				}
-			},
+// watchDefinitions starts watching the network definitions when these are used. The
+// definitions are synchronized before pods are watched so that the initial pods are
+// matched against them.
+func (watcher *PodWatcher) watchDefinitions(ctx context.Context) error {
+	if watcher.definitionFactory == nil {
+		return nil
+	}
+	registration, err := watcher.definitionInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.definitionChanged,
+		UpdateFunc: func(_ any, obj any) {
+			watcher.definitionChanged(obj)
 		},
-		ResyncPeriod: 0,
+		DeleteFunc: watcher.definitionDeleted,
+	})
+	if err != nil {
+		return err
 	}
+	watcher.definitionFactory.Start(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), registration.HasSynced)
+	return nil
+}
 
-	_, controller := cache.NewInformerWithOptions(options)
-	stop := make(chan struct{})
-	defer close(stop)
-	go controller.Run(stop)
-	select {}
+func (watcher *PodWatcher) definitionChanged(obj any) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		klog.Errorf("Ignoring object of unexpected type %T: %v", obj, obj)
+		metrics.WatcherUnexpectedObjects.Inc()
+		return
+	}
+	if !watcher.Watched(configMap.Namespace) {
+		return
+	}
+	klog.Infof("%s/%s: network definitions updated", configMap.Namespace, configMap.Name)
+	if err := watcher.podConfig.NetworkDefinitions.Set(configMap); err != nil {
+		klog.Errorf("Ignoring network definitions: %v", err)
+	}
+	watcher.resync(configMap.Namespace)
+}
+
+func (watcher *PodWatcher) definitionDeleted(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		klog.Errorf("Ignoring object of unexpected type %T: %v", obj, obj)
+		metrics.WatcherUnexpectedObjects.Inc()
+		return
+	}
+	klog.Infof("%s/%s: network definitions deleted", configMap.Namespace, configMap.Name)
+	watcher.podConfig.NetworkDefinitions.Delete(configMap.Namespace, configMap.Name)
+	watcher.resync(configMap.Namespace)
+}
+
+// resync re-evaluates all pods in a namespace after the network definitions changed.
+func (watcher *PodWatcher) resync(namespace string) {
+	if !watcher.informer.HasSynced() {
+		// the initial pods are matched when they are added.
+		return
+	}
+	k8spods, err := watcher.lister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Could not list pods in namespace %s: %v", namespace, err)
+		return
+	}
+	for _, k8spod := range k8spods {
+		watcher.addOrUpdate(k8spod)
+	}
+}
+
+// namespaceChanged re-evaluates the pods in a namespace that started or stopped matching
+// the namespace selector.
+func (watcher *PodWatcher) namespaceChanged(obj any) {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		klog.Errorf("Ignoring object of unexpected type %T: %v", obj, obj)
+		metrics.WatcherUnexpectedObjects.Inc()
+		return
+	}
+	if !watcher.informer.HasSynced() {
+		// the initial pods are filtered when they are added.
+		return
+	}
+	k8spods, err := watcher.lister.Pods(namespace.Name).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Could not list pods in namespace %s: %v", namespace.Name, err)
+		return
+	}
+	watched := watcher.Watched(namespace.Name)
+	klog.Infof("Namespace %s changed, watched %v", namespace.Name, watched)
+	for _, k8spod := range k8spods {
+		if watched {
+			watcher.addOrUpdate(k8spod)
+		} else {
+			watcher.delete(k8spod)
+		}
+	}
+}
+
+func (watcher *PodWatcher) addOrUpdate(obj any) {
+	k8spod, ok := getPod(obj)
+	if !ok {
+		return
+	}
+	if !watcher.Watched(k8spod.Namespace) {
+		klog.V(3).Infof("Ignoring pod %s/%s: namespace not watched", k8spod.Namespace, k8spod.Name)
+		return
+	}
+	watcher.serializer <- func() {
+		pod, err := model.GetPodEssentials(k8spod, "", watcher.podConfig)
+		if err == nil {
+			watcher.pods.AddOrUpdate(pod)
+			return
+		}
+		if k8spod.Labels[watcher.podConfig.LabelName] == "true" {
+			klog.Infof("Ignoring pod %s/%s: %v", k8spod.Namespace, k8spod.Name, err)
+		} else {
+			klog.V(3).Infof("Ignoring pod %s/%s: %v", k8spod.Namespace, k8spod.Name, err)
+		}
+		if k8spod.Status.PodIP != "" {
+			// the pod can have been a network member before the network definitions changed.
+			// Pods without an IP are not removed since these can have been admitted already.
+			watcher.pods.Delete(k8spod.Namespace, k8spod.Name)
+		}
+	}
+}
+
+func (watcher *PodWatcher) delete(obj any) {
+	namespace, name, ok := getDeletedPodName(obj)
+	if !ok {
+		return
+	}
+	watcher.serializer <- func() {
+		watcher.pods.Delete(namespace, name)
+	}
+}
+
+// getDeletedPodName determines the pod that was deleted. When a delete event was missed,
+// the informer delivers a tombstone instead of the pod.
+func getDeletedPodName(obj any) (string, string, bool) {
+	tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+	if !ok {
+		pod, ok := getPod(obj)
+		if !ok {
+			return "", "", false
+		}
+		return pod.Namespace, pod.Name, true
+	}
+	klog.Warningf("%s: delete event was missed", tombstone.Key)
+	metrics.WatcherTombstones.Inc()
+	namespace, name, err := cache.SplitMetaNamespaceKey(tombstone.Key)
+	if err != nil {
+		klog.Errorf("Ignoring tombstone with invalid key '%s': %v", tombstone.Key, err)
+		metrics.WatcherUnexpectedObjects.Inc()
+		return "", "", false
+	}
+	return namespace, name, true
 }
 
-func getPod(obj any) *corev1.Pod {
+// getPod converts the object from the informer to a pod. Objects of other types are
+// logged and ignored.
+func getPod(obj any) (*corev1.Pod, bool) {
 	k8spod, ok := obj.(*corev1.Pod)
 	if !ok {
-		klog.Fatalf("Object of wrong type: %v", obj)
+		klog.Errorf("Ignoring object of unexpected type %T: %v", obj, obj)
+		metrics.WatcherUnexpectedObjects.Inc()
 	}
-	return k8spod
+	return k8spod, ok
 }
@@ -0,0 +1,194 @@
+package watcher
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"wamblee.org/kubedock/dns/internal/config"
+	"wamblee.org/kubedock/dns/internal/metrics"
+	"wamblee.org/kubedock/dns/internal/model"
+)
+
+// PodAdminRecorder records the pods it is notified about.
+type PodAdminRecorder struct {
+	mutex  sync.Mutex
+	pods   map[string]*model.Pod
+	synced chan struct{}
+}
+
+func NewPodAdminRecorder() *PodAdminRecorder {
+	return &PodAdminRecorder{
+		pods:   make(map[string]*model.Pod),
+		synced: make(chan struct{}),
+	}
+}
+
+func (recorder *PodAdminRecorder) AddOrUpdate(pod *model.Pod) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.pods[pod.Namespace+"/"+pod.Name] = pod
+}
+
+func (recorder *PodAdminRecorder) Delete(namespace, name string) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	delete(recorder.pods, namespace+"/"+name)
+}
+
+func (recorder *PodAdminRecorder) Synced() {
+	close(recorder.synced)
+}
+
+func (recorder *PodAdminRecorder) Names() []string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	res := make([]string, 0)
+	for key := range recorder.pods {
+		res = append(res, key)
+	}
+	slices.Sort(res)
+	return res
+}
+
+type WatcherTestSuite struct {
+	suite.Suite
+
+	podConfig config.PodConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	recorder  *PodAdminRecorder
+	clientset *fake.Clientset
+	watcher   *PodWatcher
+}
+
+func (s *WatcherTestSuite) SetupTest() {
+	s.podConfig = config.PodConfig{
+		HostAliasPrefix: "kubedock.hostalias/",
+		NetworkIdPrefix: "kubedock.network/",
+		LabelName:       "kubedock",
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.recorder = NewPodAdminRecorder()
+	s.clientset = fake.NewClientset()
+	s.watcher = NewPodWatcher(s.clientset, NewNamespaceList("kubedock"), s.recorder, s.podConfig)
+}
+
+func (s *WatcherTestSuite) TearDownTest() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func TestWatcherTestSuite(t *testing.T) {
+	suite.Run(t, &WatcherTestSuite{})
+}
+
+func (s *WatcherTestSuite) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.Nil(s.watcher.Run(s.ctx))
+	}()
+	select {
+	case <-s.recorder.synced:
+	case <-time.After(10 * time.Second):
+		s.Require().Fail("watcher did not sync")
+	}
+}
+
+func (s *WatcherTestSuite) k8sPod(name string, ip string, labeled bool) *corev1.Pod {
+	podLabels := map[string]string{}
+	if labeled {
+		podLabels[s.podConfig.LabelName] = "true"
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "kubedock",
+			Labels:    podLabels,
+			Annotations: map[string]string{
+				s.podConfig.HostAliasPrefix + "0": name,
+				s.podConfig.NetworkIdPrefix + "0": "test",
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIP: ip,
+		},
+	}
+}
+
+func (s *WatcherTestSuite) createPod(pod *corev1.Pod) {
+	_, err := s.clientset.CoreV1().Pods(pod.Namespace).Create(s.ctx, pod, metav1.CreateOptions{})
+	s.Require().Nil(err)
+}
+
+func (s *WatcherTestSuite) Test_OnlyLabeledPodsAreWatched() {
+	s.createPod(s.k8sPod("db", "10.0.0.1", true))
+	s.createPod(s.k8sPod("other", "10.0.0.2", false))
+	s.start()
+
+	s.Equal([]string{"kubedock/db"}, s.recorder.Names())
+
+	k8spods, err := s.watcher.Lister().List(labels.Everything())
+	s.Nil(err)
+	s.Equal(1, len(k8spods))
+	s.Equal("db", k8spods[0].Name)
+	s.True(s.watcher.HasSynced())
+}
+
+func (s *WatcherTestSuite) waitForPods(names ...string) {
+	names = append([]string{}, names...)
+	tend := time.Now().Add(5 * time.Second)
+	for time.Now().Before(tend) && !slices.Equal(names, s.recorder.Names()) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Equal(names, s.recorder.Names())
+}
+
+func (s *WatcherTestSuite) Test_TombstoneIsProcessedAsDelete() {
+	s.createPod(s.k8sPod("db", "10.0.0.1", true))
+	s.createPod(s.k8sPod("service", "10.0.0.2", true))
+	s.start()
+	s.waitForPods("kubedock/db", "kubedock/service")
+
+	tombstones := testutil.ToFloat64(metrics.WatcherTombstones)
+	s.watcher.delete(cache.DeletedFinalStateUnknown{
+		Key: "kubedock/db",
+		Obj: s.k8sPod("db", "10.0.0.1", true),
+	})
+	s.waitForPods("kubedock/service")
+
+	// the last known state in the tombstone is not necessarily a pod.
+	s.watcher.delete(cache.DeletedFinalStateUnknown{
+		Key: "kubedock/service",
+		Obj: "unknown",
+	})
+	s.waitForPods()
+	s.Equal(tombstones+2, testutil.ToFloat64(metrics.WatcherTombstones))
+}
+
+func (s *WatcherTestSuite) Test_UnexpectedObjectsAreIgnored() {
+	s.createPod(s.k8sPod("db", "10.0.0.1", true))
+	s.start()
+	s.waitForPods("kubedock/db")
+
+	unexpected := testutil.ToFloat64(metrics.WatcherUnexpectedObjects)
+	s.watcher.addOrUpdate("garbage")
+	s.watcher.addOrUpdate(&corev1.Service{})
+	s.watcher.delete(&corev1.ConfigMap{})
+	s.watcher.delete(cache.DeletedFinalStateUnknown{Key: "a/b/c"})
+	s.Equal(unexpected+4, testutil.ToFloat64(metrics.WatcherUnexpectedObjects))
+
+	// the watcher still processes events
+	s.createPod(s.k8sPod("service", "10.0.0.2", true))
+	s.waitForPods("kubedock/db", "kubedock/service")
+}